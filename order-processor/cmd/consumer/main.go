@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -12,6 +16,7 @@ import (
 	"github.com/xilapa/go-tiny-projects/order-processor/config"
 	"github.com/xilapa/go-tiny-projects/order-processor/internal/order/infra/database"
 	"github.com/xilapa/go-tiny-projects/order-processor/internal/order/usecases"
+	"github.com/xilapa/go-tiny-projects/order-processor/pkg/outbox"
 	rabbithelper "github.com/xilapa/go-tiny-projects/order-processor/pkg/rabbitmq"
 	strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
 )
@@ -26,17 +31,40 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	repo := database.NewOrderRepository(db)
+	repo := database.NewOrderRepositoryWithEvents(db, "order-events", "orders.priced")
 	useCase := usecases.NewCalculateFinalPriceUseCase(repo)
 
+	// the order priced events are published after the orders are saved,
+	// on their own exchange, the orders one fans out to the orders queue
+	eventsCh := rabbithelper.SetupProducerChannel(
+		cfg.RabbitMq.Url,
+		"consume-events",
+		"order-events",
+		"orders-priced",
+		"orders.priced",
+	)
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayStopped := make(chan struct{})
+	go func() {
+		defer close(relayStopped)
+		outbox.NewRelay(db, eventsCh, outbox.RelayOpts{}).Run(relayCtx)
+	}()
+
 	ch := rabbithelper.SetupConsumeChannel(
 		cfg.RabbitMq.Url,
 		"consume",
 		"orders",
 	)
 
-	out := make(chan amqp.Delivery, 2)
-	go ch.Consume(&strongrabbit.ConsumeOpts{
+	// the orders already processed are acked without handling them again,
+	// the handler records them on the transaction that saves the order
+	ordersHandler := strongrabbit.Dedup(
+		strongrabbit.Typed(handler(useCase), poisonHandler),
+		strongrabbit.DedupOpts{Store: database.NewDedupStore(db), MarkedByHandler: true},
+	)
+
+	workerCount := 5
+	go ch.ConsumeWithHandler(&strongrabbit.ConsumeOpts{
 		Queue:     "orders",
 		Consumer:  "order-consumer-go",
 		AutoAck:   false,
@@ -44,37 +72,52 @@ func main() {
 		NoLocal:   false,
 		NoWait:    false,
 		Args:      nil,
-	}, out)
-
-	workerCount := 5
-	for i := 1; i <= workerCount; i++ {
-		go worker(out, useCase, i)
-	}
+	}, ordersHandler, workerCount)
 
 	getTotalUC := usecases.NewGetTotalUseCase(repo)
 
 	http.HandleFunc("/status", statusHandler(getTotalUC))
-	http.ListenAndServe(":8080", nil)
+	http.Handle("/metrics", strongrabbit.MetricsHandler())
+	http.Handle("/health", strongrabbit.HealthHandler())
+	go http.ListenAndServe(":8080", nil)
+
+	// on shutdown the orders being processed are acked, and their
+	// events confirmed, before the channels close
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelShutdown()
+	if err := ch.Shutdown(ctx); err != nil {
+		log.Printf("cannot drain the orders consumer: %s", err)
+	}
+	stopRelay()
+	<-relayStopped
+	if err := eventsCh.Shutdown(ctx); err != nil {
+		log.Printf("cannot drain the events publisher: %s", err)
+	}
 }
 
-func worker(deliveries <-chan amqp.Delivery, uc *usecases.CalculateFinalPriceUseCase, workerID int) {
-	for msg := range deliveries {
-		var cmmd usecases.OrderCommand
-		if err := json.Unmarshal(msg.Body, &cmmd); err != nil {
-			log.Printf("bad coded message: %s", string(msg.Body))
-			msg.Ack(false)
-			continue
-		}
+func handler(uc *usecases.CalculateFinalPriceUseCase) strongrabbit.TypedHandler[usecases.OrderCommand] {
+	return func(cmmd usecases.OrderCommand, msg amqp.Delivery) strongrabbit.Decision {
+		cmmd.MessageKey = strongrabbit.MessageIdKey(msg)
 		res, err := uc.Handle(&cmmd)
 		if err != nil {
 			log.Printf("error processing the message: %s", err)
+			return strongrabbit.Retry(err)
 		}
-		msg.Ack(false)
-		fmt.Printf("Worker %d processed order %s\n", workerID, res.ID)
+		fmt.Printf("processed order %s\n", res.ID)
 		<-time.After(time.Second * 10)
+		return strongrabbit.Ack
 	}
 }
 
+func poisonHandler(msg amqp.Delivery, err error) strongrabbit.Decision {
+	log.Printf("bad coded message: %s, %s", string(msg.Body), err)
+	return strongrabbit.Reject
+}
+
 func statusHandler(uc *usecases.GetTotalUseCase) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != "GET" {
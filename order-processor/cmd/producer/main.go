@@ -2,8 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"math/rand"
 	"time"
@@ -16,6 +14,9 @@ import (
 	strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
 )
 
+// batchSize is how many orders are published together
+const batchSize = 10
+
 func main() {
 	cfg, err := config.NewConfig()
 	if err != nil {
@@ -31,51 +32,59 @@ func main() {
 	)
 
 	for producerLoop := true; producerLoop; {
-		if ch.Done {
+		if ch.Stopped() {
 			producerLoop = false
 			continue
 		}
-		err := Publish(ch, GenerateOrder())
+		batch := make([]*orders.Order, batchSize)
+		for i := range batch {
+			batch[i] = GenerateOrder()
+		}
+		err := PublishOrders(ch, batch)
 		if err != nil {
-			fmt.Printf("error while publishing order: %s", err)
+			fmt.Printf("error while publishing orders: %s", err)
 			<-time.After(time.Second * 5)
 			continue
 		}
-		fmt.Println("message published")
+		fmt.Printf("%d messages published\n", len(batch))
 		<-time.After(time.Second * 5)
 	}
 	fmt.Println("producer program finalized")
 }
 
-func Publish(ch *strongrabbit.StrongChannel, order *orders.Order) error {
-	body, err := json.Marshal(*order)
-	if err != nil {
-		return err
-	}
-
+// PublishOrders publishes the orders together, waiting for all the
+// confirmations at once. The nacked ones are published again.
+func PublishOrders(ch strongrabbit.BatchPublisher, batch []*orders.Order) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
-	confirm, err := ch.PublishWithDeferredConfirmWithContext(
-		ctx,
-		"order-processor",
-		"orders",
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
-
+	codec, err := strongrabbit.CodecFor(strongrabbit.ContentTypeJSON)
 	if err != nil {
 		return err
 	}
 
-	published := confirm.Wait()
-	if !published {
-		return errors.New("not confirmed")
+	msgs := make([]strongrabbit.BatchMessage, 0, len(batch))
+	for _, order := range batch {
+		body, err := codec.Marshal(*order)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, strongrabbit.BatchMessage{
+			Exchange: "order-processor",
+			Key:      "orders",
+			// the order id lets the consumer discard the duplicates
+			Msg: amqp.Publishing{ContentType: codec.ContentType(), MessageId: order.ID, Body: body},
+		})
 	}
 
+	results, err := ch.PublishBatch(ctx, msgs, strongrabbit.BatchOpts{})
+	if err != nil {
+		for i, r := range results {
+			if !r.Acked {
+				return fmt.Errorf("order %s not published: %w", batch[i].ID, r.Err)
+			}
+		}
+		return err
+	}
 	return nil
 }
 
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	orders "github.com/xilapa/go-tiny-projects/order-processor/internal/order/entity"
+	strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+func TestPublishOrdersSendsTheBatch(t *testing.T) {
+	// arrange
+	ch := strongrabbit.NewFakeChannel()
+	batch := []*orders.Order{GenerateOrder(), GenerateOrder()}
+
+	// act
+	err := PublishOrders(ch, batch)
+
+	// assert
+	assert.NoError(t, err)
+	published := ch.Published()
+	assert.Equal(t, 2, len(published))
+	for i, p := range published {
+		assert.Equal(t, "order-processor", p.Exchange)
+		assert.Equal(t, "orders", p.Key)
+		assert.Equal(t, "application/json", p.Msg.ContentType)
+		assert.Equal(t, batch[i].ID, p.Msg.MessageId)
+		var body orders.Order
+		assert.NoError(t, json.Unmarshal(p.Msg.Body, &body))
+		assert.Equal(t, *batch[i], body)
+	}
+}
+
+func TestPublishOrdersFailsWhenNotConfirmed(t *testing.T) {
+	// arrange
+	ch := strongrabbit.NewFakeChannel()
+	ch.NackPublishes(true)
+
+	// act
+	err := PublishOrders(ch, []*orders.Order{GenerateOrder()})
+
+	// assert
+	assert.True(t, errors.Is(err, strongrabbit.ErrNacked))
+}
+
+func TestPublishOrdersReturnsThePublishError(t *testing.T) {
+	// arrange
+	ch := strongrabbit.NewFakeChannel()
+	failure := errors.New("channel is closed")
+	ch.FailPublishes(failure)
+
+	// act
+	err := PublishOrders(ch, []*orders.Order{GenerateOrder()})
+
+	// assert
+	assert.True(t, errors.Is(err, failure))
+	assert.Equal(t, 0, len(ch.Published()))
+}
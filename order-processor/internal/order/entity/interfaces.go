@@ -2,5 +2,8 @@ package orders
 
 type OrderRepo interface {
 	Save(*Order) (int64, error)
+	// SaveProcessed saves the order and records the key of the message
+	// that carried it as processed, atomically. An empty key is not recorded.
+	SaveProcessed(o *Order, messageKey string) (int64, error)
 	GetTotal() (int, error)
 }
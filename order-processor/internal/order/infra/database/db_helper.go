@@ -1,6 +1,10 @@
 package database
 
-import "database/sql"
+import (
+	"database/sql"
+
+	"github.com/xilapa/go-tiny-projects/order-processor/pkg/outbox"
+)
 
 func InitialiazeDb(connString string) (*sql.DB, error) {
 	if connString == "" {
@@ -25,10 +29,32 @@ func InitialiazeDb(connString string) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	_, err = db.Exec(
+		`CREATE TABLE IF NOT EXISTS processed_messages (
+			key varchar(255) NOT NULL PRIMARY KEY,
+			processed_at integer NOT NULL
+			)`)
+	if err != nil {
+		return nil, err
+	}
+
+	err = outbox.CreateTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
 func ClearOrders(db *sql.DB) error {
 	_, err := db.Exec("DELETE FROM orders")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM outbox")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM processed_messages")
 	return err
 }
@@ -0,0 +1,44 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
+)
+
+// DedupStore records the keys of the processed messages on the
+// processed_messages table, they are kept as long as the orders.
+type DedupStore struct {
+	Db *sql.DB
+}
+
+func NewDedupStore(db *sql.DB) *DedupStore {
+	return &DedupStore{Db: db}
+}
+
+var _ strongrabbit.DedupStore = (*DedupStore)(nil)
+
+func (s *DedupStore) Seen(key string) (bool, error) {
+	var total int
+	err := s.Db.QueryRow("SELECT COUNT(key) FROM processed_messages WHERE key = ?", key).
+		Scan(&total)
+	if err != nil {
+		return false, err
+	}
+	return total > 0, nil
+}
+
+func (s *DedupStore) Mark(key string) error {
+	_, err := s.Db.Exec(markProcessedQuery, key, time.Now().UnixMilli())
+	return err
+}
+
+const markProcessedQuery = "INSERT OR IGNORE INTO processed_messages (key, processed_at) VALUES (?,?)"
+
+// MarkProcessed records the key as processed on the transaction, so the
+// message is marked only if the writes of its processing are committed.
+func MarkProcessed(tx *sql.Tx, key string) error {
+	_, err := tx.Exec(markProcessedQuery, key, time.Now().UnixMilli())
+	return err
+}
@@ -0,0 +1,30 @@
+package database
+
+import (
+	"testing"
+
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+func TestDedupStore(t *testing.T) {
+	// arrange
+	db, err := InitialiazeDb("")
+	assert.NoError(t, err)
+	defer db.Close()
+	store := NewDedupStore(db)
+
+	// act
+	seenBefore, err := store.Seen("order-1")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Mark("order-1"))
+	assert.NoError(t, store.Mark("order-1"))
+	seenAfter, err := store.Seen("order-1")
+	assert.NoError(t, err)
+	seenOther, err := store.Seen("order-2")
+	assert.NoError(t, err)
+
+	// assert
+	assert.False(t, seenBefore)
+	assert.True(t, seenAfter)
+	assert.False(t, seenOther)
+}
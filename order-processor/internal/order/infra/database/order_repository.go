@@ -2,26 +2,51 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 
+	amqp "github.com/rabbitmq/amqp091-go"
 	orders "github.com/xilapa/go-tiny-projects/order-processor/internal/order/entity"
+	"github.com/xilapa/go-tiny-projects/order-processor/pkg/outbox"
 )
 
+// OrderPricedEvent is the message type of the events written
+// to the outbox when an order is saved.
+const OrderPricedEvent = "order.priced"
+
 type OrderRepository struct {
-	Db *sql.DB
+	Db             *sql.DB
+	eventsExchange string
+	eventsKey      string
 }
 
 func NewOrderRepository(db *sql.DB) *OrderRepository {
 	return &OrderRepository{Db: db}
 }
 
+// NewOrderRepositoryWithEvents creates an OrderRepository that writes an
+// order priced event to the outbox, on the same transaction that saves
+// the order. The outbox relay publishes it to the exchange with the key.
+func NewOrderRepositoryWithEvents(db *sql.DB, exchange, key string) *OrderRepository {
+	return &OrderRepository{Db: db, eventsExchange: exchange, eventsKey: key}
+}
+
 var _ orders.OrderRepo = (*OrderRepository)(nil)
 
 func (r *OrderRepository) Save(o *orders.Order) (int64, error) {
-	stmt, err := r.Db.Prepare("INSERT INTO orders (id, price, tax, final_price) VALUES (?,?,?,?)")
+	return r.SaveProcessed(o, "")
+}
+
+// SaveProcessed saves the order, its event and the message key as
+// processed on the same transaction.
+func (r *OrderRepository) SaveProcessed(o *orders.Order, messageKey string) (int64, error) {
+	tx, err := r.Db.Begin()
 	if err != nil {
 		return 0, err
 	}
-	res, err := stmt.Exec(o.ID, o.Price, o.Tax, o.FinalPrice)
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO orders (id, price, tax, final_price) VALUES (?,?,?,?)",
+		o.ID, o.Price, o.Tax, o.FinalPrice)
 	if err != nil {
 		return 0, err
 	}
@@ -31,6 +56,33 @@ func (r *OrderRepository) Save(o *orders.Order) (int64, error) {
 		return 0, err
 	}
 
+	if r.eventsExchange != "" {
+		body, err := json.Marshal(o)
+		if err != nil {
+			return 0, err
+		}
+		err = outbox.Add(tx, r.eventsExchange, r.eventsKey, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Type:         OrderPricedEvent,
+			MessageId:    OrderPricedEvent + "-" + o.ID,
+			Body:         body,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if messageKey != "" {
+		if err := MarkProcessed(tx, messageKey); err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
 	return rows, nil
 }
 
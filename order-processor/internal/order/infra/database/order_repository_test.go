@@ -2,10 +2,12 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
+	amqp "github.com/rabbitmq/amqp091-go"
 	orders "github.com/xilapa/go-tiny-projects/order-processor/internal/order/entity"
 	assert "github.com/xilapa/go-tiny-projects/test-assertions"
 )
@@ -63,6 +65,65 @@ func (s *orderRepositoryTestSuite) canCountTotalOrders(t *testing.T) {
 	assert.Equal(t, expectedTotal, total)
 }
 
+func (s *orderRepositoryTestSuite) savesOrderPricedEventOnTheOutbox(t *testing.T) {
+	// arrange
+	order, err := orders.NewOrder("123", 12.1, 2)
+	assert.NoError(t, err)
+	order.CalculateFinalPrice()
+	repo := NewOrderRepositoryWithEvents(s.Db, "order-processor", "orders.priced")
+
+	// act
+	_, err = repo.Save(order)
+	assert.NoError(t, err)
+	_, duplicatedErr := repo.Save(order)
+
+	// assert
+	assert.Error(t, duplicatedErr)
+	var events int
+	assert.NoError(t, s.Db.QueryRow("SELECT COUNT(id) FROM outbox").Scan(&events))
+	assert.Equal(t, 1, events)
+	var exchange, key, messageType, body string
+	var deliveryMode uint8
+	err = s.Db.QueryRow(
+		` SELECT
+					exchange, routing_key, message_type, delivery_mode, body
+				FROM
+					outbox`).
+		Scan(&exchange, &key, &messageType, &deliveryMode, &body)
+	assert.NoError(t, err)
+	assert.Equal(t, "order-processor", exchange)
+	assert.Equal(t, "orders.priced", key)
+	assert.Equal(t, OrderPricedEvent, messageType)
+	assert.Equal(t, amqp.Persistent, deliveryMode)
+	var res orders.Order
+	assert.NoError(t, json.Unmarshal([]byte(body), &res))
+	assert.Equal(t, order, &res)
+}
+
+func (s *orderRepositoryTestSuite) marksTheMessageProcessedWithTheOrder(t *testing.T) {
+	// arrange
+	order, err := orders.NewOrder("123", 12.1, 2)
+	assert.NoError(t, err)
+	order.CalculateFinalPrice()
+	repo := NewOrderRepository(s.Db)
+	store := NewDedupStore(s.Db)
+
+	// act
+	_, err = repo.SaveProcessed(order, "order-123")
+	assert.NoError(t, err)
+	// the duplicated order rolls back the mark of the other message
+	_, duplicatedErr := repo.SaveProcessed(order, "order-123-copy")
+
+	// assert
+	assert.Error(t, duplicatedErr)
+	seen, err := store.Seen("order-123")
+	assert.NoError(t, err)
+	assert.True(t, seen)
+	seenCopy, err := store.Seen("order-123-copy")
+	assert.NoError(t, err)
+	assert.False(t, seenCopy)
+}
+
 func TestOrderRepository(t *testing.T) {
 	// setup
 	t.Parallel() // run parallel with other tests, not with each other
@@ -75,8 +136,10 @@ func TestOrderRepository(t *testing.T) {
 
 	// run tests
 	tests := map[string]func(t *testing.T){
-		"CanSaveOrderToDb":    suite.canSaveOrderToDb,
-		"CanCountTotalOrders": suite.canCountTotalOrders,
+		"CanSaveOrderToDb":                     suite.canSaveOrderToDb,
+		"CanCountTotalOrders":                  suite.canCountTotalOrders,
+		"SavesOrderPricedEventOnTheOutbox":     suite.savesOrderPricedEventOnTheOutbox,
+		"MarksTheMessageProcessedWithTheOrder": suite.marksTheMessageProcessedWithTheOrder,
 	}
 
 	for i := range tests {
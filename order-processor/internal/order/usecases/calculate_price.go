@@ -8,6 +8,9 @@ type OrderCommand struct {
 	ID    string
 	Price float64
 	Tax   float64
+	// MessageKey is the key of the message that carried the command,
+	// recorded as processed with the order. It's not part of the body.
+	MessageKey string `json:"-"`
 }
 
 type OrderResult struct {
@@ -35,7 +38,7 @@ func (u *CalculateFinalPriceUseCase) Handle(cmmd *OrderCommand) (*OrderResult, e
 
 	order.CalculateFinalPrice()
 
-	_, err = u.OrderRepository.Save(order)
+	_, err = u.OrderRepository.SaveProcessed(order, cmmd.MessageKey)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,319 @@
+// Package outbox implements the transactional outbox: messages are
+// written to an outbox table on the same transaction of the business
+// write, and a Relay publishes them after the commit. A rolled back
+// transaction leaves no message, and a committed one is published even
+// if the broker is down at the time.
+//
+// The delivery is at-least-once, a message whose confirmation arrives
+// but cannot be marked as sent is published again. Each message has a
+// stable MessageId, the consumers can use it to discard duplicates.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
+)
+
+// CreateTable creates the outbox table if it doesn't exist.
+func CreateTable(db *sql.DB) error {
+	_, err := db.Exec(
+		`CREATE TABLE IF NOT EXISTS outbox (
+			id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			exchange varchar(255) NOT NULL,
+			routing_key varchar(255) NOT NULL,
+			content_type varchar(255) NOT NULL,
+			content_encoding varchar(255) NOT NULL,
+			delivery_mode integer NOT NULL,
+			priority integer NOT NULL,
+			correlation_id varchar(255) NOT NULL,
+			reply_to varchar(255) NOT NULL,
+			expiration varchar(255) NOT NULL,
+			message_id varchar(255) NOT NULL,
+			timestamp integer,
+			message_type varchar(255) NOT NULL,
+			user_id varchar(255) NOT NULL,
+			app_id varchar(255) NOT NULL,
+			headers blob,
+			body blob,
+			created_at integer NOT NULL,
+			attempts integer NOT NULL DEFAULT 0,
+			next_attempt_at integer NOT NULL,
+			last_error text,
+			sent_at integer
+			)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (sent_at, attempts)`)
+	return err
+}
+
+// the types the headers can hold besides the basic ones, gob
+// needs them to encode the header values
+func init() {
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+	gob.Register(amqp.Decimal{})
+}
+
+// Add writes the message to the outbox on the given transaction, it's
+// published by the Relay after the transaction commits. All the
+// properties of msg are kept, the headers are stored gob encoded so
+// their values come back with the same types.
+func Add(tx *sql.Tx, exchange, key string, msg amqp.Publishing) error {
+	var headers []byte
+	if len(msg.Headers) > 0 {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(msg.Headers); err != nil {
+			return err
+		}
+		headers = buf.Bytes()
+	}
+	var timestamp sql.NullInt64
+	if !msg.Timestamp.IsZero() {
+		timestamp = sql.NullInt64{Int64: msg.Timestamp.UnixMilli(), Valid: true}
+	}
+	now := time.Now().UnixMilli()
+	_, err := tx.Exec(
+		`INSERT INTO outbox
+			(exchange, routing_key, content_type, content_encoding, delivery_mode, priority,
+			correlation_id, reply_to, expiration, message_id, timestamp, message_type,
+			user_id, app_id, headers, body, created_at, next_attempt_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		exchange, key, msg.ContentType, msg.ContentEncoding, msg.DeliveryMode, msg.Priority,
+		msg.CorrelationId, msg.ReplyTo, msg.Expiration, msg.MessageId, timestamp, msg.Type,
+		msg.UserId, msg.AppId, headers, msg.Body, now, now)
+	return err
+}
+
+// RelayOpts is a struct that encapsulates the settings of a Relay.
+type RelayOpts struct {
+	Interval       time.Duration // how often the pending messages are read, defaults to 1s
+	BatchSize      int           // how many messages are read at a time, defaults to 100
+	ConfirmTimeout time.Duration // how long a publish waits for its confirmation, defaults to 5s
+	RetryDelay     time.Duration // the delay after the first failure, it grows with the attempts, defaults to 5s
+	MaxAttempts    int           // after that a message is no longer published, defaults to 10
+	Retention      time.Duration // how long the sent messages are kept, defaults to 24h
+}
+
+// DefaultRelayOpts are the settings used for the zero fields of RelayOpts.
+var DefaultRelayOpts = RelayOpts{
+	Interval:       time.Second,
+	BatchSize:      100,
+	ConfirmTimeout: 5 * time.Second,
+	RetryDelay:     5 * time.Second,
+	MaxAttempts:    10,
+	Retention:      24 * time.Hour,
+}
+
+// withDefaults fills the zero fields with the DefaultRelayOpts values
+func (o RelayOpts) withDefaults() RelayOpts {
+	if o.Interval <= 0 {
+		o.Interval = DefaultRelayOpts.Interval
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = DefaultRelayOpts.BatchSize
+	}
+	if o.ConfirmTimeout <= 0 {
+		o.ConfirmTimeout = DefaultRelayOpts.ConfirmTimeout
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = DefaultRelayOpts.RetryDelay
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultRelayOpts.MaxAttempts
+	}
+	if o.Retention <= 0 {
+		o.Retention = DefaultRelayOpts.Retention
+	}
+	return o
+}
+
+var errNotConfirmed = errors.New("message not confirmed by the broker")
+
+// Relay publishes the outbox messages, in the order they were added,
+// through a confirm mode publisher, eg.: a StrongChannel.
+//
+// A message that fails is retried after RetryDelay times its attempts,
+// the messages after it wait, to keep the order. When the attempts run
+// out the message stays on the table, with its last error, and the
+// next ones are published.
+type Relay struct {
+	db   *sql.DB
+	pub  strongrabbit.MessagePublisher
+	opts RelayOpts
+}
+
+// NewRelay creates a Relay publishing the messages of the outbox table.
+func NewRelay(db *sql.DB, pub strongrabbit.MessagePublisher, opts RelayOpts) *Relay {
+	return &Relay{db: db, pub: pub, opts: opts.withDefaults()}
+}
+
+// Run publishes the pending messages and deletes the old sent ones every
+// Interval, until the context is done. It returns ctx.Err().
+func (r *Relay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.RelayPending(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("outbox relay failed: %s", err)
+		}
+		if _, err := r.Cleanup(); err != nil {
+			log.Printf("outbox cleanup failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// pending is an outbox message waiting to be published
+type pending struct {
+	id       int64
+	exchange string
+	key      string
+	attempts int
+	next     int64 // when the message can be published, in unix milliseconds
+	msg      amqp.Publishing
+}
+
+// RelayPending publishes a batch of the pending messages, marking them as
+// sent. It stops on the first failure, recording it on the message, and
+// returns how many messages were sent.
+func (r *Relay) RelayPending(ctx context.Context) (int, error) {
+	batch, err := r.pending()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UnixMilli()
+	for i, p := range batch {
+		// a message waiting for its retry holds the next ones
+		if p.next > now {
+			return i, nil
+		}
+		if err := r.publish(ctx, p); err != nil {
+			// the relay is stopping, it's not an attempt
+			if ctx.Err() != nil {
+				return i, ctx.Err()
+			}
+			if failErr := r.fail(p, err); failErr != nil {
+				return i, failErr
+			}
+			return i, err
+		}
+		if err := r.markSent(p); err != nil {
+			return i, err
+		}
+	}
+	return len(batch), nil
+}
+
+// pending reads the messages not sent yet, in order
+func (r *Relay) pending() ([]pending, error) {
+	rows, err := r.db.Query(
+		`SELECT id, exchange, routing_key, content_type, content_encoding, delivery_mode, priority,
+			correlation_id, reply_to, expiration, message_id, timestamp, message_type,
+			user_id, app_id, headers, body, attempts, next_attempt_at
+		FROM outbox
+		WHERE sent_at IS NULL AND attempts < ?
+		ORDER BY id
+		LIMIT ?`,
+		r.opts.MaxAttempts, r.opts.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		var headers []byte
+		var timestamp sql.NullInt64
+		err := rows.Scan(&p.id, &p.exchange, &p.key, &p.msg.ContentType, &p.msg.ContentEncoding,
+			&p.msg.DeliveryMode, &p.msg.Priority, &p.msg.CorrelationId, &p.msg.ReplyTo,
+			&p.msg.Expiration, &p.msg.MessageId, &timestamp, &p.msg.Type, &p.msg.UserId,
+			&p.msg.AppId, &headers, &p.msg.Body, &p.attempts, &p.next)
+		if err != nil {
+			return nil, err
+		}
+		if timestamp.Valid {
+			p.msg.Timestamp = time.UnixMilli(timestamp.Int64)
+		}
+		if len(headers) > 0 {
+			if err := gob.NewDecoder(bytes.NewReader(headers)).Decode(&p.msg.Headers); err != nil {
+				return nil, err
+			}
+		}
+		if p.msg.MessageId == "" {
+			p.msg.MessageId = "outbox-" + strconv.FormatInt(p.id, 10)
+		}
+		batch = append(batch, p)
+	}
+	return batch, rows.Err()
+}
+
+// publish sends the message and waits for its confirmation
+func (r *Relay) publish(ctx context.Context, p pending) error {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.ConfirmTimeout)
+	defer cancel()
+
+	confirm, err := r.pub.PublishConfirmed(ctx, p.exchange, p.key, false, false, p.msg)
+	if err != nil {
+		return err
+	}
+	confirmed, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		if err := confirm.Err(); err != nil {
+			return err
+		}
+		return errNotConfirmed
+	}
+	return nil
+}
+
+// markSent records the message was published
+func (r *Relay) markSent(p pending) error {
+	_, err := r.db.Exec(`UPDATE outbox SET sent_at = ? WHERE id = ?`, time.Now().UnixMilli(), p.id)
+	return err
+}
+
+// fail records a failed attempt, delaying the next one
+func (r *Relay) fail(p pending, cause error) error {
+	attempts := p.attempts + 1
+	next := time.Now().Add(r.opts.RetryDelay * time.Duration(attempts))
+	_, err := r.db.Exec(
+		`UPDATE outbox SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?`,
+		attempts, cause.Error(), next.UnixMilli(), p.id)
+	if err == nil && attempts >= r.opts.MaxAttempts {
+		log.Printf("outbox message %d gave up after %d attempts: %s", p.id, attempts, cause)
+	}
+	return err
+}
+
+// Cleanup deletes the messages sent before the Retention,
+// returning how many were deleted.
+func (r *Relay) Cleanup() (int64, error) {
+	before := time.Now().Add(-r.opts.Retention).UnixMilli()
+	res, err := r.db.Exec(`DELETE FROM outbox WHERE sent_at IS NOT NULL AND sent_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,226 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	amqp "github.com/rabbitmq/amqp091-go"
+	strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+// openDb opens a file database with the outbox table, the in-memory
+// databases are not shared between the pool connections
+func openDb(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "outbox.db")+"?_busy_timeout=5000")
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	assert.NoError(t, CreateTable(db))
+	return db
+}
+
+// addMessages adds the messages on a transaction, committing or rolling it back
+func addMessages(t *testing.T, db *sql.DB, commit bool, bodies ...string) {
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	for _, body := range bodies {
+		err = Add(tx, "order-processor", "orders.priced", amqp.Publishing{
+			ContentType: "application/json",
+			Headers:     amqp.Table{"tenant": "a"},
+			Body:        []byte(body),
+		})
+		assert.NoError(t, err)
+	}
+	if commit {
+		assert.NoError(t, tx.Commit())
+	} else {
+		assert.NoError(t, tx.Rollback())
+	}
+}
+
+// count returns how many outbox rows match the condition
+func count(t *testing.T, db *sql.DB, where string) int {
+	var total int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(id) FROM outbox WHERE "+where).Scan(&total))
+	return total
+}
+
+func TestRelayPublishesTheCommittedMessages(t *testing.T) {
+	// arrange
+	db := openDb(t)
+	pub := strongrabbit.NewFakeChannel()
+	relay := NewRelay(db, pub, RelayOpts{})
+	addMessages(t, db, true, "first", "second")
+	addMessages(t, db, false, "rolled back")
+
+	// act
+	sent, err := relay.RelayPending(context.Background())
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	published := pub.Published()
+	assert.Equal(t, 2, len(published))
+	assert.Equal(t, "first", string(published[0].Msg.Body))
+	assert.Equal(t, "second", string(published[1].Msg.Body))
+	assert.Equal(t, "orders.priced", published[0].Key)
+	assert.Equal(t, "application/json", published[0].Msg.ContentType)
+	assert.Equal(t, "a", published[0].Msg.Headers["tenant"])
+	assert.Equal(t, "outbox-1", published[0].Msg.MessageId)
+	assert.Equal(t, 2, count(t, db, "sent_at IS NOT NULL"))
+}
+
+func TestRelayKeepsTheMessageProperties(t *testing.T) {
+	// arrange
+	db := openDb(t)
+	pub := strongrabbit.NewFakeChannel()
+	relay := NewRelay(db, pub, RelayOpts{})
+	msg := amqp.Publishing{
+		Headers:         amqp.Table{"attempt": int32(2), "tenant": "a", "nested": amqp.Table{"retried": true}},
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		DeliveryMode:    amqp.Persistent,
+		Priority:        5,
+		CorrelationId:   "order-1",
+		ReplyTo:         "replies",
+		Expiration:      "60000",
+		MessageId:       "order-priced-1",
+		Timestamp:       time.UnixMilli(time.Now().UnixMilli()),
+		Type:            "order-priced",
+		UserId:          "guest",
+		AppId:           "order-processor",
+		Body:            []byte("order"),
+	}
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, Add(tx, "order-processor", "orders.priced", msg))
+	assert.NoError(t, tx.Commit())
+
+	// act
+	_, err = relay.RelayPending(context.Background())
+
+	// assert
+	assert.NoError(t, err)
+	published := pub.Published()
+	assert.Equal(t, 1, len(published))
+	assert.True(t, published[0].Msg.Timestamp.Equal(msg.Timestamp))
+	published[0].Msg.Timestamp = msg.Timestamp
+	assert.Equal(t, msg, published[0].Msg)
+}
+
+var relayFailureData = map[string]struct {
+	fail func(pub *strongrabbit.FakeChannel)
+	err  error
+}{
+	"publish error": {
+		fail: func(pub *strongrabbit.FakeChannel) { pub.FailPublishes(errPublishTest) },
+		err:  errPublishTest,
+	},
+	"nack": {
+		fail: func(pub *strongrabbit.FakeChannel) { pub.NackPublishes(true) },
+		err:  errNotConfirmed,
+	},
+}
+
+var errPublishTest = errors.New("channel is reconnecting")
+
+func TestRelayRetriesTheFailedMessagesInOrder(t *testing.T) {
+	for name, d := range relayFailureData {
+		t.Run(name, func(t *testing.T) {
+			// arrange
+			db := openDb(t)
+			pub := strongrabbit.NewFakeChannel()
+			relay := NewRelay(db, pub, RelayOpts{RetryDelay: 50 * time.Millisecond})
+			addMessages(t, db, true, "first", "second")
+			d.fail(pub)
+
+			// act
+			sent, err := relay.RelayPending(context.Background())
+			pub.FailPublishes(nil)
+			pub.NackPublishes(false)
+			sentBeforeTheDelay, errBeforeTheDelay := relay.RelayPending(context.Background())
+			time.Sleep(60 * time.Millisecond)
+			sentAfterTheDelay, errAfterTheDelay := relay.RelayPending(context.Background())
+
+			// assert
+			assert.True(t, errors.Is(err, d.err))
+			assert.Equal(t, 0, sent)
+			assert.Equal(t, 1, count(t, db, "attempts = 1 AND last_error IS NOT NULL"))
+			assert.NoError(t, errBeforeTheDelay)
+			assert.Equal(t, 0, sentBeforeTheDelay)
+			assert.NoError(t, errAfterTheDelay)
+			assert.Equal(t, 2, sentAfterTheDelay)
+			published := pub.Published()
+			assert.Equal(t, "first", string(published[len(published)-2].Msg.Body))
+			assert.Equal(t, "second", string(published[len(published)-1].Msg.Body))
+		})
+	}
+}
+
+func TestRelaySkipsTheMessagesWithoutAttemptsLeft(t *testing.T) {
+	// arrange
+	db := openDb(t)
+	pub := strongrabbit.NewFakeChannel()
+	relay := NewRelay(db, pub, RelayOpts{RetryDelay: time.Millisecond, MaxAttempts: 1})
+	addMessages(t, db, true, "first", "second")
+	pub.FailPublishes(errPublishTest)
+	_, err := relay.RelayPending(context.Background())
+	assert.True(t, errors.Is(err, errPublishTest))
+	pub.FailPublishes(nil)
+
+	// act
+	sent, err := relay.RelayPending(context.Background())
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, "second", string(pub.Published()[0].Msg.Body))
+	assert.Equal(t, 1, count(t, db, "sent_at IS NULL AND attempts = 1"))
+}
+
+func TestCleanupDeletesTheOldSentMessages(t *testing.T) {
+	// arrange
+	db := openDb(t)
+	relay := NewRelay(db, strongrabbit.NewFakeChannel(), RelayOpts{Retention: time.Millisecond})
+	addMessages(t, db, true, "sent")
+	_, err := relay.RelayPending(context.Background())
+	assert.NoError(t, err)
+	addMessages(t, db, true, "pending")
+	time.Sleep(5 * time.Millisecond)
+
+	// act
+	deleted, err := relay.Cleanup()
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	assert.Equal(t, 1, count(t, db, "sent_at IS NULL"))
+}
+
+func TestRunRelaysUntilTheContextIsDone(t *testing.T) {
+	// arrange
+	db := openDb(t)
+	pub := strongrabbit.NewFakeChannel()
+	relay := NewRelay(db, pub, RelayOpts{Interval: 10 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- relay.Run(ctx) }()
+
+	// act
+	addMessages(t, db, true, "order")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pub.Published()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	// assert
+	assert.True(t, errors.Is(<-stopped, context.Canceled))
+	assert.Equal(t, 1, len(pub.Published()))
+	assert.Equal(t, 1, count(t, db, "sent_at IS NOT NULL"))
+}
@@ -1,9 +1,15 @@
 package rabbitmq
 
-import strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
+import (
+	"time"
 
-func SetupConsumeChannel(url, connGroup, queue string) *strongrabbit.StrongChannel {
-	conn, err := strongrabbit.Connect(url, connGroup)
+	strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
+)
+
+// SetupConsumeChannel connects and declares the queue and its retry queues.
+// The options are given to Connect, eg.: a dialer to an in-process broker.
+func SetupConsumeChannel(url, connGroup, queue string, opts ...strongrabbit.Option) *strongrabbit.StrongChannel {
+	conn, err := strongrabbit.Connect(url, connGroup, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -30,16 +36,29 @@ func SetupConsumeChannel(url, connGroup, queue string) *strongrabbit.StrongChann
 		panic(err)
 	}
 
+	// failed orders wait on a retry queue before being processed again
+	err = ch.DeclareRetry(queue, strongrabbit.RetryOpts{Delay: 30 * time.Second, MaxAttempts: 5})
+	if err != nil {
+		panic(err)
+	}
+
 	return ch
 }
 
-func SetupProducerChannel(url, group, exchange, queue, binding string) *strongrabbit.StrongChannel {
-	conn, err := strongrabbit.Connect(url, group)
+// SetupProducerChannel connects and declares the exchange and the queue bound to it.
+// The options are given to Connect, eg.: a dialer to an in-process broker.
+func SetupProducerChannel(url, group, exchange, queue, binding string, opts ...strongrabbit.Option) *strongrabbit.StrongChannel {
+	conn, err := strongrabbit.Connect(url, group, opts...)
 	if err != nil {
 		panic(err)
 	}
 
-	ch, err := conn.Channel(strongrabbit.Publisher, "producer")
+	// buffer the messages published while disconnected
+	ch, err := conn.Channel(
+		strongrabbit.Publisher,
+		"producer",
+		strongrabbit.WithPublishBuffer(strongrabbit.BufferOpts{Size: 100}),
+	)
 	if err != nil {
 		panic(err)
 	}
@@ -61,6 +80,18 @@ func SetupProducerChannel(url, group, exchange, queue, binding string) *strongra
 		panic(err)
 	}
 
+	_, err = ch.QueueDeclare(
+		queue,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		panic(err)
+	}
+
 	err = ch.QueueBind(
 		queue,
 		binding,
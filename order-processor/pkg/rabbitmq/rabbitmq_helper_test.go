@@ -0,0 +1,57 @@
+package rabbitmq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
+	"github.com/xilapa/go-tiny-projects/strong-rabbit/rabbittest"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+func TestProducerMessagesReachTheConsumer(t *testing.T) {
+	// arrange
+	broker := rabbittest.NewBroker()
+	t.Cleanup(broker.Close)
+	dialer := strongrabbit.WithDialer(broker.Dial)
+
+	consumer := SetupConsumeChannel(broker.URL(), "helper-consumer", "orders", dialer)
+	t.Cleanup(func() { consumer.Close() })
+	producer := SetupProducerChannel(broker.URL(), "helper-producer", "order-processor", "orders", "orders", dialer)
+	t.Cleanup(func() { producer.Close() })
+
+	deliveries := make(chan amqp.Delivery)
+	go consumer.Consume(&strongrabbit.ConsumeOpts{Queue: "orders"}, deliveries)
+
+	// act
+	confirm, err := producer.PublishConfirmed(context.Background(), "order-processor", "orders", false, false,
+		amqp.Publishing{ContentType: "application/json", Body: []byte(`{"ID":"1"}`)})
+	assert.NoError(t, err)
+
+	// assert
+	assert.True(t, confirm.Wait())
+	select {
+	case d := <-deliveries:
+		assert.Equal(t, `{"ID":"1"}`, string(d.Body))
+		assert.NoError(t, d.Ack(false))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the order was not consumed")
+	}
+	assert.True(t, broker.HasQueue(strongrabbit.RetryQueueName("orders")))
+}
+
+func TestProducerDeclaresTheQueueItBinds(t *testing.T) {
+	// arrange
+	broker := rabbittest.NewBroker()
+	t.Cleanup(broker.Close)
+	dialer := strongrabbit.WithDialer(broker.Dial)
+
+	// act
+	producer := SetupProducerChannel(broker.URL(), "helper-events", "order-events", "orders-priced", "orders.priced", dialer)
+	t.Cleanup(func() { producer.Close() })
+
+	// assert
+	assert.True(t, broker.HasQueue("orders-priced"))
+}
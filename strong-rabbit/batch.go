@@ -0,0 +1,170 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrNacked is set on the results of the batch messages
+	// rejected by the broker on all the attempts.
+	ErrNacked = errors.New("message nacked by the broker")
+	// ErrBatchIncomplete is returned by PublishBatch when any
+	// message of the batch was not acked, check the results.
+	ErrBatchIncomplete = errors.New("batch not completely published")
+
+	errNotConfirmMode = errors.New("channel is not in confirm mode")
+)
+
+// BatchMessage is a message published by PublishBatch.
+type BatchMessage struct {
+	Exchange  string
+	Key       string
+	Mandatory bool
+	Msg       amqp.Publishing
+}
+
+// BatchResult is the outcome of a message published by PublishBatch,
+// it has the same index of the message on the batch.
+type BatchResult struct {
+	Acked    bool  // the broker confirmed the message
+	Returned bool  // the message was mandatory and the broker returned it, see Confirmation.Returned
+	Attempts int   // how many times the batch published the message
+	Err      error // why the message was not acked, ErrNacked if the broker rejected it
+}
+
+// BatchOpts is a struct that encapsulates the settings of PublishBatch.
+type BatchOpts struct {
+	MaxAttempts int           // how many times a message is published, defaults to 3
+	RetryDelay  time.Duration // the wait before publishing the failed messages again, defaults to 100ms
+}
+
+// DefaultBatchOpts are the settings used for the zero fields of BatchOpts.
+var DefaultBatchOpts = BatchOpts{
+	MaxAttempts: 3,
+	RetryDelay:  100 * time.Millisecond,
+}
+
+// withDefaults fills the zero fields with the DefaultBatchOpts values
+func (o BatchOpts) withDefaults() BatchOpts {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultBatchOpts.MaxAttempts
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = DefaultBatchOpts.RetryDelay
+	}
+	return o
+}
+
+// PublishBatch publishes all the messages and then waits for their
+// confirmations together, instead of a round trip per message. The
+// channel must be on confirm mode.
+//
+// It returns a result for each message. The nacked messages and the
+// ones that failed to be sent are published again, up to MaxAttempts,
+// after the channel is Ready, so a retried message can arrive after the
+// ones published after it. The messages left without confirmation by a
+// reconnection are republished by the channel itself, as any publish,
+// and are not counted as attempts.
+//
+// When any message is not acked ErrBatchIncomplete is returned with
+// the results. The context bounds the whole batch, the messages not
+// confirmed when it's done get ctx.Err().
+func (ch *StrongChannel) PublishBatch(ctx context.Context, msgs []BatchMessage, opts BatchOpts) ([]BatchResult, error) {
+	if ch.chType != Publisher {
+		return nil, errInvalidChannelType
+	}
+	ch.pub.lock.Lock()
+	confirm := ch.confirm
+	ch.pub.lock.Unlock()
+	if !confirm {
+		return nil, errNotConfirmMode
+	}
+	return publishBatch(ctx, ch, msgs, opts.withDefaults(), ch.WaitReady)
+}
+
+// publishBatch publishes the messages through the publisher, calling
+// ready before each retry
+func publishBatch(ctx context.Context, pub MessagePublisher, msgs []BatchMessage, opts BatchOpts, ready func(ctx context.Context) error) ([]BatchResult, error) {
+	if ctx == nil {
+		return nil, errors.New("nil Context")
+	}
+
+	results := make([]BatchResult, len(msgs))
+	pending := make([]int, len(msgs))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for attempt := 1; len(pending) > 0 && attempt <= opts.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			err := ready(ctx)
+			if err == nil && !wait(opts.RetryDelay, ctx.Done()) {
+				err = ctx.Err()
+			}
+			if err != nil {
+				for _, i := range pending {
+					results[i].Err = err
+				}
+				break
+			}
+		}
+
+		// send all the messages before waiting for the confirmations
+		confirmations := make([]*Confirmation, len(pending))
+		for n, i := range pending {
+			m := msgs[i]
+			results[i].Attempts = attempt
+			confirmations[n], results[i].Err = pub.PublishConfirmed(
+				ctx, m.Exchange, m.Key, m.Mandatory, false, m.Msg)
+		}
+
+		var retry []int
+		for n, i := range pending {
+			if c := confirmations[n]; c != nil {
+				results[i].Err = waitBatchConfirmation(ctx, c, &results[i])
+			}
+			if err := results[i].Err; err != nil && retryableBatchError(ctx, err) {
+				retry = append(retry, i)
+			}
+		}
+		pending = retry
+	}
+
+	for _, r := range results {
+		if !r.Acked {
+			return results, ErrBatchIncomplete
+		}
+	}
+	return results, nil
+}
+
+// waitBatchConfirmation waits for the confirmation, filling the result
+// when the message is acked. It returns why it was not acked.
+func waitBatchConfirmation(ctx context.Context, c *Confirmation, r *BatchResult) error {
+	ack, err := c.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ack {
+		if err := c.Err(); err != nil {
+			return err
+		}
+		return ErrNacked
+	}
+	r.Acked = true
+	_, r.Returned = c.Returned()
+	return nil
+}
+
+// retryableBatchError reports if a message that failed with the
+// error can be published again
+func retryableBatchError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return !errors.Is(err, errChannelClosed) && !errors.Is(err, ErrReconnectGaveUp)
+}
@@ -0,0 +1,121 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+// batchOf returns a batch with a message for each body
+func batchOf(bodies ...string) []BatchMessage {
+	msgs := make([]BatchMessage, 0, len(bodies))
+	for _, body := range bodies {
+		msgs = append(msgs, BatchMessage{Exchange: "orders", Key: "created", Msg: amqp.Publishing{Body: []byte(body)}})
+	}
+	return msgs
+}
+
+var fastBatch = BatchOpts{MaxAttempts: 3, RetryDelay: time.Millisecond}
+
+func TestPublishBatch(t *testing.T) {
+	// arrange
+	ch := NewFakeChannel()
+
+	// act
+	results, err := ch.PublishBatch(context.Background(), batchOf("1", "2", "3"), fastBatch)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(results))
+	for _, r := range results {
+		assert.True(t, r.Acked)
+		assert.NoError(t, r.Err)
+		assert.Equal(t, 1, r.Attempts)
+	}
+	published := ch.Published()
+	assert.Equal(t, 3, len(published))
+	assert.Equal(t, "3", string(published[2].Msg.Body))
+}
+
+var publishBatchFailuresData = map[string]struct {
+	setup            func(ch *FakeChannel)
+	expectedErr      error
+	expectedAttempts int
+}{
+	"nacked messages are retried": {
+		setup:            func(ch *FakeChannel) { ch.NackPublishes(true) },
+		expectedErr:      ErrNacked,
+		expectedAttempts: 3,
+	},
+	"failed publishes are retried": {
+		setup:            func(ch *FakeChannel) { ch.FailPublishes(amqp.ErrClosed) },
+		expectedErr:      amqp.ErrClosed,
+		expectedAttempts: 3,
+	},
+	"closed channel is not retried": {
+		setup:            func(ch *FakeChannel) { ch.Close() },
+		expectedErr:      errChannelClosed,
+		expectedAttempts: 1,
+	},
+}
+
+func TestPublishBatchFailures(t *testing.T) {
+	for name, d := range publishBatchFailuresData {
+		t.Run(name, func(t *testing.T) {
+			// arrange
+			ch := NewFakeChannel()
+			d.setup(ch)
+
+			// act
+			results, err := ch.PublishBatch(context.Background(), batchOf("1", "2"), fastBatch)
+
+			// assert
+			assert.True(t, errors.Is(err, ErrBatchIncomplete))
+			for _, r := range results {
+				assert.False(t, r.Acked)
+				assert.True(t, errors.Is(r.Err, d.expectedErr))
+				assert.Equal(t, d.expectedAttempts, r.Attempts)
+			}
+		})
+	}
+}
+
+func TestPublishBatchStopsWhenTheContextIsDone(t *testing.T) {
+	// arrange
+	ch := NewFakeChannel()
+	ch.NackPublishes(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// act
+	results, err := ch.PublishBatch(ctx, batchOf("1"), BatchOpts{MaxAttempts: 10, RetryDelay: time.Hour})
+
+	// assert
+	assert.True(t, errors.Is(err, ErrBatchIncomplete))
+	assert.True(t, errors.Is(results[0].Err, context.DeadlineExceeded))
+	assert.Equal(t, 1, results[0].Attempts)
+}
+
+var publishBatchChannelData = map[string]struct {
+	ch       *StrongChannel
+	expected error
+}{
+	"consumer channel":    {ch: &StrongChannel{chType: Consumer}, expected: errInvalidChannelType},
+	"not on confirm mode": {ch: &StrongChannel{chType: Publisher}, expected: errNotConfirmMode},
+}
+
+func TestPublishBatchNeedsAConfirmModePublisher(t *testing.T) {
+	for name, d := range publishBatchChannelData {
+		t.Run(name, func(t *testing.T) {
+			// act
+			_, err := d.ch.PublishBatch(context.Background(), batchOf("1"), BatchOpts{})
+
+			// assert
+			assert.True(t, errors.Is(err, d.expected))
+		})
+	}
+}
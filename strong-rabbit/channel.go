@@ -1,9 +1,11 @@
 package strongrabbit
 
 import (
+	"context"
 	"errors"
-	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -13,25 +15,50 @@ import (
 // additional data to make auto-reconnect possible.
 // For the caller, it can be used as an *amqp.Channel.
 type StrongChannel struct {
-	*amqp.Channel                      // The underlying *amqp.Channel
-	Done             bool              // Indicates if the channel has been stopped
-	Name             string            // Name used for logs
-	conn             *StrongConnection // the underlying connection
-	notifyClose      chan *amqp.Error  // used to listen to close notifications
-	consLoopStop     chan struct{}     // closes to signal the consumer loop to stop, after that it'll be nil
-	consLoopStopped  chan struct{}     // used by the consumer loop to signal it has stopped
-	reconnectStop    chan struct{}     // used to signal the reconnection go routine to stop
-	reconnectStopped chan struct{}     // used by the reconnection go routine to signal it has stopped
-	opts             *ConsumeOpts      // the opts used on consume
-	err              *amqp.Error       // the last error happened on this channels, it resets when reconnected
-	confirm          bool              // save the confirm mode set to the channel
-	confirmNoWait    bool              // save the noWait used when setting the confirm mode
-	chType           ChannelType       // the underlying channel type
-	lock             sync.Mutex        // mutex used when closing the channel
-	qos              bool              // save if qos was called on channel
-	prefetchCount    int               // save the prefetch count set to the channel
-	prefetchSize     int               // save the prefecth size set to the channel
-	prefetchGlobal   bool              // save the prefetch global options set to the channel
+	*amqp.Channel // The underlying *amqp.Channel
+	// Done indicates if the channel has been stopped.
+	//
+	// Deprecated: Done is not safe for concurrent use, use Stopped instead.
+	Done             bool
+	Name             string               // Name used for logs
+	conn             *StrongConnection    // the underlying connection
+	notifyClose      chan *amqp.Error     // used to listen to close notifications
+	notifyCancel     chan string          // used to listen to the consumer cancel notifications, only on Consumer channels
+	consLoopStop     chan struct{}        // closes to signal the consumer loop to stop, after that it'll be nil
+	consLoopStopped  chan struct{}        // used by the consumer loop to signal it has stopped
+	reconnectStop    chan struct{}        // used to signal the reconnection go routine to stop
+	reconnectStopped chan struct{}        // used by the reconnection go routine to signal it has stopped
+	opts             *ConsumeOpts         // a copy of the opts used on consume, Queue is the name it started with
+	queue            string               // the queue consumed, renamed when a server-named queue is redeclared
+	queueLock        sync.RWMutex         // mutex used to read and write the consumed queue
+	err              *amqp.Error          // the last error happened on this channels, it resets when reconnected
+	confirm          bool                 // save the confirm mode set to the channel
+	confirmNoWait    bool                 // save the noWait used when setting the confirm mode
+	chType           ChannelType          // the underlying channel type
+	lock             sync.Mutex           // mutex used when closing the channel
+	qos              bool                 // save if qos was called on channel
+	prefetchCount    int                  // save the prefetch count set to the channel
+	prefetchSize     int                  // save the prefecth size set to the channel
+	prefetchGlobal   bool                 // save the prefetch global options set to the channel
+	topology         topology             // exchanges, queues and bindings to restore on reconnection
+	retries          map[string]RetryOpts // the retry settings declared for each queue
+	retryPub         *StrongChannel       // the confirm mode channel the retried messages are published on
+	retryLock        sync.RWMutex         // mutex used to read and write the retry settings
+	stopping         chan struct{}        // closed when the channel is closed, stops the handlers waiting to retry
+	cfg              options              // the options inherited from the connection and set on Channel
+	chLock           sync.RWMutex         // mutex used when replacing the underlying channel
+	reconnectLock    sync.Mutex           // mutex used to avoid reconnecting the channel twice at the same time
+	stateLock        sync.RWMutex         // mutex used to read and write the closed and failure state
+	closed           bool                 // set when Close is called, the channel will not recover
+	failErr          error                // set when the reconnection gives up, the channel will not recover
+	pub              publisher            // the publishing state, used by Publisher channels
+	handlers         sync.WaitGroup       // the handlers started by ConsumeWithHandler
+	consumeLock      sync.Mutex           // mutex used when starting the consumer and when cancelling it on Shutdown
+	consumerTag      string               // the tag of the consumer, generated if ConsumeOpts.Consumer is empty
+	consuming        *amqp.Channel        // the underlying channel the consumer was started on
+	draining         bool                 // set when Shutdown is called, the consumer is not started again
+	state            stateMachine         // the lifecycle state, reported by State
+	metrics          channelMetrics       // the counters returned by Stats
 }
 
 type ChannelType int
@@ -45,6 +72,8 @@ var (
 	errInvalidChannelType = errors.New("invalid channel type")
 	errAlreadyConsuming   = errors.New("channel is already consuming messages")
 	errNilConsumeOpts     = errors.New("ConsumeOpts is nil")
+	errChannelClosed      = errors.New("channel is closed")
+	errConsumerCancelled  = errors.New("consumer cancelled by the broker")
 )
 
 // Channel receives the channel type and returns a *StrongChannel
@@ -52,27 +81,58 @@ var (
 // Channel can be of Consumer or Publisher type. Each one has an
 // optimized reconnection strategy.
 // To stop consuming or publishing, call the Close() method.
-func (conn *StrongConnection) Channel(t ChannelType, name string) (*StrongChannel, error) {
+//
+// The channel is registered on the connection, when the connection
+// drops it recovers the channel after redialing.
+// The channel inherits the options set on Connect, the given
+// options override them only for this channel.
+func (conn *StrongConnection) Channel(t ChannelType, name string, opts ...Option) (*StrongChannel, error) {
+	return conn.ChannelContext(context.Background(), t, name, opts...)
+}
+
+// ChannelContext behaves as Channel. If the connection is recovering, it
+// waits for the connection to be ready before opening the channel, until
+// the context is done, then ctx.Err() is returned.
+// Once opened, the context doesn't affect the channel.
+func (conn *StrongConnection) ChannelContext(ctx context.Context, t ChannelType, name string, opts ...Option) (*StrongChannel, error) {
+	if ctx == nil {
+		return nil, errors.New("nil Context")
+	}
 	// validate if the channel type is valid
 	if t != Consumer && t != Publisher {
 		return nil, errInvalidChannelType
 	}
 
-	ch, err := conn.Connection.Channel()
+	if !conn.waitReady(ctx.Done()) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// the connection was closed or gave up recovering
+		if err := conn.Err(); err != nil {
+			return nil, err
+		}
+		return nil, amqp.ErrClosed
+	}
+
+	amqpConn, _ := conn.current()
+	ch, err := amqpConn.Channel()
 	if err != nil {
 		return nil, err
 	}
 
-	notifyClose := ch.NotifyClose(make(chan *amqp.Error))
+	notifyClose := ch.NotifyClose(make(chan *amqp.Error, 1))
 	strongCh := &StrongChannel{
 		Channel:     ch,
 		conn:        conn,
 		notifyClose: notifyClose,
 		chType:      t,
 		Name:        name,
+		cfg:         conn.opts.apply(opts...),
+		stopping:    make(chan struct{}),
 	}
 
 	if strongCh.chType == Consumer {
+		strongCh.notifyCancel = ch.NotifyCancel(make(chan string, 1))
 		// the consumer doesn't need a go routine to reconnect
 		// the internalConsume listens to the messages,
 		// the amqp.Close method and the stop signal
@@ -81,6 +141,18 @@ func (conn *StrongConnection) Channel(t ChannelType, name string) (*StrongChanne
 	}
 
 	if strongCh.chType == Publisher {
+		if b := strongCh.cfg.publishBuffer; b.Size > 0 || b.SpillFile != "" {
+			strongCh.pub.buffer, err = newPublishBuffer(b)
+			if err != nil {
+				ch.Close()
+				return nil, err
+			}
+		}
+
+		// track the confirmations and the returns, the confirmations
+		// only arrive after the channel is put on confirm mode
+		strongCh.trackConfirms(ch)
+
 		strongCh.reconnectStop = make(chan struct{})
 		strongCh.reconnectStopped = make(chan struct{})
 		// if the channel is a producer, start a go routine
@@ -88,6 +160,8 @@ func (conn *StrongConnection) Channel(t ChannelType, name string) (*StrongChanne
 		go strongCh.reconnectionLoop()
 	}
 
+	strongCh.state.set(Ready)
+	conn.register(strongCh)
 	return strongCh, nil
 }
 
@@ -104,29 +178,54 @@ type ConsumeOpts struct {
 	Args      amqp.Table
 }
 
+// consumerSeq makes the generated consumer tags unique
+var consumerSeq atomic.Uint64
+
+// uniqueConsumerTag generates the consumer tag of a channel, it's
+// generated here, not by the broker, to be cancelled by Shutdown
+func uniqueConsumerTag(name string) string {
+	return "strongrabbit-" + name + "-" + strconv.FormatUint(consumerSeq.Add(1), 10)
+}
+
 // Consume starts consuming messages from a channel with the given options.
 // The received messages are sent to the out chan.
 // If there is an error on the opts passed, it's returned.
 // If the connection is closed gracefully, eg.: by calling Close() on the
 // connection or channel, it'll stop consuming and not reconnect.
-// Any other connection error will make the channel reconnect.
+// Any other connection error will make the channel reconnect, following
+// the ReconnectPolicy. When the policy attempts run out, the channel
+// stops and an error wrapping ErrReconnectGaveUp is returned.
 //
 // To stop consuming Channel.Close() should be called on another go-routine.
 // When the channel stops this method returns nil.
 //
 // This method can only be called once per consumer channel.
 func (ch *StrongChannel) Consume(opts *ConsumeOpts, out chan amqp.Delivery) error {
-	if ch.opts != nil {
-		return errAlreadyConsuming
-	}
-
 	if opts == nil {
 		return errNilConsumeOpts
 	}
 
-	log.Printf("[%s] listening for messages", ch.Name)
 	// set the opts on the channel
-	ch.opts = opts
+	ch.lock.Lock()
+	if ch.isClosed() {
+		ch.lock.Unlock()
+		return errChannelClosed
+	}
+	if ch.opts != nil {
+		ch.lock.Unlock()
+		return errAlreadyConsuming
+	}
+	// copied, the caller may reuse the opts
+	consumeOpts := *opts
+	ch.opts = &consumeOpts
+	ch.setQueue(opts.Queue)
+	ch.consumerTag = opts.Consumer
+	if ch.consumerTag == "" {
+		ch.consumerTag = uniqueConsumerTag(ch.Name)
+	}
+	ch.lock.Unlock()
+
+	ch.logger().Info("listening for messages", "channel", ch.Name)
 
 	for consLopp := true; consLopp; {
 		select {
@@ -135,48 +234,113 @@ func (ch *StrongChannel) Consume(opts *ConsumeOpts, out chan amqp.Delivery) erro
 			continue
 		default:
 			// only try to consume if the channel is open
-			if ch.Channel != nil && !ch.IsClosed() {
+			if ch.isOpen() {
 				consLopp = ch.internalConsume(out)
 				continue // continue to check if the chan is done
 			}
 
-			// reconnection delay
-			<-time.After(time.Second * 5)
-			if ok := ch.reconnect(); ok {
-				log.Printf("[%s] reconnected", ch.Name)
+			if err := ch.recover(ch.consLoopStop); err != nil {
+				close(ch.consLoopStopped)
+				return err
 			}
 		}
 	}
 
 	close(ch.consLoopStopped)
-	log.Printf("[%s] consumer loop stopped, channel gracefully closed", ch.Name)
+	ch.logger().Info("consumer loop stopped, channel gracefully closed", "channel", ch.Name)
 	return nil
 }
 
+// ConsumeContext behaves as Consume, when the context is done the channel
+// is closed, as if Close was called, and ctx.Err() is returned. Any
+// reconnection in progress is stopped.
+func (ch *StrongChannel) ConsumeContext(ctx context.Context, opts *ConsumeOpts, out chan amqp.Delivery) error {
+	return ch.consumeContext(ctx, opts, out, nil)
+}
+
+// consumeContext consumes until the context is done, calling stopped
+// after the consume loop stops and before waiting the channel to close
+func (ch *StrongChannel) consumeContext(ctx context.Context, opts *ConsumeOpts, out chan amqp.Delivery, stopped func()) error {
+	if stopped == nil {
+		stopped = func() {}
+	}
+	if ctx == nil {
+		stopped()
+		return errors.New("nil Context")
+	}
+	if err := ctx.Err(); err != nil {
+		stopped()
+		return err
+	}
+
+	// close the channel when the context is done, Close stops
+	// the consume loop and waits for it, so this method
+	// only returns after the channel is closed
+	consumed := make(chan struct{})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		select {
+		case <-ctx.Done():
+			ch.Close()
+		case <-consumed:
+		}
+	}()
+
+	err := ch.Consume(opts, out)
+	close(consumed)
+	stopped()
+	<-closed
+
+	if ctxErr := ctx.Err(); ctxErr != nil && err == nil {
+		return ctxErr
+	}
+	return err
+}
+
 // internalConsume starts consuming the messages from the channel
 // and sends them to the out chan.
-// If notifyClose returns a nil error (graceful channel close),
-// keepConsuming returns false, to avoid reconnections
+// If notifyClose returns a nil error (graceful channel close) or the
+// consume loop is stopped, keepConsuming returns false, to avoid
+// reconnections
 func (ch *StrongChannel) internalConsume(out chan amqp.Delivery) (keepConsuming bool) {
 	keepConsuming = true
-	msgs, err := ch.Channel.Consume(
-		ch.opts.Queue,
-		ch.opts.Consumer,
+	amqpCh, notifyClose := ch.current()
+	notifyCancel := ch.cancelNotifications()
+
+	// the consumer is started while holding the lock, so
+	// Shutdown cancels it or it's not started at all
+	ch.consumeLock.Lock()
+	if ch.draining {
+		ch.consumeLock.Unlock()
+		return ch.idle()
+	}
+	msgs, err := amqpCh.Consume(
+		ch.currentQueue(),
+		ch.consumerTag,
 		ch.opts.AutoAck,
 		ch.opts.Exclusive,
 		ch.opts.NoLocal,
 		ch.opts.NoWait,
 		ch.opts.Args,
 	)
+	if err == nil {
+		ch.consuming = amqpCh
+	}
+	ch.consumeLock.Unlock()
 
 	if err != nil {
-		log.Printf("[%s] error: %s", ch.Name, err)
+		ch.logger().Error("cannot consume", "channel", ch.Name, "error", err)
 		return
 	}
+	var unacked *unackedDeliveries
+	if !ch.opts.AutoAck {
+		unacked = ch.unackedOf(amqpCh)
+	}
 
 	for {
 		select {
-		case err := <-ch.notifyClose:
+		case err := <-notifyClose:
 			// when the connection is closed gracefully no error is returned
 			// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#hdr-Use_Case
 			if err == nil {
@@ -187,82 +351,303 @@ func (ch *StrongChannel) internalConsume(out chan amqp.Delivery) (keepConsuming
 			// notifyClose chan. Closed chan returns nil immediately, due to
 			// this, at Consume method it's verified if the consLoopStop chan
 			// still open to do a reconnect
-			log.Printf("[%s] reconnection will start\nerror: %s", ch.Name, err)
+			ch.logger().Warn("channel closed, reconnection will start", "channel", ch.Name, "error", err)
+			emit(ch.cfg.events.OnDisconnect, ch.event(err))
 			return
-		case msg := <-msgs:
-			// if the channel closes due to an error
-			// the msg.Body and other fields came empty/nil
-			if msg.Body != nil {
-				out <- msg
+		case <-ch.consLoopStop:
+			keepConsuming = false
+			return
+		case tag := <-notifyCancel:
+			// the queue was deleted or its node failed,
+			// the deliveries chan is closed after that
+			return ch.resubscribe(amqpCh, tag)
+		case msg, ok := <-msgs:
+			// the deliveries chan closes when the consumer is cancelled
+			// or the channel closes, on the latter the Consume method
+			// notices the channel is closed and recovers it
+			if !ok {
+				if amqpCh.IsClosed() {
+					return
+				}
+				// cancelled by Shutdown, wait for the channel to close
+				if ch.isDraining() {
+					return ch.idle()
+				}
+				return ch.resubscribe(amqpCh, ch.consumerTag)
+			}
+			msg = ch.delivered(msg, unacked)
+			// a message not sent stays unacked, it's
+			// requeued when the channel closes
+			select {
+			case out <- msg:
+			case <-ch.consLoopStop:
+				keepConsuming = false
+				return
 			}
 		}
 	}
 }
 
+// resubscribe handles a consumer cancelled by the broker. The queue
+// is redeclared, with its bindings, if it was declared through the
+// channel, then after the reconnection delay it returns to consume
+// again with the same ConsumeOpts
+func (ch *StrongChannel) resubscribe(amqpCh *amqp.Channel, tag string) (keepConsuming bool) {
+	queue := ch.currentQueue()
+	ch.logger().Warn("consumer cancelled, consuming again", "channel", ch.Name, "consumer", tag, "queue", queue)
+	emit(ch.cfg.events.OnDisconnect, ch.event(errConsumerCancelled))
+
+	// the cancel notification arrives before the deliveries
+	// chan closes, drop it to not resubscribe twice
+	select {
+	case <-ch.cancelNotifications():
+	default:
+	}
+
+	if !wait(ch.cfg.reconnectPolicy.delay(1), ch.consLoopStop) {
+		return false
+	}
+
+	// a failed declaration closes the channel, it's recovered
+	// with all the topology by the Consume method
+	newName, known, err := ch.topology.restoreQueue(amqpCh, queue)
+	if err != nil {
+		ch.logger().Warn("cannot redeclare the queue", "channel", ch.Name, "queue", queue, "error", err)
+		return true
+	}
+	if known {
+		ch.setQueue(newName)
+	}
+	return true
+}
+
+// currentQueue returns the name of the queue consumed
+func (ch *StrongChannel) currentQueue() string {
+	ch.queueLock.RLock()
+	defer ch.queueLock.RUnlock()
+	return ch.queue
+}
+
+// setQueue sets the name of the queue consumed
+func (ch *StrongChannel) setQueue(name string) {
+	ch.queueLock.Lock()
+	defer ch.queueLock.Unlock()
+	ch.queue = name
+}
+
 // reconnectionLoop listens to channel close notifications and
-// reconnect the channel until it's gracefully closed
+// reconnect the channel until it's gracefully closed or the
+// reconnection policy gives up
 func (ch *StrongChannel) reconnectionLoop() {
-	log.Printf("[%s] listening for channel close", ch.Name)
+	ch.logger().Debug("listening for channel close", "channel", ch.Name)
+	defer close(ch.reconnectStopped)
 	for {
+		_, notifyClose := ch.current()
 		select {
 		case <-ch.reconnectStop:
-			close(ch.reconnectStopped)
-			log.Printf("[%s] reconnection loop stopped, connection closed gracefully", ch.Name)
+			ch.logger().Debug("reconnection loop stopped, channel closed gracefully", "channel", ch.Name)
 			return
 
-		case err := <-ch.notifyClose:
-			// when the connection/channel closes, this chan
-			// will also be closed and will always return nil
-			// after that. So it's necessary to check if the
-			// ch.err has a value
-			if err == nil && ch.err == nil {
-				continue
-			}
-
-			// save the error on the channel to keep trying the reconnection
-			// when reconnected, the ch.err will be set to nil
-			if err != nil {
-				ch.err = err
-				log.Printf("[%s] channel closed: %s", ch.Name, ch.err)
+		case err := <-notifyClose:
+			// when the channel is closed gracefully no error is
+			// sent, only wait for the stop signal
+			if err == nil {
+				<-ch.reconnectStop
+				ch.logger().Debug("reconnection loop stopped, channel closed gracefully", "channel", ch.Name)
+				return
 			}
 
-			// reconnection delay
-			<-time.After(time.Second * 5)
+			// save the error on the channel, when reconnected
+			// the ch.err will be set to nil
+			ch.err = err
+			ch.logger().Warn("channel closed, reconnection will start", "channel", ch.Name, "error", err)
+			emit(ch.cfg.events.OnDisconnect, ch.event(err))
 
-			// stop the reconnection loop, if reconnection succeeds
-			if res := ch.reconnect(); res {
-				log.Printf("[%s] reconnected", ch.Name)
+			if err := ch.recover(ch.reconnectStop); err != nil {
 				return
 			}
 		}
 	}
 }
 
-// reconnect will try to reconnect and open a new channel.
-// If the reconnection or channel opening fails, it'll log
-// the error and returns false.
-// If the reconection succeeds, it returns true.
-func (ch *StrongChannel) reconnect() (success bool) {
-	conn, err := Connect(ch.conn.url, ch.conn.group)
+// recover brings the channel back after it was closed by an error.
+// When the whole connection dropped, it waits for the connection to
+// redial and recover the channel. Otherwise, the channel is reopened
+// following the reconnection policy.
+// It returns nil when the channel is recovered or the stop chan closes,
+// and the error that put the channel on the failed state if it gives up.
+func (ch *StrongChannel) recover(stop chan struct{}) error {
+	ch.state.set(Recovering)
+	policy := ch.cfg.reconnectPolicy
+	failedAttempts := 0
+	for {
+		if !ch.conn.waitReady(stop) {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			// the connection was closed or gave up recovering
+			err := ch.conn.Err()
+			if err == nil {
+				err = amqp.ErrClosed
+			}
+			return ch.fail(err)
+		}
+
+		// the connection already recovered this channel
+		if ch.isOpen() {
+			ch.state.set(Ready)
+			return nil
+		}
+
+		// reconnection delay, stop waiting if the channel is closed
+		if !wait(policy.delay(failedAttempts+1), stop) {
+			return nil
+		}
+
+		attempt := ch.event(nil)
+		attempt.Attempt = failedAttempts + 1
+		emit(ch.cfg.events.OnReconnectAttempt, attempt)
+
+		err := ch.reconnect()
+		if err == nil {
+			return nil
+		}
+
+		failedAttempts++
+		if policy.exhausted(failedAttempts) {
+			return ch.fail(giveUpError(err))
+		}
+	}
+}
+
+// wait waits for the given duration, returning false if
+// the stop chan closes before that
+func wait(d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// fail puts the channel on a terminal failed state, after
+// that it'll not try to reconnect anymore
+func (ch *StrongChannel) fail(err error) error {
+	ch.stateLock.Lock()
+	ch.failErr = err
+	ch.stateLock.Unlock()
+	ch.state.set(Failed)
+
+	// mirrors the state on the deprecated field
+	ch.Done = true
+	ch.discardPending(err)
+	ch.logger().Error("channel will not reconnect", "channel", ch.Name, "error", err)
+	emit(ch.cfg.events.OnGiveUp, ch.event(err))
+	return err
+}
+
+// Stopped reports if the channel has been closed or gave up
+// reconnecting, it's safe for concurrent use.
+func (ch *StrongChannel) Stopped() bool {
+	return ch.state.get().final()
+}
+
+// logger returns the logger set on the channel options
+func (ch *StrongChannel) logger() Logger {
+	return ch.cfg.logger()
+}
+
+// event returns an Event of this channel with the given error
+func (ch *StrongChannel) event(err error) Event {
+	return Event{Channel: ch.Name, Group: ch.conn.group, Err: err}
+}
+
+// Err returns the error that made the channel give up reconnecting.
+// If the channel is working or it was gracefully closed, nil is returned.
+func (ch *StrongChannel) Err() error {
+	ch.stateLock.RLock()
+	defer ch.stateLock.RUnlock()
+	return ch.failErr
+}
+
+// current returns the underlying channel and its close notifications
+func (ch *StrongChannel) current() (*amqp.Channel, chan *amqp.Error) {
+	ch.chLock.RLock()
+	defer ch.chLock.RUnlock()
+	return ch.Channel, ch.notifyClose
+}
+
+// cancelNotifications returns the consumer cancel
+// notifications of the underlying channel
+func (ch *StrongChannel) cancelNotifications() chan string {
+	ch.chLock.RLock()
+	defer ch.chLock.RUnlock()
+	return ch.notifyCancel
+}
+
+// isOpen reports if the underlying channel is open
+func (ch *StrongChannel) isOpen() bool {
+	amqpCh, _ := ch.current()
+	return amqpCh != nil && !amqpCh.IsClosed()
+}
+
+// isClosed reports if Close was called on the channel
+func (ch *StrongChannel) isClosed() bool {
+	ch.stateLock.RLock()
+	defer ch.stateLock.RUnlock()
+	return ch.closed
+}
+
+// reconnect opens a new channel on the connection and restores
+// the channel state on it. It's called by the channel itself
+// and by the connection after redialing, if the channel is
+// already open nothing is done.
+// If the channel opening fails, it'll log and return the error.
+// If the reconection succeeds, it returns nil.
+func (ch *StrongChannel) reconnect() error {
+	ch.reconnectLock.Lock()
+	defer ch.reconnectLock.Unlock()
+
+	if ch.isClosed() {
+		return errChannelClosed
+	}
+	if ch.isOpen() {
+		return nil
+	}
+
+	conn, _ := ch.conn.current()
+	newChan, err := conn.Channel()
 	if err != nil {
-		log.Printf("[%s] cannot reconnect: %s", ch.Name, err)
-		return
+		ch.logger().Warn("cannot open a channel", "channel", ch.Name, "error", err)
+		return err
 	}
-	// replace the connection on the channel
-	ch.conn = conn
 
-	newChan, err := conn.Connection.Channel()
+	// restore the topology before anything else, the queues must
+	// exist before consuming from them
+	renamed, err := ch.topology.restore(newChan)
 	if err != nil {
-		log.Printf("[%s] cannot open a channel: %s", ch.Name, err)
-		return
+		ch.logger().Warn("cannot restore the topology", "channel", ch.Name, "error", err)
+		newChan.Close()
+		return err
+	}
+
+	// server-named queues get a new name when redeclared
+	if newName, ok := renamed[ch.currentQueue()]; ok {
+		ch.setQueue(newName)
 	}
 
 	// if channel was in confirm mode, re-set it
 	if ch.confirm {
 		err = newChan.Confirm(ch.confirmNoWait)
 		if err != nil {
-			log.Printf("[%s] cannot put channel in confirm mode: %s", ch.Name, err)
-			return
+			ch.logger().Warn("cannot put channel in confirm mode", "channel", ch.Name, "error", err)
+			newChan.Close()
+			return err
 		}
 	}
 
@@ -270,24 +655,48 @@ func (ch *StrongChannel) reconnect() (success bool) {
 	if ch.qos {
 		err = newChan.Qos(ch.prefetchCount, ch.prefetchSize, ch.prefetchGlobal)
 		if err != nil {
-			log.Printf("[%s] cannot restore channel qos: %s", ch.Name, err)
-			return
+			ch.logger().Warn("cannot restore channel qos", "channel", ch.Name, "error", err)
+			newChan.Close()
+			return err
 		}
 	}
 
-	// replace the notify close chan and the underlying channel
+	// replace the notify close chan and the underlying channel, while
+	// holding the publisher lock to not publish on a half restored channel
+	ch.pub.lock.Lock()
+	ch.collectUnconfirmed()
+	ch.chLock.Lock()
+	// Close doesn't wait for the reconnection, if it already read
+	// the previous channel the new one would be left open
+	if ch.isClosed() {
+		ch.chLock.Unlock()
+		ch.pub.lock.Unlock()
+		newChan.Close()
+		return errChannelClosed
+	}
 	ch.Channel = newChan
-	ch.notifyClose = newChan.NotifyClose(make(chan *amqp.Error))
+	ch.notifyClose = newChan.NotifyClose(make(chan *amqp.Error, 1))
+	if ch.chType == Consumer {
+		ch.notifyCancel = newChan.NotifyCancel(make(chan string, 1))
+	}
+	ch.chLock.Unlock()
+	if ch.chType == Publisher {
+		ch.trackConfirms(newChan)
+	}
+	ch.pub.lock.Unlock()
 
 	// clear the error on the channel
 	ch.err = nil
+	ch.state.set(Ready)
+	ch.metrics.reconnects.Add(1)
+	ch.logger().Info("reconnected", "channel", ch.Name)
+	emit(ch.cfg.events.OnReconnected, ch.event(nil))
 
-	// start another reconnection loop if it's a producer channel
-	if ch.chType == Publisher {
-		go ch.reconnectionLoop()
-	}
+	// send the messages not confirmed and the ones
+	// published while disconnected
+	ch.flush()
 
-	return true
+	return nil
 }
 
 // Close stop consuming messages and then close the channel.
@@ -299,24 +708,37 @@ func (ch *StrongChannel) Close() error {
 	ch.lock.Lock()
 	defer ch.lock.Unlock()
 
-	var err error
-	// only close the underlying channel, if it's not null
-	if ch.Channel != nil {
-		err = ch.Channel.Close()
-	}
+	// mark the channel as closed before closing the underlying
+	// channel, so neither the channel or the connection recover it
+	ch.markClosed()
+	ch.conn.unregister(ch)
 
 	if ch.consLoopStop != nil {
 		// signalize the consume loop to stop
 		close(ch.consLoopStop)
 
-		// await the consume loop stop
-		<-ch.consLoopStopped
+		// await the consume loop stop, if it was started
+		if ch.opts != nil {
+			<-ch.consLoopStopped
+		}
 
 		// set the chan to nil, to avoid closing it again
 		ch.consLoopStop = nil
 		ch.consLoopStopped = nil
 	}
 
+	// await the running handlers, they must
+	// ack the deliveries before the channel closes
+	ch.handlers.Wait()
+	ch.closeRetryPublisher()
+
+	var err error
+	// only close the underlying channel, if it's not null
+	if amqpCh, _ := ch.current(); amqpCh != nil {
+		err = amqpCh.Close()
+	}
+	ch.discardPending(errChannelClosed)
+
 	if ch.reconnectStop != nil {
 		// signalize the reconnection go routine to stop
 		close(ch.reconnectStop)
@@ -329,18 +751,28 @@ func (ch *StrongChannel) Close() error {
 		ch.reconnectStopped = nil
 	}
 
-	// indicates for the caller that the channel stopped
+	// mirrors the state on the deprecated field
 	ch.Done = true
 
 	// release resources
-	ch.notifyClose = nil
 	ch.err = nil
-	ch.opts = nil
 
-	log.Printf("[%s] channel stopped", ch.Name)
+	ch.logger().Info("channel stopped", "channel", ch.Name)
+	emit(ch.cfg.events.OnClosed, ch.event(nil))
 	return err
 }
 
+// markClosed marks the channel as closed, it'll not recover anymore
+func (ch *StrongChannel) markClosed() {
+	ch.stateLock.Lock()
+	if !ch.closed && ch.stopping != nil {
+		close(ch.stopping)
+	}
+	ch.closed = true
+	ch.stateLock.Unlock()
+	ch.state.set(Closed)
+}
+
 // Confirm puts the channel on Confirm mode. Only Publisher
 // channels can have confirm mode set.
 // On reconnection, confirm mode is restored.
@@ -351,18 +783,24 @@ func (ch *StrongChannel) Confirm(noWait bool) error {
 		return errInvalidChannelType
 	}
 
-	err := ch.Channel.Confirm(noWait)
+	ch.pub.lock.Lock()
+	defer ch.pub.lock.Unlock()
+
+	amqpCh, _ := ch.current()
+	err := amqpCh.Confirm(noWait)
 	if err != nil {
 		return err
 	}
 	// if there is no error, save the confirm mode to use on reconnection
+	// the confirmations are tracked since the channel was opened
 	ch.confirm = true
 	ch.confirmNoWait = noWait
 	return nil
 }
 
 func (ch *StrongChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
-	err := ch.Channel.Qos(prefetchCount, prefetchSize, global)
+	amqpCh, _ := ch.current()
+	err := amqpCh.Qos(prefetchCount, prefetchSize, global)
 	if err != nil {
 		return err
 	}
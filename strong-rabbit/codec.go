@@ -0,0 +1,225 @@
+package strongrabbit
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// ContentTypeJSON is the content type of the JSON codec, it's used
+	// when the message has no content type.
+	ContentTypeJSON = "application/json"
+	// ContentTypeGob is the content type of the gob codec.
+	ContentTypeGob = "application/x-gob"
+	// ContentTypeMsgpack is the content type of the msgpack codec.
+	ContentTypeMsgpack = "application/x-msgpack"
+	// ContentTypeProtobuf is the content type of the protobuf codec,
+	// it encodes only proto.Message values.
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// ErrUnknownContentType is returned when there is no Codec registered
+// for the content type of a message.
+var ErrUnknownContentType = errors.New("no codec registered for the content type")
+
+// errNotProtoMessage is returned by the protobuf codec for values
+// that are not a proto.Message
+var errNotProtoMessage = errors.New("value is not a proto.Message")
+
+// Codec encodes and decodes the message bodies of a content type.
+// Codecs for other formats are added with RegisterCodec.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// codecs holds the registered codecs by content type
+var codecs = struct {
+	lock   sync.RWMutex
+	byType map[string]Codec
+}{
+	byType: map[string]Codec{
+		ContentTypeJSON:     jsonCodec{},
+		ContentTypeGob:      gobCodec{},
+		ContentTypeMsgpack:  msgpackCodec{},
+		ContentTypeProtobuf: protobufCodec{},
+	},
+}
+
+// RegisterCodec registers the codec for its content type, replacing
+// the codec previously registered for it.
+func RegisterCodec(c Codec) {
+	codecs.lock.Lock()
+	defer codecs.lock.Unlock()
+	codecs.byType[mediaType(c.ContentType())] = c
+}
+
+// CodecFor returns the codec registered for the content type, the
+// parameters, eg.: charset, are ignored. An empty content type
+// returns the JSON codec.
+func CodecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	codecs.lock.RLock()
+	defer codecs.lock.RUnlock()
+	c, ok := codecs.byType[mediaType(contentType)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownContentType, contentType)
+	}
+	return c, nil
+}
+
+// mediaType returns the content type without its parameters
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return t
+}
+
+// jsonCodec is the Codec of ContentTypeJSON
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// gobCodec is the Codec of ContentTypeGob
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return ContentTypeGob }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// msgpackCodec is the Codec of ContentTypeMsgpack
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+// protobufCodec is the Codec of ContentTypeProtobuf
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", errNotProtoMessage, v)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal decodes into a proto.Message or into a pointer to one,
+// Typed decodes a *Message type into a **Message, allocating it.
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Pointer {
+		return fmt.Errorf("%w: %T", errNotProtoMessage, v)
+	}
+	msg := reflect.New(rv.Elem().Type().Elem())
+	m, ok := msg.Interface().(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w: %T", errNotProtoMessage, v)
+	}
+	if err := proto.Unmarshal(data, m); err != nil {
+		return err
+	}
+	rv.Elem().Set(msg)
+	return nil
+}
+
+// Publish encodes v with the codec of msg.ContentType, JSON if it's empty,
+// and publishes it through p. The other msg fields, eg.: headers, are
+// published as given.
+func Publish[T any](ctx context.Context, p MessagePublisher, exchange, key string, v T, msg amqp.Publishing) (*Confirmation, error) {
+	codec, err := CodecFor(msg.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode the message: %w", err)
+	}
+	msg.ContentType = codec.ContentType()
+	msg.Body = body
+	return p.PublishConfirmed(ctx, exchange, key, false, false, msg)
+}
+
+// TypedHandler processes a decoded delivery and decides how it
+// must be acknowledged.
+type TypedHandler[T any] func(v T, d amqp.Delivery) Decision
+
+// PoisonHandler decides what to do with a delivery whose body cannot be
+// decoded, err tells why. Returning Nack(true) redelivers the message
+// forever, the usual choice is Reject, dead-lettering it.
+type PoisonHandler func(d amqp.Delivery, err error) Decision
+
+// RejectPoison is the PoisonHandler used when none is given,
+// it rejects the delivery.
+func RejectPoison(amqp.Delivery, error) Decision {
+	return Reject
+}
+
+// Typed returns a Handler that decodes the delivery body with the codec
+// of its content type and calls the handler with the decoded value.
+// Deliveries with an unknown content type or a body that cannot be
+// decoded go to the poison handler, RejectPoison if it's nil.
+func Typed[T any](handler TypedHandler[T], poison PoisonHandler) Handler {
+	if poison == nil {
+		poison = RejectPoison
+	}
+	return func(d amqp.Delivery) Decision {
+		codec, err := CodecFor(d.ContentType)
+		if err != nil {
+			return poison(d, err)
+		}
+		var v T
+		if err := codec.Unmarshal(d.Body, &v); err != nil {
+			return poison(d, fmt.Errorf("cannot decode the message: %w", err))
+		}
+		return handler(v, d)
+	}
+}
+
+// ConsumeTyped consumes from c with ConsumeWithHandlerContext, decoding
+// the deliveries as Typed does.
+func ConsumeTyped[T any](ctx context.Context, c MessageConsumer, opts *ConsumeOpts, handler TypedHandler[T], poison PoisonHandler, concurrency int) error {
+	if handler == nil {
+		return errNilHandler
+	}
+	return c.ConsumeWithHandlerContext(ctx, opts, Typed(handler, poison), concurrency)
+}
@@ -0,0 +1,200 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type codecTestOrder struct {
+	ID    string
+	Price float64
+}
+
+// upperCodec is a registrable codec that stores the ID in upper case
+type upperCodec struct{}
+
+func (upperCodec) ContentType() string { return "text/x-upper" }
+
+func (upperCodec) Marshal(v any) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(codecTestOrder).ID)), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v any) error {
+	v.(*codecTestOrder).ID = string(data)
+	return nil
+}
+
+var codecRoundTripData = map[string]struct {
+	contentType         string
+	expectedContentType string
+}{
+	"empty content type uses json": {contentType: "", expectedContentType: ContentTypeJSON},
+	"json":                         {contentType: ContentTypeJSON, expectedContentType: ContentTypeJSON},
+	"json with charset":            {contentType: "application/json; charset=utf-8", expectedContentType: ContentTypeJSON},
+	"gob":                          {contentType: ContentTypeGob, expectedContentType: ContentTypeGob},
+	"msgpack":                      {contentType: ContentTypeMsgpack, expectedContentType: ContentTypeMsgpack},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for name, d := range codecRoundTripData {
+		t.Run(name, func(t *testing.T) {
+			// arrange
+			order := codecTestOrder{ID: "1", Price: 10.5}
+			codec, err := CodecFor(d.contentType)
+			assert.NoError(t, err)
+
+			// act
+			body, err := codec.Marshal(order)
+			assert.NoError(t, err)
+			var decoded codecTestOrder
+			err = codec.Unmarshal(body, &decoded)
+
+			// assert
+			assert.NoError(t, err)
+			assert.Equal(t, d.expectedContentType, codec.ContentType())
+			assert.Equal(t, order, decoded)
+		})
+	}
+}
+
+func TestProtobufCodecRoundTrip(t *testing.T) {
+	// arrange
+	ch := NewFakeChannel()
+	var decoded *wrapperspb.StringValue
+	handler := Typed(func(v *wrapperspb.StringValue, _ amqp.Delivery) Decision {
+		decoded = v
+		return Ack
+	}, nil)
+
+	// act
+	_, err := Publish(context.Background(), ch, "orders", "created", wrapperspb.String("1"),
+		amqp.Publishing{ContentType: ContentTypeProtobuf})
+	assert.NoError(t, err)
+	published := ch.Published()[0].Msg
+	decision := handler(amqp.Delivery{ContentType: published.ContentType, Body: published.Body})
+
+	// assert
+	assert.Equal(t, ackDecision, decision.kind)
+	assert.Equal(t, "1", decoded.GetValue())
+}
+
+func TestProtobufCodecRejectsOtherValues(t *testing.T) {
+	// arrange
+	codec, err := CodecFor(ContentTypeProtobuf)
+	assert.NoError(t, err)
+
+	// act
+	_, marshalErr := codec.Marshal(codecTestOrder{ID: "1"})
+	unmarshalErr := codec.Unmarshal(nil, &codecTestOrder{})
+
+	// assert
+	assert.True(t, errors.Is(marshalErr, errNotProtoMessage))
+	assert.True(t, errors.Is(unmarshalErr, errNotProtoMessage))
+}
+
+func TestCodecForUnknownContentType(t *testing.T) {
+	// act
+	_, err := CodecFor("application/x-unknown")
+
+	// assert
+	assert.True(t, errors.Is(err, ErrUnknownContentType))
+}
+
+func TestRegisterCodec(t *testing.T) {
+	// arrange
+	RegisterCodec(upperCodec{})
+	ch := NewFakeChannel()
+
+	// act
+	_, err := Publish(context.Background(), ch, "orders", "created", codecTestOrder{ID: "abc"},
+		amqp.Publishing{ContentType: "text/x-upper"})
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, "ABC", string(ch.Published()[0].Msg.Body))
+}
+
+func TestPublishEncodesTheMessage(t *testing.T) {
+	// arrange
+	ch := NewFakeChannel()
+	headers := amqp.Table{"tenant": "a"}
+
+	// act
+	confirmation, err := Publish(context.Background(), ch, "orders", "created",
+		codecTestOrder{ID: "1", Price: 2}, amqp.Publishing{Headers: headers})
+
+	// assert
+	assert.NoError(t, err)
+	assert.True(t, confirmation.Wait())
+	published := ch.Published()[0]
+	assert.Equal(t, ContentTypeJSON, published.Msg.ContentType)
+	assert.Equal(t, `{"ID":"1","Price":2}`, string(published.Msg.Body))
+	assert.Equal(t, headers, published.Msg.Headers)
+}
+
+var typedHandlerData = map[string]struct {
+	delivery       amqp.Delivery
+	poison         PoisonHandler
+	expected       Acknowledgement
+	expectedPoison bool
+}{
+	"decoded message goes to the handler": {
+		delivery: amqp.Delivery{ContentType: ContentTypeJSON, Body: []byte(`{"ID":"1"}`)},
+		expected: Acknowledgement{DeliveryTag: 1, Kind: Acked, Ack: true},
+	},
+	"invalid body goes to the poison handler": {
+		delivery:       amqp.Delivery{ContentType: ContentTypeJSON, Body: []byte(`{"ID":`)},
+		poison:         func(amqp.Delivery, error) Decision { return Nack(false) },
+		expected:       Acknowledgement{DeliveryTag: 1, Kind: Nacked},
+		expectedPoison: true,
+	},
+	"unknown content type goes to the poison handler": {
+		delivery:       amqp.Delivery{ContentType: "application/x-unknown", Body: []byte(`{"ID":"1"}`)},
+		poison:         func(amqp.Delivery, error) Decision { return Nack(false) },
+		expected:       Acknowledgement{DeliveryTag: 1, Kind: Nacked},
+		expectedPoison: true,
+	},
+	"poison is rejected by default": {
+		delivery:       amqp.Delivery{Body: []byte(`not json`)},
+		expected:       Acknowledgement{DeliveryTag: 1, Kind: Rejected},
+		expectedPoison: true,
+	},
+}
+
+func TestConsumeTyped(t *testing.T) {
+	for name, d := range typedHandlerData {
+		t.Run(name, func(t *testing.T) {
+			// arrange
+			ch := NewFakeChannel()
+			var handled codecTestOrder
+			handler := func(v codecTestOrder, _ amqp.Delivery) Decision {
+				handled = v
+				return Ack
+			}
+			consumed := make(chan error)
+			go func() {
+				consumed <- ConsumeTyped(context.Background(), ch, &ConsumeOpts{}, handler, d.poison, 1)
+			}()
+
+			// act
+			assert.NoError(t, ch.Deliver(d.delivery))
+			// the next delivery is only taken after the first is handled
+			assert.NoError(t, ch.Deliver(amqp.Delivery{}))
+			assert.NoError(t, ch.Close())
+
+			// assert
+			assert.NoError(t, <-consumed)
+			ack := ch.Acknowledgements()[0]
+			assert.Equal(t, d.expected.Kind, ack.Kind)
+			assert.Equal(t, d.expected.Ack, ack.Ack)
+			assert.Equal(t, d.expected.Requeue, ack.Requeue)
+			assert.Equal(t, d.expectedPoison, handled.ID == "")
+		})
+	}
+}
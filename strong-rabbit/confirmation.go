@@ -0,0 +1,127 @@
+package strongrabbit
+
+import (
+	"context"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Confirmation is the result of a publish made through a StrongChannel.
+// It resolves when the broker confirms the message, or right after the
+// publish if the channel is not in confirm mode.
+// Its methods mirror the ones from amqp.DeferredConfirmation.
+type Confirmation struct {
+	done     chan struct{}
+	once     sync.Once
+	ack      bool
+	err      error
+	lock     sync.Mutex   // mutex used to read and write the returned message
+	returned *amqp.Return // set when the broker returned the message
+}
+
+func newConfirmation() *Confirmation {
+	return &Confirmation{done: make(chan struct{})}
+}
+
+// resolve sets the confirmation result, only the first call has effect
+func (c *Confirmation) resolve(ack bool, err error) {
+	c.once.Do(func() {
+		c.ack = ack
+		c.err = err
+		close(c.done)
+	})
+}
+
+// markReturned records the message was returned by the broker, it must
+// be called before the confirmation is resolved, as the broker sends the
+// return before the confirmation
+func (c *Confirmation) markReturned(r amqp.Return) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.resolved() {
+		c.returned = &r
+	}
+}
+
+// clearReturned forgets the return of a message that will be
+// republished, the new attempt may be routed
+func (c *Confirmation) clearReturned() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.returned = nil
+}
+
+// resolved reports if the confirmation is resolved
+func (c *Confirmation) resolved() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a chan that is closed when the confirmation is resolved.
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the confirmation is resolved. It returns true if
+// the broker successfully received the message.
+func (c *Confirmation) Wait() bool {
+	<-c.done
+	return c.ack
+}
+
+// WaitContext blocks until the confirmation is resolved or the context
+// is done. It returns true if the broker successfully received the
+// message, and the context error if it's done first.
+func (c *Confirmation) WaitContext(ctx context.Context) (bool, error) {
+	select {
+	case <-c.done:
+		return c.ack, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// Acked returns true if the broker successfully received the message.
+// It returns false while the confirmation is not resolved.
+func (c *Confirmation) Acked() bool {
+	select {
+	case <-c.done:
+		return c.ack
+	default:
+		return false
+	}
+}
+
+// Err returns the reason the message could not be published, eg.: the
+// channel was closed before flushing a buffered message.
+// A message nacked by the broker has a nil error.
+func (c *Confirmation) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Returned reports if the broker returned the message, a mandatory one
+// that could not be routed to any queue or an immediate one that could
+// not be delivered right away, and the returned message. A returned
+// message is still acked, Returned tells it from a delivered one.
+// It's only reported on confirm mode, after the confirmation resolves.
+func (c *Confirmation) Returned() (amqp.Return, bool) {
+	if !c.resolved() {
+		return amqp.Return{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.returned == nil {
+		return amqp.Return{}, false
+	}
+	return *c.returned, true
+}
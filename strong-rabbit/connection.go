@@ -1,8 +1,12 @@
 package strongrabbit
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -13,17 +17,43 @@ var (
 	connLock sync.Mutex
 )
 
+const (
+	defaultHeartbeat = 10 * time.Second // the same heartbeat used by amqp.Dial
+	defaultLocale    = "en_US"          // the same locale used by amqp.Dial
+	dialTimeout      = 30 * time.Second // the same dial and handshake timeout used by amqp.Dial
+)
+
 // StrongConnection encapsulates an amqp connection pointer and the
 // additional data to make auto-reconnect possible.
 // For the caller, it can be used as an *amqp.Connection.
+//
+// The connection watches its own close notifications, when it drops
+// the connection is dialed again and then all the channels opened on
+// it are recovered, one after another.
 type StrongConnection struct {
 	*amqp.Connection
-	group string
-	url   string
+	group           string
+	endpoints       *endpoints // the cluster nodes, the connection can be on any of them
+	opts            options
+	lock            sync.RWMutex     // mutex used when replacing the underlying connection
+	notifyClose     chan *amqp.Error // used to listen to close notifications
+	ready           chan struct{}    // closed while the connection is up, replaced when it drops
+	done            chan struct{}    // closed when the connection is closed or gives up recovering
+	doneOnce        sync.Once        // used to close the done chan only once
+	recoveryStop    chan struct{}    // closes to signal the recovery loop to stop
+	recoveryStopped chan struct{}    // closed by the recovery loop when it stops
+	stopOnce        sync.Once        // used to close the recoveryStop chan only once
+	failErr         error            // set when the connection gives up recovering
+	chLock          sync.Mutex       // mutex used to register and unregister channels
+	channels        []*StrongChannel // the channels opened on this connection, in the registration order
+	unblocked       chan struct{}    // closed while the broker is not blocking the connection
+	blockReason     string           // the reason sent by the broker when blocking the connection
+	reconnects      atomic.Uint64    // how many times the connection was redialed
+	state           stateMachine     // the lifecycle state, reported by State
 }
 
-// Connect receives the rabbitmq endpoint and the connection group,
-// returning a *StrongConnection and an error.
+// Connect receives the rabbitmq endpoint, the connection group and
+// optional settings, returning a *StrongConnection and an error.
 // If a connection for the given group is already made, it's returned
 // without creating a new one.
 //
@@ -32,57 +62,575 @@ type StrongConnection struct {
 // official recommendation of having different connections to publish
 // and consume, while making multiplexing channels on connections possible.
 // https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.Consume
-func Connect(url, group string) (*StrongConnection, error) {
+//
+// The options are kept by the connection and inherited by its channels.
+// They are ignored when the connection is taken from the pool.
+func Connect(url, group string, opts ...Option) (*StrongConnection, error) {
+	return ConnectContext(context.Background(), url, group, opts...)
+}
+
+// ConnectContext behaves as Connect, the context bounds the dial and the
+// setup delay that follows it. If the context is done before connecting,
+// the dial is aborted and ctx.Err() is returned.
+// Once connected, the context doesn't affect the connection, it keeps
+// reconnecting until Close is called.
+func ConnectContext(ctx context.Context, url, group string, opts ...Option) (*StrongConnection, error) {
+	return ConnectClusterContext(ctx, []string{url}, group, opts...)
+}
+
+// ConnectCluster behaves as Connect, receiving the urls of the
+// cluster nodes. The nodes are dialed following the EndpointPolicy
+// set with WithEndpointPolicy, when the connection drops it
+// reconnects to the next available node.
+func ConnectCluster(urls []string, group string, opts ...Option) (*StrongConnection, error) {
+	return ConnectClusterContext(context.Background(), urls, group, opts...)
+}
+
+// ConnectClusterContext behaves as ConnectCluster, the context
+// is used as in ConnectContext.
+func ConnectClusterContext(ctx context.Context, urls []string, group string, opts ...Option) (*StrongConnection, error) {
+	if ctx == nil {
+		return nil, errors.New("nil Context")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, errNoEndpoints
+	}
+	return connect(ctx, urls, group, defaultOptions().apply(opts...))
+}
+
+// connect gets a connection from the pool or dials a new one
+// with the given options
+func connect(ctx context.Context, urls []string, group string, opts options) (*StrongConnection, error) {
 	if conn := getConnection(group); conn != nil {
-		log.Println("got a connection from pool")
+		opts.logger().Debug("got a connection from pool", "group", group)
 		return conn, nil
 	}
 	connLock.Lock()
 	defer connLock.Unlock()
 	// check again if there is a connection after getting the lock
 	if conn := getConnection(group); conn != nil {
-		log.Println("got a connection from pool")
+		opts.logger().Debug("got a connection from pool", "group", group)
 		return conn, nil
 	}
-	log.Println("connecting")
-	conn, err := amqp.Dial(url)
+	opts.logger().Info("connecting", "group", group)
+	eps := newEndpoints(urls, opts.endpointPolicy)
+	conn, err := eps.dial(ctx, opts, group)
 	if err != nil {
 		return nil, err
 	}
-	// Give the connection sometime to setup (as the official library does)
-	<-time.After(time.Second)
 
 	// Creating the strong connection
 	strongConn := &StrongConnection{
-		Connection: conn,
-		group:      group,
-		url:        url,
+		Connection:      conn,
+		group:           group,
+		endpoints:       eps,
+		opts:            opts,
+		notifyClose:     conn.NotifyClose(make(chan *amqp.Error, 1)),
+		ready:           make(chan struct{}),
+		done:            make(chan struct{}),
+		recoveryStop:    make(chan struct{}),
+		recoveryStopped: make(chan struct{}),
+		unblocked:       make(chan struct{}),
 	}
+	close(strongConn.ready)
+	close(strongConn.unblocked)
+	strongConn.state.set(Ready)
+	go strongConn.recoveryLoop()
+	go strongConn.watchBlocked(conn, conn.NotifyBlocked(make(chan amqp.Blocking, 1)))
 
 	connPool[group] = strongConn
-	log.Println("connected")
+	opts.logger().Info("connected", "group", group, "node", eps.node())
 	return strongConn, nil
 }
 
+// dial opens a new amqp connection with the given config, aborting
+// the dial and the handshake if the context is done
+func dial(ctx context.Context, url string, cfg amqp.Config) (*amqp.Connection, error) {
+	cfg = dialConfig(cfg)
+	dialer := cfg.Dial
+	dialed := make(chan net.Conn, 1)
+	cfg.Dial = func(network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if dialer != nil {
+			conn, err = dialer(network, addr)
+		} else {
+			conn, err = dialContext(ctx, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		dialed <- conn
+		return conn, nil
+	}
+
+	// the handshake is not bound to the context,
+	// expire the connection deadline to abort it
+	handshaking := make(chan struct{})
+	defer close(handshaking)
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case conn := <-dialed:
+				conn.SetDeadline(time.Now())
+			default:
+			}
+		case <-handshaking:
+		}
+	}()
+
+	conn, err := amqp.DialConfig(url, cfg)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	// Give the connection sometime to setup (as the official library does)
+	if !wait(time.Second, ctx.Done()) {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return conn, nil
+}
+
+// dialContext opens a tcp connection as amqp.DefaultDial does,
+// aborting it if the context is done
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	// don't stall forever on a dead server while handshaking
+	if err := conn.SetDeadline(time.Now().Add(dialTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialConfig returns a copy of the config to be used on a single dial.
+// The amqp library writes on the TLS config and on the properties, so
+// they are copied too, keeping the config reusable for all the nodes.
+// The zero heartbeat and locale get the amqp.Dial defaults.
+func dialConfig(cfg amqp.Config) amqp.Config {
+	if cfg.Heartbeat == 0 {
+		cfg.Heartbeat = defaultHeartbeat
+	}
+	if cfg.Locale == "" {
+		cfg.Locale = defaultLocale
+	}
+	if cfg.TLSClientConfig != nil {
+		cfg.TLSClientConfig = cfg.TLSClientConfig.Clone()
+	}
+	if cfg.Properties != nil {
+		props := make(amqp.Table, len(cfg.Properties))
+		for k, v := range cfg.Properties {
+			props[k] = v
+		}
+		cfg.Properties = props
+	}
+	return cfg
+}
+
+// WithDialConfig sets the amqp.Config used to dial the connection and
+// every reconnection, making it possible to set TLS client certificates,
+// SASL mechanisms, the heartbeat, the vhost, the frame size and the client
+// properties, eg.: the connection name shown on the management UI, set
+// with Config.Properties.SetClientConnectionName.
+//
+// As with amqp.DialConfig, the url credentials and vhost are used when
+// SASL and Vhost are not set. The zero Heartbeat and Locale fields get
+// the same defaults used by amqp.Dial. It's a connection option, it's
+// ignored when given to Channel.
+func WithDialConfig(cfg amqp.Config) Option {
+	return func(o *options) {
+		o.dialConfig = cfg
+	}
+}
+
+// WithDialer sets the function used to open the network connection of
+// every dial, taking precedence over the Dial of the config given to
+// WithDialConfig. It allows connecting to in-process brokers, such as
+// rabbittest.Broker. It's a connection option, it's ignored when given
+// to Channel.
+func WithDialer(dialer func(network, addr string) (net.Conn, error)) Option {
+	return func(o *options) {
+		o.dialer = dialer
+	}
+}
+
 // getConnection returns the connection of a given group, if there is
-// no connection or the connection is closed, nil is returned
+// no connection or the connection was closed for good, nil is returned.
+// Connections that are recovering are returned, the failed ones are
+// replaced.
 func getConnection(group string) *StrongConnection {
 	conn, ok := connPool[group]
-	if !ok || conn == nil || conn.IsClosed() {
+	if !ok || conn == nil || conn.isDone() {
 		return nil
 	}
 	return conn
 }
 
-// Close the connection and remove it from the internal pool.
+// recoveryLoop listens to the connection close notifications, redials
+// and recovers the channels until the connection is gracefully closed
+// or the reconnection policy gives up
+func (cn *StrongConnection) recoveryLoop() {
+	defer close(cn.recoveryStopped)
+	for {
+		_, notifyClose := cn.current()
+		select {
+		case <-cn.recoveryStop:
+			return
+
+		case err := <-notifyClose:
+			// the connection was closed gracefully
+			if err == nil {
+				cn.finish(nil)
+				return
+			}
+			cn.logger().Warn("connection lost", "group", cn.group, "node", cn.Node(), "error", err)
+			emit(cn.opts.events.OnDisconnect, Event{Group: cn.group, Node: cn.Node(), Err: err})
+			if !cn.recover() {
+				return
+			}
+		}
+	}
+}
+
+// recover redials the connection following the reconnection policy and
+// then reopens all the registered channels, one by one. It returns false
+// if the connection was closed or the reconnection attempts run out
+func (cn *StrongConnection) recover() bool {
+	cn.markRecovering()
+
+	// abort a dial in progress when the connection is closed
+	ctx, cancel := stopContext(cn.recoveryStop)
+	defer cancel()
+
+	policy := cn.opts.reconnectPolicy
+	var conn *amqp.Connection
+	for failedAttempts := 0; conn == nil; {
+		if !wait(policy.delay(failedAttempts+1), cn.recoveryStop) {
+			return false
+		}
+		emit(cn.opts.events.OnReconnectAttempt, Event{Group: cn.group, Attempt: failedAttempts + 1})
+
+		var err error
+		conn, err = cn.endpoints.dial(ctx, cn.opts, cn.group)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		failedAttempts++
+		cn.logger().Warn("cannot reconnect", "group", cn.group, "attempt", failedAttempts, "error", err)
+		if policy.exhausted(failedAttempts) {
+			cn.giveUp(err)
+			return false
+		}
+	}
+
+	cn.lock.Lock()
+	cn.Connection = conn
+	cn.notifyClose = conn.NotifyClose(make(chan *amqp.Error, 1))
+	// the new connection starts unblocked
+	if cn.isBlocked() {
+		close(cn.unblocked)
+		cn.blockReason = ""
+	}
+	cn.lock.Unlock()
+	go cn.watchBlocked(conn, conn.NotifyBlocked(make(chan amqp.Blocking, 1)))
+	cn.reconnects.Add(1)
+	cn.logger().Info("reconnected", "group", cn.group, "node", cn.Node())
+
+	// recover the channels in the order they were opened, the ones that
+	// fail will retry by themselves after the connection is marked as ready
+	for _, ch := range cn.registeredChannels() {
+		if err := ch.reconnect(); err != nil {
+			cn.logger().Warn("cannot recover channel", "group", cn.group, "channel", ch.Name, "error", err)
+		}
+	}
+
+	cn.lock.Lock()
+	close(cn.ready)
+	cn.lock.Unlock()
+	cn.state.set(Ready)
+	emit(cn.opts.events.OnReconnected, Event{Group: cn.group, Node: cn.Node()})
+	return true
+}
+
+// stopContext returns a context that is cancelled when the stop chan closes
+func stopContext(stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// watchBlocked listens to the connection.blocked notifications of
+// the underlying connection, until it closes. A closed connection
+// is not blocked anymore, the publishers waiting are released.
+// The notifications are registered by the caller, the amqp lib
+// doesn't lock them while the connection reads the frames.
+func (cn *StrongConnection) watchBlocked(conn *amqp.Connection, blocks chan amqp.Blocking) {
+	for b := range blocks {
+		if !cn.setBlocked(conn, b.Active, b.Reason) {
+			continue
+		}
+		e := Event{Group: cn.group, Node: cn.Node(), Blocked: b.Active}
+		if b.Active {
+			e.Err = fmt.Errorf("%w: %s", ErrBlocked, b.Reason)
+			cn.logger().Warn("connection blocked", "group", cn.group, "reason", b.Reason)
+		} else {
+			cn.logger().Info("connection unblocked", "group", cn.group)
+		}
+		emit(cn.opts.events.OnBlocked, e)
+	}
+	cn.setBlocked(conn, false, "")
+}
+
+// setBlocked updates the blocked state, if the given connection is still
+// the current one. It returns false if the state was not changed.
+func (cn *StrongConnection) setBlocked(conn *amqp.Connection, blocked bool, reason string) bool {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	if cn.Connection != conn {
+		return false
+	}
+
+	wasBlocked := cn.isBlocked()
+	switch {
+	case blocked && !wasBlocked:
+		cn.unblocked = make(chan struct{})
+	case !blocked && wasBlocked:
+		close(cn.unblocked)
+	default:
+		return false
+	}
+	cn.blockReason = reason
+	return true
+}
+
+// isBlocked reports if the unblocked chan is open,
+// it must be called with the lock held
+func (cn *StrongConnection) isBlocked() bool {
+	select {
+	case <-cn.unblocked:
+		return false
+	default:
+		return true
+	}
+}
+
+// Blocked reports if the broker is blocking the connection, eg.: due to
+// a memory or disk alarm, and the reason it sent. While blocked the broker
+// doesn't read the messages published on the connection.
+func (cn *StrongConnection) Blocked() (blocked bool, reason string) {
+	cn.lock.RLock()
+	defer cn.lock.RUnlock()
+	return cn.isBlocked(), cn.blockReason
+}
+
+// waitUnblocked follows the blocked policy. It returns nil right
+// away if the connection is not blocked, otherwise ErrBlocked is
+// returned or it waits for the connection to be unblocked, until
+// the context is done.
+func (cn *StrongConnection) waitUnblocked(ctx context.Context, policy BlockedPolicy) error {
+	cn.lock.RLock()
+	unblocked, reason := cn.unblocked, cn.blockReason
+	cn.lock.RUnlock()
+
+	select {
+	case <-unblocked:
+		return nil
+	default:
+	}
+
+	if policy == FailWhileBlocked {
+		return fmt.Errorf("%w: %s", ErrBlocked, reason)
+	}
+	select {
+	case <-unblocked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Node returns the address of the cluster node the connection is on,
+// or was on before dropping. The credentials are not included.
+func (cn *StrongConnection) Node() string {
+	return cn.endpoints.node()
+}
+
+// logger returns the logger set on the connection options
+func (cn *StrongConnection) logger() Logger {
+	return cn.opts.logger()
+}
+
+// current returns the underlying connection and its close notifications
+func (cn *StrongConnection) current() (*amqp.Connection, chan *amqp.Error) {
+	cn.lock.RLock()
+	defer cn.lock.RUnlock()
+	return cn.Connection, cn.notifyClose
+}
+
+// markRecovering replaces the ready chan, to make the channels wait
+// for the recovery. If the connection is already recovering nothing
+// is done, so it's safe to be called by the channels and the
+// recovery loop.
+func (cn *StrongConnection) markRecovering() {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	select {
+	case <-cn.ready:
+		cn.ready = make(chan struct{})
+		cn.state.set(Recovering)
+	default:
+	}
+}
+
+// waitReady blocks while the connection is recovering. It returns false
+// if the stop chan closes or the connection is closed for good
+func (cn *StrongConnection) waitReady(stop <-chan struct{}) bool {
+	// a channel can notice the connection drop before the
+	// recovery loop does
+	if conn, _ := cn.current(); conn.IsClosed() {
+		cn.markRecovering()
+	}
+
+	cn.lock.RLock()
+	ready := cn.ready
+	cn.lock.RUnlock()
+
+	select {
+	case <-ready:
+		return !cn.isDone()
+	case <-cn.done:
+		return false
+	case <-stop:
+		return false
+	}
+}
+
+// giveUp puts the connection on a terminal failed state. It stays on
+// the pool, reported as Failed, until a new Connect replaces it or
+// Close is called
+func (cn *StrongConnection) giveUp(err error) {
+	failErr := giveUpError(err)
+	cn.logger().Error("connection will not reconnect", "group", cn.group, "error", failErr)
+	cn.finish(failErr)
+	emit(cn.opts.events.OnGiveUp, Event{Group: cn.group, Err: failErr})
+}
+
+// finish marks the connection as done, a gracefully
+// closed connection is removed from the pool
+func (cn *StrongConnection) finish(err error) {
+	cn.doneOnce.Do(func() {
+		cn.lock.Lock()
+		cn.failErr = err
+		cn.lock.Unlock()
+		close(cn.done)
+		if err != nil {
+			cn.state.set(Failed)
+			return
+		}
+		cn.state.set(Closed)
+		cn.logger().Info("connection closed", "group", cn.group)
+		emit(cn.opts.events.OnClosed, Event{Group: cn.group})
+	})
+	if err != nil {
+		return
+	}
+
+	connLock.Lock()
+	if connPool[cn.group] == cn {
+		delete(connPool, cn.group)
+	}
+	connLock.Unlock()
+}
+
+// isDone reports if the connection was closed for good
+func (cn *StrongConnection) isDone() bool {
+	select {
+	case <-cn.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err returns the error that made the connection give up recovering.
+// If the connection is working or it was gracefully closed, nil is returned.
+func (cn *StrongConnection) Err() error {
+	cn.lock.RLock()
+	defer cn.lock.RUnlock()
+	return cn.failErr
+}
+
+// register adds a channel to be recovered with the connection
+func (cn *StrongConnection) register(ch *StrongChannel) {
+	cn.chLock.Lock()
+	defer cn.chLock.Unlock()
+	cn.channels = append(cn.channels, ch)
+}
+
+// unregister removes a channel from the connection
+func (cn *StrongConnection) unregister(ch *StrongChannel) {
+	cn.chLock.Lock()
+	defer cn.chLock.Unlock()
+	for i := range cn.channels {
+		if cn.channels[i] == ch {
+			cn.channels = append(cn.channels[:i], cn.channels[i+1:]...)
+			return
+		}
+	}
+}
+
+// registeredChannels returns a snapshot of the channels opened on the
+// connection, in the registration order. It's safe to call the channel
+// methods on them.
+func (cn *StrongConnection) registeredChannels() []*StrongChannel {
+	cn.chLock.Lock()
+	defer cn.chLock.Unlock()
+	channels := make([]*StrongChannel, len(cn.channels))
+	copy(channels, cn.channels)
+	return channels
+}
+
+// Close closes all the channels opened on the connection, then closes
+// the connection and remove it from the internal pool.
 // If the connection is already closed or nil, no error is returned.
 // It is safe to call this method multiple times.
 func (cn *StrongConnection) Close() error {
-	if cn.Connection == nil || cn.Connection.IsClosed() {
-		delete(connPool, cn.group)
-		return nil
+	// close the channels first, so they don't try to recover
+	for _, ch := range cn.registeredChannels() {
+		ch.Close()
+	}
+
+	// stop the recovery loop
+	cn.stopOnce.Do(func() { close(cn.recoveryStop) })
+	<-cn.recoveryStopped
+
+	var err error
+	conn, _ := cn.current()
+	if conn != nil && !conn.IsClosed() {
+		err = conn.Close()
 	}
-	err := cn.Connection.Close()
-	delete(connPool, cn.group)
+	cn.finish(nil)
 	return err
 }
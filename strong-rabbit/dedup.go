@@ -0,0 +1,182 @@
+package strongrabbit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultDedupSize = 10000
+	defaultDedupTTL  = 24 * time.Hour
+)
+
+// DedupStore records the keys of the processed deliveries.
+type DedupStore interface {
+	// Seen reports if the key was already processed.
+	Seen(key string) (bool, error)
+	// Mark records the key as processed.
+	Mark(key string) error
+}
+
+// DedupOpts is a struct that encapsulates the settings of Dedup.
+type DedupOpts struct {
+	Store  DedupStore                   // where the processed keys are recorded, defaults to a MemoryDedupStore
+	Key    func(d amqp.Delivery) string // the key of a delivery, defaults to its MessageId
+	Logger Logger                       // defaults to the standard log package
+	// MarkedByHandler tells that the handler records the key itself,
+	// eg.: on the same transaction of its writes, so Mark is not called.
+	MarkedByHandler bool
+}
+
+// MessageIdKey is the default key of Dedup, the MessageId of the delivery.
+func MessageIdKey(d amqp.Delivery) string {
+	return d.MessageId
+}
+
+// Dedup returns a Handler that acks the deliveries already processed
+// without calling the handler, making the consumer idempotent for
+// redeliveries and republished messages.
+//
+// A delivery is recorded as processed when the handler acks it, the
+// other decisions let it be processed again. Deliveries with an empty
+// key are always handled. When the store fails the handler is called,
+// a duplicate is preferred over a lost message.
+//
+// A crash between the handler and the record processes the message
+// again, when the handler writes to the same database of the store it
+// should record the key on its own transaction, with MarkedByHandler.
+//
+// The check and the record are not atomic, two copies of a message
+// handled at the same time by different workers are both processed.
+func Dedup(handler Handler, opts DedupOpts) Handler {
+	if opts.Store == nil {
+		opts.Store = NewMemoryDedupStore(defaultDedupSize, defaultDedupTTL)
+	}
+	if opts.Key == nil {
+		opts.Key = MessageIdKey
+	}
+	if opts.Logger == nil {
+		opts.Logger = stdLogger{}
+	}
+
+	return func(d amqp.Delivery) Decision {
+		key := opts.Key(d)
+		if key == "" {
+			return handler(d)
+		}
+
+		seen, err := opts.Store.Seen(key)
+		if err != nil {
+			opts.Logger.Warn("cannot check if the delivery was processed", "key", key, "error", err)
+		}
+		if seen {
+			opts.Logger.Debug("duplicated delivery acked", "key", key, "deliveryTag", d.DeliveryTag)
+			return Ack
+		}
+
+		decision := handler(d)
+		if decision.kind != ackDecision || opts.MarkedByHandler {
+			return decision
+		}
+		if err := opts.Store.Mark(key); err != nil {
+			opts.Logger.Warn("cannot record the processed delivery", "key", key, "error", err)
+		}
+		return decision
+	}
+}
+
+// MemoryDedupStore is an in-memory LRU DedupStore that keeps the most
+// recently used keys, up to a size, for a TTL. It's safe for
+// concurrent use.
+type MemoryDedupStore struct {
+	lock  sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List // front is the most recently used key
+	keys  map[string]*list.Element
+	now   func() time.Time
+}
+
+// dedupEntry is a key recorded on the MemoryDedupStore
+type dedupEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// NewMemoryDedupStore creates a MemoryDedupStore keeping up to size keys,
+// the least recently used, seen or marked, are evicted first. A zero ttl
+// keeps the keys until they are evicted.
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	if size < 1 {
+		size = 1
+	}
+	return &MemoryDedupStore{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+// Seen reports if the key was marked and didn't expire yet, a seen
+// key becomes the most recently used. Its TTL is not renewed.
+func (s *MemoryDedupStore) Seen(key string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.keys[key]
+	if !ok {
+		return false, nil
+	}
+	if s.expired(e.Value.(*dedupEntry)) {
+		s.remove(e)
+		return false, nil
+	}
+	s.order.MoveToFront(e)
+	return true, nil
+}
+
+// Mark records the key, evicting the least recently used
+// one when the store is full.
+func (s *MemoryDedupStore) Mark(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var expiresAt time.Time
+	if s.ttl > 0 {
+		expiresAt = s.now().Add(s.ttl)
+	}
+	if e, ok := s.keys[key]; ok {
+		e.Value.(*dedupEntry).expiresAt = expiresAt
+		s.order.MoveToFront(e)
+		return nil
+	}
+
+	s.keys[key] = s.order.PushFront(&dedupEntry{key: key, expiresAt: expiresAt})
+	for s.order.Len() > s.size {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+// Len returns how many keys are recorded, including the expired
+// ones not evicted yet.
+func (s *MemoryDedupStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.order.Len()
+}
+
+// expired reports if the entry TTL is over
+func (s *MemoryDedupStore) expired(entry *dedupEntry) bool {
+	return !entry.expiresAt.IsZero() && !s.now().Before(entry.expiresAt)
+}
+
+// remove deletes the entry, it must be called with the lock held
+func (s *MemoryDedupStore) remove(e *list.Element) {
+	s.order.Remove(e)
+	delete(s.keys, e.Value.(*dedupEntry).key)
+}
@@ -0,0 +1,146 @@
+package strongrabbit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+// failingDedupStore is a DedupStore that always fails
+type failingDedupStore struct{}
+
+func (failingDedupStore) Seen(string) (bool, error) { return false, errors.New("store is down") }
+
+func (failingDedupStore) Mark(string) error { return errors.New("store is down") }
+
+var dedupData = map[string]struct {
+	store           func() DedupStore
+	key             func(d amqp.Delivery) string
+	markedByHandler bool
+	decision        Decision
+	deliveries      []amqp.Delivery
+	expectedCalls   int
+}{
+	"duplicated message id is acked without handling": {
+		decision:      Ack,
+		deliveries:    []amqp.Delivery{{MessageId: "1"}, {MessageId: "1", Redelivered: true}, {MessageId: "2"}},
+		expectedCalls: 2,
+	},
+	"not acked message is handled again": {
+		decision:      Nack(true),
+		deliveries:    []amqp.Delivery{{MessageId: "1"}, {MessageId: "1", Redelivered: true}},
+		expectedCalls: 2,
+	},
+	"message without key is always handled": {
+		decision:      Ack,
+		deliveries:    []amqp.Delivery{{}, {}},
+		expectedCalls: 2,
+	},
+	"custom key": {
+		key:           func(d amqp.Delivery) string { return d.CorrelationId },
+		decision:      Ack,
+		deliveries:    []amqp.Delivery{{MessageId: "1", CorrelationId: "a"}, {MessageId: "2", CorrelationId: "a"}},
+		expectedCalls: 1,
+	},
+	"store failure handles the message": {
+		store:         func() DedupStore { return failingDedupStore{} },
+		decision:      Ack,
+		deliveries:    []amqp.Delivery{{MessageId: "1"}, {MessageId: "1"}},
+		expectedCalls: 2,
+	},
+	"key marked by the handler is not recorded": {
+		markedByHandler: true,
+		decision:        Ack,
+		deliveries:      []amqp.Delivery{{MessageId: "1"}, {MessageId: "1"}},
+		expectedCalls:   2,
+	},
+}
+
+func TestDedup(t *testing.T) {
+	for name, d := range dedupData {
+		t.Run(name, func(t *testing.T) {
+			// arrange
+			opts := DedupOpts{Key: d.key, Logger: discardLogger{}, MarkedByHandler: d.markedByHandler}
+			if d.store != nil {
+				opts.Store = d.store()
+			}
+			calls := 0
+			handler := Dedup(func(amqp.Delivery) Decision {
+				calls++
+				return d.decision
+			}, opts)
+
+			// act
+			decisions := make([]Decision, 0, len(d.deliveries))
+			for _, delivery := range d.deliveries {
+				decisions = append(decisions, handler(delivery))
+			}
+
+			// assert
+			assert.Equal(t, d.expectedCalls, calls)
+			for _, decision := range decisions {
+				assert.True(t, decision.kind == ackDecision || decision.kind == d.decision.kind)
+			}
+		})
+	}
+}
+
+func TestMemoryDedupStoreEvictsTheLeastRecentlyUsed(t *testing.T) {
+	// arrange
+	store := NewMemoryDedupStore(2, 0)
+	assert.NoError(t, store.Mark("1"))
+	assert.NoError(t, store.Mark("2"))
+	assert.NoError(t, store.Mark("1"))
+
+	// act
+	assert.NoError(t, store.Mark("3"))
+
+	// assert
+	assert.Equal(t, 2, store.Len())
+	for key, expected := range map[string]bool{"1": true, "2": false, "3": true} {
+		seen, err := store.Seen(key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, seen)
+	}
+}
+
+func TestMemoryDedupStoreSeenKeysAreNotEvictedFirst(t *testing.T) {
+	// arrange
+	store := NewMemoryDedupStore(2, 0)
+	assert.NoError(t, store.Mark("1"))
+	assert.NoError(t, store.Mark("2"))
+
+	// act
+	seen, err := store.Seen("1")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Mark("3"))
+
+	// assert
+	assert.True(t, seen)
+	seen1, _ := store.Seen("1")
+	seen2, _ := store.Seen("2")
+	assert.True(t, seen1)
+	assert.False(t, seen2)
+	assert.Equal(t, 2, store.Len())
+}
+
+func TestMemoryDedupStoreExpiresTheKeys(t *testing.T) {
+	// arrange
+	now := time.Now()
+	store := NewMemoryDedupStore(10, time.Minute)
+	store.now = func() time.Time { return now }
+	assert.NoError(t, store.Mark("1"))
+
+	// act
+	seenBefore, _ := store.Seen("1")
+	now = now.Add(time.Minute)
+	seenAfter, _ := store.Seen("1")
+
+	// assert
+	assert.True(t, seenBefore)
+	assert.False(t, seenAfter)
+	assert.Equal(t, 0, store.Len())
+}
@@ -0,0 +1,171 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// EndpointSelection defines the order the cluster nodes are dialed.
+type EndpointSelection int
+
+const (
+	// Ordered always dials the nodes in the given order, the first
+	// node works as a primary and the others as fallbacks.
+	Ordered EndpointSelection = iota
+	// RoundRobin starts dialing from the node after the last one used,
+	// spreading the connections across the cluster.
+	RoundRobin
+	// Random dials the nodes in a random order.
+	Random
+)
+
+// EndpointPolicy controls how the cluster nodes are picked when
+// connecting and reconnecting.
+//
+// A node that fails to dial stays on cooldown for the Cooldown duration,
+// the nodes on cooldown are only dialed after all the other nodes failed.
+type EndpointPolicy struct {
+	Selection EndpointSelection
+	Cooldown  time.Duration
+}
+
+// DefaultEndpointPolicy dials the nodes in order, with a ten
+// seconds cooldown for the failed ones.
+var DefaultEndpointPolicy = EndpointPolicy{
+	Selection: Ordered,
+	Cooldown:  time.Second * 10,
+}
+
+var errNoEndpoints = errors.New("no endpoints to connect")
+
+// WithEndpointPolicy sets how the cluster nodes are picked
+// by ConnectCluster.
+func WithEndpointPolicy(p EndpointPolicy) Option {
+	return func(o *options) {
+		o.endpointPolicy = p
+	}
+}
+
+// endpoints keeps the cluster nodes and their failures,
+// picking the order they are dialed
+type endpoints struct {
+	lock     sync.Mutex
+	urls     []string
+	policy   EndpointPolicy
+	failedAt []time.Time // when each node last failed, zero if it's not on cooldown
+	current  int         // the node of the current connection
+	now      func() time.Time
+}
+
+func newEndpoints(urls []string, policy EndpointPolicy) *endpoints {
+	return &endpoints{
+		urls:     urls,
+		policy:   policy,
+		failedAt: make([]time.Time, len(urls)),
+		current:  -1,
+		now:      time.Now,
+	}
+}
+
+// order returns the indexes of the nodes in the order they must be
+// dialed. The nodes on cooldown go last, the ones that failed first
+// are dialed first.
+func (e *endpoints) order() []int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	n := len(e.urls)
+	candidates := make([]int, n)
+	switch e.policy.Selection {
+	case RoundRobin:
+		for i := range candidates {
+			candidates[i] = (e.current + 1 + i) % n
+		}
+	case Random:
+		candidates = rand.Perm(n)
+	default:
+		for i := range candidates {
+			candidates[i] = i
+		}
+	}
+
+	now := e.now()
+	var ready, cooling []int
+	for _, i := range candidates {
+		if !e.failedAt[i].IsZero() && now.Sub(e.failedAt[i]) < e.policy.Cooldown {
+			cooling = append(cooling, i)
+			continue
+		}
+		ready = append(ready, i)
+	}
+	sort.SliceStable(cooling, func(a, b int) bool {
+		return e.failedAt[cooling[a]].Before(e.failedAt[cooling[b]])
+	})
+	return append(ready, cooling...)
+}
+
+// failed puts the node on cooldown
+func (e *endpoints) failed(i int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.failedAt[i] = e.now()
+}
+
+// connected marks the node as the current one and removes it from cooldown
+func (e *endpoints) connected(i int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.failedAt[i] = time.Time{}
+	e.current = i
+}
+
+// node returns the address of the current node, without the credentials
+func (e *endpoints) node() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.current < 0 {
+		return ""
+	}
+	return nodeAddress(e.urls[e.current])
+}
+
+// dial tries the nodes once, in order, returning the first connection
+// made. If all of them fail, the last error is returned.
+func (e *endpoints) dial(ctx context.Context, opts options, group string) (*amqp.Connection, error) {
+	cfg := opts.dialConfig
+	if opts.dialer != nil {
+		cfg.Dial = opts.dialer
+	}
+	err := errNoEndpoints
+	for _, i := range e.order() {
+		var conn *amqp.Connection
+		conn, err = dial(ctx, e.urls[i], cfg)
+		if err == nil {
+			e.connected(i)
+			return conn, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		e.failed(i)
+		opts.logger().Warn("cannot dial node", "group", group, "node", nodeAddress(e.urls[i]), "error", err)
+	}
+	return nil, err
+}
+
+// nodeAddress returns the host and port of the url,
+// to be logged without exposing the credentials
+func nodeAddress(url string) string {
+	uri, err := amqp.ParseURI(url)
+	if err != nil {
+		return "invalid url"
+	}
+	return fmt.Sprintf("%s:%d", uri.Host, uri.Port)
+}
@@ -0,0 +1,88 @@
+package strongrabbit
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger is the logging interface used by strong-rabbit. The messages
+// are followed by key-value pairs, as in the log/slog package, so a
+// *slog.Logger can be used directly.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Event describes a lifecycle transition of a connection or a channel.
+// Connection events have an empty Channel.
+type Event struct {
+	Channel string // the channel name
+	Group   string // the connection group
+	Node    string // the address of the cluster node, set on the connection events
+	Err     error  // the error that caused the transition, if any
+	Attempt int    // the reconnection attempt, starting at 1
+	Blocked bool   // on OnBlocked, reports if the connection was blocked or unblocked
+}
+
+// EventOpts is a struct that encapsulates the logger and the callbacks
+// called on the connection and channel lifecycle transitions.
+// The callbacks run on the reconnection go routines, so they must
+// not block. Nil callbacks are ignored.
+type EventOpts struct {
+	Logger             Logger      // defaults to the standard log package
+	OnDisconnect       func(Event) // the connection or channel was closed by an error
+	OnReconnectAttempt func(Event) // a reconnection attempt is about to start
+	OnReconnected      func(Event) // the connection or channel is working again
+	OnGiveUp           func(Event) // the reconnection attempts run out
+	OnBlocked          func(Event) // the broker blocked or unblocked the connection
+	OnClosed           func(Event) // the connection or channel was closed for good
+}
+
+// WithEvents sets the logger and the lifecycle callbacks.
+func WithEvents(opts EventOpts) Option {
+	return func(o *options) {
+		o.events = opts
+	}
+}
+
+// logger returns the configured logger or the standard one
+func (o options) logger() Logger {
+	if o.events.Logger != nil {
+		return o.events.Logger
+	}
+	return stdLogger{}
+}
+
+// emit calls the callback, if it's set
+func emit(callback func(Event), e Event) {
+	if callback != nil {
+		callback(e)
+	}
+}
+
+// stdLogger writes to the standard log package, the key-value
+// pairs are appended to the message as key=value
+type stdLogger struct{}
+
+func (l stdLogger) Debug(msg string, args ...any) { l.print("DEBUG", msg, args) }
+func (l stdLogger) Info(msg string, args ...any)  { l.print("INFO", msg, args) }
+func (l stdLogger) Warn(msg string, args ...any)  { l.print("WARN", msg, args) }
+func (l stdLogger) Error(msg string, args ...any) { l.print("ERROR", msg, args) }
+
+func (stdLogger) print(level, msg string, args []any) {
+	var sb strings.Builder
+	sb.WriteString(level)
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&sb, " %v", args[i])
+			break
+		}
+		fmt.Fprintf(&sb, " %v=%v", args[i], args[i+1])
+	}
+	log.Println(sb.String())
+}
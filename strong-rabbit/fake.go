@@ -0,0 +1,401 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// PublishedMessage is a publish recorded by a FakeChannel.
+type PublishedMessage struct {
+	Exchange  string
+	Key       string
+	Mandatory bool
+	Immediate bool
+	Msg       amqp.Publishing
+}
+
+// Declaration is a topology call recorded by a FakeChannel. Method is the
+// name of the called method, eg.: QueueBind, the fields the method
+// doesn't receive are left empty.
+type Declaration struct {
+	Method     string
+	Name       string // exchange or queue name, or binding destination
+	Kind       string // the exchange type, eg.: direct, fanout, topic
+	Key        string // binding routing key
+	Source     string // binding source exchange
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Internal   bool
+	NoWait     bool
+	IfUnused   bool
+	IfEmpty    bool
+	Args       amqp.Table
+}
+
+// AckKind tells how a delivery consumed from a FakeChannel was acknowledged.
+type AckKind int
+
+const (
+	Acked    AckKind = iota + 1 // acked by Ack or by the Ack decision
+	Nacked                      // nacked by Nack or by the Nack decision
+	Rejected                    // rejected by Reject or by the Reject decision
+	Retried                     // the handler returned the Retry decision
+)
+
+// Acknowledgement is an ack, nack, reject or retry of a delivery
+// consumed from a FakeChannel.
+type Acknowledgement struct {
+	DeliveryTag uint64
+	Kind        AckKind
+	Ack         bool // false for nacks and rejects
+	Multiple    bool
+	Requeue     bool
+	Retry       error // the error given to Retry, the retry is not published
+}
+
+// FakeChannel is an in-memory MessagePublisher, MessageConsumer and
+// TopologyDeclarer that records the calls made to it. It allows unit
+// testing code that depends on those interfaces without a broker.
+//
+// Publishes are confirmed right away, deliveries are fed with Deliver
+// and their acknowledgements are recorded. Like a StrongChannel, it
+// can only consume once, and a done consume context closes it.
+type FakeChannel struct {
+	lock         sync.Mutex
+	published    []PublishedMessage
+	declarations []Declaration
+	acks         []Acknowledgement
+	publishErr   error
+	nack         bool
+	consuming    bool
+	deliveryTag  uint64
+	queues       int
+	deliveries   chan amqp.Delivery
+	done         chan struct{}
+	closed       bool
+}
+
+var (
+	_ MessagePublisher = (*FakeChannel)(nil)
+	_ BatchPublisher   = (*FakeChannel)(nil)
+	_ MessageConsumer  = (*FakeChannel)(nil)
+	_ TopologyDeclarer = (*FakeChannel)(nil)
+)
+
+// NewFakeChannel creates an open FakeChannel.
+func NewFakeChannel() *FakeChannel {
+	return &FakeChannel{
+		deliveries: make(chan amqp.Delivery),
+		done:       make(chan struct{}),
+	}
+}
+
+// FailPublishes makes the following publishes return err,
+// a nil err makes them succeed again.
+func (f *FakeChannel) FailPublishes(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.publishErr = err
+}
+
+// NackPublishes makes the confirmations of the following publishes
+// resolve as nacks, until it's called with false.
+func (f *FakeChannel) NackPublishes(nack bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.nack = nack
+}
+
+// Published returns the recorded publishes, in order.
+func (f *FakeChannel) Published() []PublishedMessage {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]PublishedMessage(nil), f.published...)
+}
+
+// Declarations returns the recorded topology calls, in order.
+func (f *FakeChannel) Declarations() []Declaration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]Declaration(nil), f.declarations...)
+}
+
+// Acknowledgements returns the recorded acks, nacks and rejects, in order.
+func (f *FakeChannel) Acknowledgements() []Acknowledgement {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]Acknowledgement(nil), f.acks...)
+}
+
+// Deliver sends the delivery to the consumer, blocking until it's taken.
+// The delivery tag is set when it's zero and the acknowledgements are
+// recorded by the FakeChannel. It returns an error if the channel is
+// closed first.
+func (f *FakeChannel) Deliver(d amqp.Delivery) error {
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return errChannelClosed
+	}
+	if d.DeliveryTag == 0 {
+		f.deliveryTag++
+		d.DeliveryTag = f.deliveryTag
+	}
+	d.Acknowledger = fakeAcknowledger{f}
+	f.lock.Unlock()
+
+	select {
+	case f.deliveries <- d:
+		return nil
+	case <-f.done:
+		return errChannelClosed
+	}
+}
+
+// Close stops the consumer, the following calls return an error.
+// It is safe to call this method multiple times, as on StrongChannel.
+func (f *FakeChannel) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	close(f.done)
+	return nil
+}
+
+// PublishWithContext records the publish.
+func (f *FakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	_, err := f.PublishConfirmed(ctx, exchange, key, mandatory, immediate, msg)
+	return err
+}
+
+// PublishConfirmed records the publish and returns a resolved
+// Confirmation, acked unless NackPublishes was set.
+func (f *FakeChannel) PublishConfirmed(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*Confirmation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return nil, errChannelClosed
+	}
+	if f.publishErr != nil {
+		return nil, f.publishErr
+	}
+	f.published = append(f.published, PublishedMessage{
+		Exchange:  exchange,
+		Key:       key,
+		Mandatory: mandatory,
+		Immediate: immediate,
+		Msg:       msg,
+	})
+
+	confirmation := newConfirmation()
+	confirmation.resolve(!f.nack, nil)
+	return confirmation, nil
+}
+
+// PublishBatch publishes the messages as StrongChannel.PublishBatch,
+// on the FakeChannel they are resolved right away.
+func (f *FakeChannel) PublishBatch(ctx context.Context, msgs []BatchMessage, opts BatchOpts) ([]BatchResult, error) {
+	return publishBatch(ctx, f, msgs, opts.withDefaults(), func(ctx context.Context) error {
+		return ctx.Err()
+	})
+}
+
+// ConsumeContext sends the deliveries given to Deliver to the out chan,
+// until the channel is closed or the context is done. It follows the
+// same rules of StrongChannel.ConsumeContext.
+func (f *FakeChannel) ConsumeContext(ctx context.Context, opts *ConsumeOpts, out chan amqp.Delivery) error {
+	return f.consume(ctx, opts, func(d amqp.Delivery) bool {
+		select {
+		case out <- d:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-f.done:
+			return false
+		}
+	})
+}
+
+// ConsumeWithHandlerContext calls the handler for each delivery given to
+// Deliver, recording the acknowledgement of the returned Decision. The
+// handler is called by a single go routine, whatever the concurrency.
+// It follows the same rules of StrongChannel.ConsumeWithHandlerContext.
+func (f *FakeChannel) ConsumeWithHandlerContext(ctx context.Context, opts *ConsumeOpts, handler Handler, concurrency int) error {
+	if handler == nil {
+		return errNilHandler
+	}
+	if opts != nil && opts.AutoAck {
+		return errHandlerAutoAck
+	}
+	return f.consume(ctx, opts, func(d amqp.Delivery) bool {
+		f.handle(d, handler)
+		return true
+	})
+}
+
+// consume passes the deliveries to handle until the channel is closed
+// or the context is done, the later closes the channel
+func (f *FakeChannel) consume(ctx context.Context, opts *ConsumeOpts, handle func(d amqp.Delivery) bool) error {
+	if ctx == nil {
+		return errors.New("nil Context")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if opts == nil {
+		return errNilConsumeOpts
+	}
+
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return errChannelClosed
+	}
+	if f.consuming {
+		f.lock.Unlock()
+		return errAlreadyConsuming
+	}
+	f.consuming = true
+	f.lock.Unlock()
+
+consumeLoop:
+	for {
+		select {
+		case d := <-f.deliveries:
+			if !handle(d) {
+				break consumeLoop
+			}
+		case <-ctx.Done():
+			break consumeLoop
+		case <-f.done:
+			return nil
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// handle calls the handler and records the acknowledgement,
+// as StrongChannel does, without publishing the retries
+func (f *FakeChannel) handle(d amqp.Delivery, handler Handler) {
+	decision, _ := callHandler(d, handler)
+	applyDecision(d, decision, f.retry)
+}
+
+// retry records the retry of the delivery
+func (f *FakeChannel) retry(d amqp.Delivery, cause error) error {
+	f.acknowledge(Acknowledgement{DeliveryTag: d.DeliveryTag, Kind: Retried, Ack: true, Retry: cause})
+	return nil
+}
+
+// acknowledge records an acknowledgement
+func (f *FakeChannel) acknowledge(ack Acknowledgement) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.acks = append(f.acks, ack)
+}
+
+// declare records a topology call
+func (f *FakeChannel) declare(d Declaration) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return errChannelClosed
+	}
+	f.declarations = append(f.declarations, d)
+	return nil
+}
+
+// ExchangeDeclare records the exchange declaration.
+func (f *FakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return f.declare(Declaration{Method: "ExchangeDeclare", Name: name, Kind: kind, Durable: durable,
+		AutoDelete: autoDelete, Internal: internal, NoWait: noWait, Args: args})
+}
+
+// ExchangeDelete records the exchange deletion.
+func (f *FakeChannel) ExchangeDelete(name string, ifUnused, noWait bool) error {
+	return f.declare(Declaration{Method: "ExchangeDelete", Name: name, IfUnused: ifUnused, NoWait: noWait})
+}
+
+// ExchangeBind records the exchange binding.
+func (f *FakeChannel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	return f.declare(Declaration{Method: "ExchangeBind", Name: destination, Key: key, Source: source,
+		NoWait: noWait, Args: args})
+}
+
+// ExchangeUnbind records the exchange unbinding.
+func (f *FakeChannel) ExchangeUnbind(destination, key, source string, noWait bool, args amqp.Table) error {
+	return f.declare(Declaration{Method: "ExchangeUnbind", Name: destination, Key: key, Source: source,
+		NoWait: noWait, Args: args})
+}
+
+// QueueDeclare records the queue declaration. A queue declared without
+// a name gets a generated one, as the broker does.
+func (f *FakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if name == "" {
+		f.lock.Lock()
+		f.queues++
+		name = fmt.Sprintf("amq.gen-fake-%d", f.queues)
+		f.lock.Unlock()
+	}
+	err := f.declare(Declaration{Method: "QueueDeclare", Name: name, Durable: durable,
+		AutoDelete: autoDelete, Exclusive: exclusive, NoWait: noWait, Args: args})
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	return amqp.Queue{Name: name}, nil
+}
+
+// QueueDelete records the queue deletion, no messages are purged.
+func (f *FakeChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	return 0, f.declare(Declaration{Method: "QueueDelete", Name: name, IfUnused: ifUnused,
+		IfEmpty: ifEmpty, NoWait: noWait})
+}
+
+// QueueBind records the queue binding.
+func (f *FakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return f.declare(Declaration{Method: "QueueBind", Name: name, Key: key, Source: exchange,
+		NoWait: noWait, Args: args})
+}
+
+// QueueUnbind records the queue unbinding.
+func (f *FakeChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	return f.declare(Declaration{Method: "QueueUnbind", Name: name, Key: key, Source: exchange, Args: args})
+}
+
+// fakeAcknowledger records the acknowledgements of the deliveries
+// consumed from a FakeChannel
+type fakeAcknowledger struct {
+	f *FakeChannel
+}
+
+func (a fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.f.acknowledge(Acknowledgement{DeliveryTag: tag, Kind: Acked, Ack: true, Multiple: multiple})
+	return nil
+}
+
+func (a fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.f.acknowledge(Acknowledgement{DeliveryTag: tag, Kind: Nacked, Multiple: multiple, Requeue: requeue})
+	return nil
+}
+
+func (a fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.f.acknowledge(Acknowledgement{DeliveryTag: tag, Kind: Rejected, Requeue: requeue})
+	return nil
+}
@@ -0,0 +1,160 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+func TestFakeChannelRecordsThePublishes(t *testing.T) {
+	// arrange
+	f := NewFakeChannel()
+	ctx := context.Background()
+
+	// act
+	first, err := f.PublishConfirmed(ctx, "orders", "created", true, false,
+		amqp.Publishing{Body: []byte("first")})
+	assert.NoError(t, err)
+	f.NackPublishes(true)
+	second, err := f.PublishConfirmed(ctx, "orders", "paid", false, false,
+		amqp.Publishing{Body: []byte("second")})
+	assert.NoError(t, err)
+	failure := errors.New("publish failed")
+	f.FailPublishes(failure)
+	failedErr := f.PublishWithContext(ctx, "orders", "paid", false, false, amqp.Publishing{})
+
+	// assert
+	assert.True(t, first.Wait())
+	assert.False(t, second.Wait())
+	assert.True(t, errors.Is(failedErr, failure))
+	published := f.Published()
+	assert.Equal(t, 2, len(published))
+	assert.Equal(t, "created", published[0].Key)
+	assert.True(t, published[0].Mandatory)
+	assert.Equal(t, "first", string(published[0].Msg.Body))
+	assert.Equal(t, "paid", published[1].Key)
+}
+
+func TestFakeChannelRecordsTheDeclarations(t *testing.T) {
+	// arrange
+	f := NewFakeChannel()
+
+	// act
+	assert.NoError(t, f.ExchangeDeclare("orders", "topic", true, false, false, false, nil))
+	q, err := f.QueueDeclare("", false, true, true, false, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, f.QueueBind(q.Name, "orders.*", "orders", false, nil))
+	_, err = f.QueueDelete(q.Name, false, false, false)
+	assert.NoError(t, err)
+
+	// assert
+	assert.Equal(t, "amq.gen-fake-1", q.Name)
+	declarations := f.Declarations()
+	assert.Equal(t, 4, len(declarations))
+	assert.Equal(t, "ExchangeDeclare", declarations[0].Method)
+	assert.Equal(t, "topic", declarations[0].Kind)
+	assert.True(t, declarations[0].Durable)
+	assert.Equal(t, "QueueDeclare", declarations[1].Method)
+	assert.True(t, declarations[1].Exclusive)
+	assert.Equal(t, "QueueBind", declarations[2].Method)
+	assert.Equal(t, q.Name, declarations[2].Name)
+	assert.Equal(t, "orders.*", declarations[2].Key)
+	assert.Equal(t, "orders", declarations[2].Source)
+	assert.Equal(t, "QueueDelete", declarations[3].Method)
+}
+
+func TestFakeChannelConsume(t *testing.T) {
+	// arrange
+	f := NewFakeChannel()
+	out := make(chan amqp.Delivery)
+	consumed := make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { consumed <- f.ConsumeContext(ctx, &ConsumeOpts{Queue: "orders"}, out) }()
+
+	// act
+	go f.Deliver(amqp.Delivery{Body: []byte("order")})
+	d := <-out
+	assert.NoError(t, d.Nack(false, true))
+	cancel()
+
+	// assert
+	assert.Equal(t, "order", string(d.Body))
+	assert.True(t, errors.Is(<-consumed, context.Canceled))
+	assert.Equal(t, []Acknowledgement{{DeliveryTag: 1, Kind: Nacked, Requeue: true}}, f.Acknowledgements())
+	assert.True(t, errors.Is(f.Deliver(amqp.Delivery{}), errChannelClosed))
+}
+
+var fakeHandlerData = map[string]struct {
+	handler  Handler
+	expected Acknowledgement
+}{
+	"ack": {
+		handler:  func(amqp.Delivery) Decision { return Ack },
+		expected: Acknowledgement{DeliveryTag: 1, Kind: Acked, Ack: true},
+	},
+	"nack": {
+		handler:  func(amqp.Delivery) Decision { return Nack(true) },
+		expected: Acknowledgement{DeliveryTag: 1, Kind: Nacked, Requeue: true},
+	},
+	"nack without requeue": {
+		handler:  func(amqp.Delivery) Decision { return Nack(false) },
+		expected: Acknowledgement{DeliveryTag: 1, Kind: Nacked},
+	},
+	"reject": {
+		handler:  func(amqp.Delivery) Decision { return Reject },
+		expected: Acknowledgement{DeliveryTag: 1, Kind: Rejected},
+	},
+	"retry": {
+		handler:  func(amqp.Delivery) Decision { return Retry(errRetryTest) },
+		expected: Acknowledgement{DeliveryTag: 1, Kind: Retried, Ack: true, Retry: errRetryTest},
+	},
+	"panic": {
+		handler:  func(amqp.Delivery) Decision { panic("boom") },
+		expected: Acknowledgement{DeliveryTag: 1, Kind: Nacked, Requeue: true},
+	},
+}
+
+var errRetryTest = errors.New("try again")
+
+func TestFakeChannelConsumeWithHandler(t *testing.T) {
+	for name, d := range fakeHandlerData {
+		t.Run(name, func(t *testing.T) {
+			// arrange
+			f := NewFakeChannel()
+			consumed := make(chan error)
+			go func() { consumed <- f.ConsumeWithHandlerContext(context.Background(), &ConsumeOpts{}, d.handler, 1) }()
+
+			// act
+			assert.NoError(t, f.Deliver(amqp.Delivery{}))
+			// the next delivery is only taken after the first is handled
+			assert.NoError(t, f.Deliver(amqp.Delivery{}))
+			assert.NoError(t, f.Close())
+
+			// assert
+			assert.NoError(t, <-consumed)
+			acks := f.Acknowledgements()
+			assert.True(t, len(acks) >= 1)
+			assert.Equal(t, d.expected.DeliveryTag, acks[0].DeliveryTag)
+			assert.Equal(t, d.expected.Kind, acks[0].Kind)
+			assert.Equal(t, d.expected.Ack, acks[0].Ack)
+			assert.Equal(t, d.expected.Requeue, acks[0].Requeue)
+			assert.True(t, errors.Is(acks[0].Retry, d.expected.Retry))
+		})
+	}
+}
+
+func TestFakeChannelCloseIsIdempotent(t *testing.T) {
+	// arrange
+	f := NewFakeChannel()
+
+	// act
+	first, second := f.Close(), f.Close()
+
+	// assert
+	assert.NoError(t, first)
+	assert.NoError(t, second)
+	assert.True(t, errors.Is(f.Deliver(amqp.Delivery{}), errChannelClosed))
+}
@@ -2,4 +2,16 @@ module github.com/xilapa/go-tiny-projects/strong-rabbit
 
 go 1.19
 
-require github.com/rabbitmq/amqp091-go v1.5.0
+require (
+	github.com/rabbitmq/amqp091-go v1.5.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	github.com/xilapa/go-tiny-projects/test-assertions v0.0.0-00010101000000-000000000000
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+)
+
+replace github.com/xilapa/go-tiny-projects/test-assertions => ../test-assertions
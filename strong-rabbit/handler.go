@@ -0,0 +1,160 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// decisionKind identifies what to do with a delivery after handling it
+type decisionKind int
+
+const (
+	ackDecision decisionKind = iota + 1
+	nackDecision
+	rejectDecision
+	retryDecision
+)
+
+// Decision is returned by a Handler to tell how the delivery
+// must be acknowledged.
+type Decision struct {
+	kind    decisionKind
+	requeue bool
+	err     error
+}
+
+var (
+	// Ack acknowledges the delivery, it's removed from the queue.
+	Ack = Decision{kind: ackDecision}
+	// Reject rejects the delivery without requeueing it, it's
+	// discarded or dead-lettered.
+	Reject = Decision{kind: rejectDecision}
+)
+
+// Nack negatively acknowledges the delivery. If requeue is true the
+// message goes back to the queue, otherwise it's discarded or dead-lettered.
+func Nack(requeue bool) Decision {
+	return Decision{kind: nackDecision, requeue: requeue}
+}
+
+// Retry sends the delivery to the retry queue declared with DeclareRetry,
+// it comes back to the queue after the retry delay. When the attempts run
+// out the delivery goes to the parking-lot queue, with the err message on
+// its headers.
+func Retry(err error) Decision {
+	return Decision{kind: retryDecision, err: err}
+}
+
+// Handler processes a delivery and decides how it must be acknowledged.
+type Handler func(d amqp.Delivery) Decision
+
+var (
+	errNilHandler     = errors.New("handler is nil")
+	errHandlerAutoAck = errors.New("handlers cannot consume with AutoAck")
+)
+
+// ConsumeWithHandler starts consuming messages from the channel, calling
+// the handler for each delivery and acknowledging it with the returned
+// Decision. The messages are handled by up to concurrency go routines,
+// the in-flight deliveries are capped by the prefetch count set with Qos.
+//
+// A handler panic is recovered and turned into a Nack, the message is
+// requeued once, if it was already redelivered it's not requeued again.
+//
+// It follows the same rules of Consume and blocks until the channel is
+// closed. Close waits for the running handlers to finish before closing
+// the underlying channel.
+func (ch *StrongChannel) ConsumeWithHandler(opts *ConsumeOpts, handler Handler, concurrency int) error {
+	return ch.ConsumeWithHandlerContext(context.Background(), opts, handler, concurrency)
+}
+
+// ConsumeWithHandlerContext behaves as ConsumeWithHandler, when the context
+// is done the channel is closed, after the running handlers finish, and
+// ctx.Err() is returned.
+func (ch *StrongChannel) ConsumeWithHandlerContext(ctx context.Context, opts *ConsumeOpts, handler Handler, concurrency int) error {
+	if handler == nil {
+		return errNilHandler
+	}
+	if opts != nil && opts.AutoAck {
+		return errHandlerAutoAck
+	}
+
+	workers := concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	// the broker doesn't deliver more than the prefetch count,
+	// the extra workers would stay idle
+	if ch.qos && ch.prefetchCount > 0 && ch.prefetchCount < workers {
+		workers = ch.prefetchCount
+	}
+
+	// register the workers while holding the lock, so Close
+	// waits for them
+	ch.lock.Lock()
+	if ch.isClosed() {
+		ch.lock.Unlock()
+		return errChannelClosed
+	}
+	deliveries := make(chan amqp.Delivery)
+	ch.handlers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer ch.handlers.Done()
+			for d := range deliveries {
+				ch.handle(d, handler)
+			}
+		}()
+	}
+	ch.lock.Unlock()
+
+	// the workers must stop before the channel closes
+	return ch.consumeContext(ctx, opts, deliveries, func() { close(deliveries) })
+}
+
+// handle calls the handler and acknowledges the delivery
+func (ch *StrongChannel) handle(d amqp.Delivery, handler Handler) {
+	decision, panicked := callHandler(d, handler)
+	if panicked != nil {
+		ch.logger().Error("handler panic", "channel", ch.Name,
+			"deliveryTag", d.DeliveryTag, "panic", panicked)
+	}
+
+	if err := applyDecision(d, decision, ch.retry); err != nil {
+		ch.logger().Warn("cannot acknowledge the delivery", "channel", ch.Name,
+			"deliveryTag", d.DeliveryTag, "error", err)
+	}
+}
+
+// callHandler calls the handler, turning panics into a Nack. It
+// returns the recovered value, nil if the handler didn't panic.
+func callHandler(d amqp.Delivery, handler Handler) (decision Decision, panicked interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			decision = Nack(!d.Redelivered)
+			panicked = r
+		}
+	}()
+	return handler(d), nil
+}
+
+// applyDecision acknowledges the delivery following the
+// decision, the retries are handed to the retry func
+func applyDecision(d amqp.Delivery, decision Decision, retry func(d amqp.Delivery, cause error) error) error {
+	switch decision.kind {
+	case ackDecision:
+		return d.Ack(false)
+	case nackDecision:
+		return d.Nack(false, decision.requeue)
+	case rejectDecision:
+		return d.Reject(false)
+	case retryDecision:
+		return retry(d, decision.err)
+	default:
+		d.Nack(false, !d.Redelivered)
+		return fmt.Errorf("invalid decision %d", decision.kind)
+	}
+}
@@ -0,0 +1,93 @@
+package strongrabbit
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+// acknowledgerRecorder records how a delivery was acknowledged
+type acknowledgerRecorder struct {
+	result string
+}
+
+func (a *acknowledgerRecorder) Ack(tag uint64, multiple bool) error {
+	a.result = "ack"
+	return nil
+}
+
+func (a *acknowledgerRecorder) Nack(tag uint64, multiple, requeue bool) error {
+	a.result = "nack"
+	if requeue {
+		a.result += " requeue"
+	}
+	return nil
+}
+
+func (a *acknowledgerRecorder) Reject(tag uint64, requeue bool) error {
+	a.result = "reject"
+	return nil
+}
+
+var handlerDecisionData = map[string]struct {
+	handler     Handler
+	redelivered bool
+	expected    string
+}{
+	"ack": {
+		handler:  func(amqp.Delivery) Decision { return Ack },
+		expected: "ack",
+	},
+	"nack with requeue": {
+		handler:  func(amqp.Delivery) Decision { return Nack(true) },
+		expected: "nack requeue",
+	},
+	"nack without requeue": {
+		handler:  func(amqp.Delivery) Decision { return Nack(false) },
+		expected: "nack",
+	},
+	"reject": {
+		handler:  func(amqp.Delivery) Decision { return Reject },
+		expected: "reject",
+	},
+	"panic is requeued once": {
+		handler:  func(amqp.Delivery) Decision { panic("boom") },
+		expected: "nack requeue",
+	},
+	"panic on redelivery is not requeued": {
+		handler:     func(amqp.Delivery) Decision { panic("boom") },
+		redelivered: true,
+		expected:    "nack",
+	},
+	"zero decision is a nack": {
+		handler:  func(amqp.Delivery) Decision { return Decision{} },
+		expected: "nack requeue",
+	},
+}
+
+func TestHandlerDecisions(t *testing.T) {
+	ch := &StrongChannel{Name: "test", cfg: options{events: EventOpts{Logger: discardLogger{}}}}
+	for name, data := range handlerDecisionData {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			// arrange
+			ack := &acknowledgerRecorder{}
+			d := amqp.Delivery{Acknowledger: ack, Redelivered: data.redelivered}
+
+			// act
+			ch.handle(d, data.handler)
+
+			// assert
+			assert.Equal(t, data.expected, ack.result)
+		})
+	}
+}
+
+// discardLogger drops all the logs
+type discardLogger struct{}
+
+func (discardLogger) Debug(msg string, args ...any) {}
+func (discardLogger) Info(msg string, args ...any)  {}
+func (discardLogger) Warn(msg string, args ...any)  {}
+func (discardLogger) Error(msg string, args ...any) {}
@@ -0,0 +1,70 @@
+package strongrabbit
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// healthReport is the body served by HealthHandler
+type healthReport struct {
+	Status      State              `json:"status"`
+	Connections []connectionHealth `json:"connections"`
+}
+
+type connectionHealth struct {
+	Group    string          `json:"group"`
+	Node     string          `json:"node"`
+	State    State           `json:"state"`
+	Channels []channelHealth `json:"channels"`
+}
+
+type channelHealth struct {
+	Name  string `json:"name"`
+	State State  `json:"state"`
+}
+
+// HealthHandler returns an http.Handler that reports, as JSON, the state
+// of all the pooled connections and of their channels, with the aggregate
+// status: the worst of them. It answers 200 when the status is Ready and
+// 503 otherwise. With no pooled connections, before the first one or after
+// Shutdown, the status is Closed, so it fits a readiness probe. The status tells a Recovering service from a Failed one, that
+// will not recover by itself.
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := health(Stats())
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// health builds the report of the connections stats
+func health(stats []ConnectionStats) healthReport {
+	report := healthReport{Status: Closed, Connections: []connectionHealth{}}
+	if len(stats) > 0 {
+		report.Status = Ready
+	}
+	for _, c := range stats {
+		conn := connectionHealth{Group: c.Group, Node: c.Node, State: c.State, Channels: []channelHealth{}}
+		report.Status = worst(report.Status, c.State)
+		for _, ch := range c.Channels {
+			conn.Channels = append(conn.Channels, channelHealth{Name: ch.Name, State: ch.State})
+			report.Status = worst(report.Status, ch.State)
+		}
+		report.Connections = append(report.Connections, conn)
+	}
+	return report
+}
+
+// stateSeverity orders the states from the healthiest
+var stateSeverity = map[State]int{Ready: 0, Recovering: 1, Closed: 2, Failed: 3}
+
+// worst returns the least healthy of the states
+func worst(a, b State) State {
+	if stateSeverity[b] > stateSeverity[a] {
+		return b
+	}
+	return a
+}
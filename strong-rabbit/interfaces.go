@@ -0,0 +1,50 @@
+package strongrabbit
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MessagePublisher publishes messages. It's satisfied by StrongChannel,
+// PublisherPool and FakeChannel, code that depends on it can be unit
+// tested without a broker.
+type MessagePublisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	PublishConfirmed(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*Confirmation, error)
+}
+
+// BatchPublisher publishes messages in batches, waiting for their
+// confirmations together. It's satisfied by StrongChannel and FakeChannel.
+type BatchPublisher interface {
+	PublishBatch(ctx context.Context, msgs []BatchMessage, opts BatchOpts) ([]BatchResult, error)
+}
+
+// MessageConsumer consumes messages. It's satisfied by StrongChannel
+// and FakeChannel.
+type MessageConsumer interface {
+	ConsumeContext(ctx context.Context, opts *ConsumeOpts, out chan amqp.Delivery) error
+	ConsumeWithHandlerContext(ctx context.Context, opts *ConsumeOpts, handler Handler, concurrency int) error
+}
+
+// TopologyDeclarer declares and deletes exchanges, queues and bindings.
+// It's satisfied by StrongChannel, FakeChannel and *amqp.Channel.
+type TopologyDeclarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDelete(name string, ifUnused, noWait bool) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	ExchangeUnbind(destination, key, source string, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+}
+
+var (
+	_ MessagePublisher = (*StrongChannel)(nil)
+	_ MessagePublisher = (*PublisherPool)(nil)
+	_ BatchPublisher   = (*StrongChannel)(nil)
+	_ MessageConsumer  = (*StrongChannel)(nil)
+	_ TopologyDeclarer = (*StrongChannel)(nil)
+	_ TopologyDeclarer = (*amqp.Channel)(nil)
+)
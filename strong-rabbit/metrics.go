@@ -0,0 +1,252 @@
+package strongrabbit
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the
+// histogram buckets used to measure the latencies.
+var LatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram is a snapshot of a latency histogram. Counts has the
+// amount of observations that fell on each of the Buckets, the ones
+// above the last bucket are only counted on Count.
+type Histogram struct {
+	Buckets []float64 // the upper bounds of the buckets, in seconds
+	Counts  []uint64  // the observations of each bucket, not cumulative
+	Count   uint64    // the total of observations
+	Sum     float64   // the sum of the observations, in seconds
+}
+
+// ChannelStats has the counters of a StrongChannel since it was opened.
+type ChannelStats struct {
+	Name           string
+	Group          string
+	State          State
+	Reconnects     uint64    // how many times the channel was recovered
+	Published      uint64    // messages sent to the broker, including the republished ones
+	Acks           uint64    // messages confirmed by the broker
+	Nacks          uint64    // messages rejected by the broker
+	Deliveries     uint64    // messages received by the consumer
+	Unacked        int       // deliveries received and not acknowledged yet, on the current underlying channel
+	PublishLatency Histogram // how long sending a message takes
+	ConfirmLatency Histogram // how long the broker takes to confirm a message, after it's sent
+}
+
+// ConnectionStats has the counters of a StrongConnection since
+// it was opened and the stats of its channels.
+type ConnectionStats struct {
+	Group      string
+	Node       string
+	State      State
+	Reconnects uint64 // how many times the connection was redialed
+	Blocked    bool   // if the broker is blocking the connection
+	Channels   []ChannelStats
+}
+
+// histogram counts latencies on the LatencyBuckets
+type histogram struct {
+	lock   sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe records a latency
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(LatencyBuckets))
+	}
+	for i, bound := range LatencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// snapshot returns a copy of the histogram
+func (h *histogram) snapshot() Histogram {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	counts := make([]uint64, len(LatencyBuckets))
+	copy(counts, h.counts)
+	return Histogram{Buckets: LatencyBuckets, Counts: counts, Count: h.count, Sum: h.sum}
+}
+
+// channelMetrics holds the counters of a StrongChannel
+type channelMetrics struct {
+	reconnects     atomic.Uint64
+	published      atomic.Uint64
+	acks           atomic.Uint64
+	nacks          atomic.Uint64
+	deliveries     atomic.Uint64
+	publishLatency histogram
+	confirmLatency histogram
+	unacked        atomic.Pointer[unackedDeliveries] // the deliveries of the current underlying channel
+}
+
+// confirmed counts a confirmation of a message sent at the given time
+func (m *channelMetrics) confirmed(ack bool, sentAt time.Time) {
+	if ack {
+		m.acks.Add(1)
+	} else {
+		m.nacks.Add(1)
+	}
+	m.confirmLatency.observe(time.Since(sentAt))
+}
+
+// unackedDeliveries tracks the delivery tags not acknowledged of an
+// underlying channel. When the channel closes they are requeued by
+// the broker, so a new set is used for each underlying channel.
+type unackedDeliveries struct {
+	lock sync.Mutex
+	ch   *amqp.Channel // the underlying channel the deliveries came from
+	tags map[uint64]struct{}
+}
+
+func newUnackedDeliveries(ch *amqp.Channel) *unackedDeliveries {
+	return &unackedDeliveries{ch: ch, tags: make(map[uint64]struct{})}
+}
+
+func (u *unackedDeliveries) add(tag uint64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.tags[tag] = struct{}{}
+}
+
+// remove drops the tag, or all the tags up to it if multiple is true
+func (u *unackedDeliveries) remove(tag uint64, multiple bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if !multiple {
+		delete(u.tags, tag)
+		return
+	}
+	for t := range u.tags {
+		if t <= tag {
+			delete(u.tags, t)
+		}
+	}
+}
+
+func (u *unackedDeliveries) len() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return len(u.tags)
+}
+
+// countingAcknowledger removes the deliveries from the
+// unacked ones when they are acknowledged
+type countingAcknowledger struct {
+	amqp.Acknowledger
+	unacked *unackedDeliveries
+}
+
+func (a *countingAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.unacked.remove(tag, multiple)
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *countingAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.unacked.remove(tag, multiple)
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *countingAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.unacked.remove(tag, false)
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// unackedOf returns the unacked deliveries of the underlying channel,
+// replacing the ones of the previous underlying channel
+func (ch *StrongChannel) unackedOf(amqpCh *amqp.Channel) *unackedDeliveries {
+	if u := ch.metrics.unacked.Load(); u != nil && u.ch == amqpCh {
+		return u
+	}
+	u := newUnackedDeliveries(amqpCh)
+	ch.metrics.unacked.Store(u)
+	return u
+}
+
+// delivered counts a delivery received from the given underlying channel,
+// wrapping its acknowledger to count the unacked deliveries
+func (ch *StrongChannel) delivered(msg amqp.Delivery, unacked *unackedDeliveries) amqp.Delivery {
+	ch.metrics.deliveries.Add(1)
+	if unacked == nil || msg.Acknowledger == nil {
+		return msg
+	}
+	unacked.add(msg.DeliveryTag)
+	msg.Acknowledger = &countingAcknowledger{Acknowledger: msg.Acknowledger, unacked: unacked}
+	return msg
+}
+
+// Stats returns the counters of the channel.
+func (ch *StrongChannel) Stats() ChannelStats {
+	m := &ch.metrics
+	stats := ChannelStats{
+		Name:           ch.Name,
+		State:          ch.State(),
+		Reconnects:     m.reconnects.Load(),
+		Published:      m.published.Load(),
+		Acks:           m.acks.Load(),
+		Nacks:          m.nacks.Load(),
+		Deliveries:     m.deliveries.Load(),
+		PublishLatency: m.publishLatency.snapshot(),
+		ConfirmLatency: m.confirmLatency.snapshot(),
+	}
+	if ch.conn != nil {
+		stats.Group = ch.conn.group
+	}
+	if unacked := m.unacked.Load(); unacked != nil {
+		stats.Unacked = unacked.len()
+	}
+	return stats
+}
+
+// Stats returns the counters of the connection and of its channels.
+func (cn *StrongConnection) Stats() ConnectionStats {
+	blocked, _ := cn.Blocked()
+	stats := ConnectionStats{
+		Group:      cn.group,
+		Node:       cn.Node(),
+		State:      cn.State(),
+		Reconnects: cn.reconnects.Load(),
+		Blocked:    blocked,
+	}
+	for _, ch := range cn.registeredChannels() {
+		stats.Channels = append(stats.Channels, ch.Stats())
+	}
+	sort.Slice(stats.Channels, func(i, j int) bool {
+		return stats.Channels[i].Name < stats.Channels[j].Name
+	})
+	return stats
+}
+
+// Stats returns the stats of all the connections on the pool,
+// including the failed ones not replaced yet.
+func Stats() []ConnectionStats {
+	connLock.Lock()
+	conns := make([]*StrongConnection, 0, len(connPool))
+	for _, conn := range connPool {
+		conns = append(conns, conn)
+	}
+	connLock.Unlock()
+
+	stats := make([]ConnectionStats, 0, len(conns))
+	for _, conn := range conns {
+		stats = append(stats, conn.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Group < stats[j].Group })
+	return stats
+}
@@ -0,0 +1,88 @@
+package strongrabbit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	// arrange
+	var h histogram
+
+	// act
+	h.observe(500 * time.Microsecond)
+	h.observe(3 * time.Millisecond)
+	h.observe(4 * time.Millisecond)
+	h.observe(time.Minute)
+
+	// assert
+	s := h.snapshot()
+	assert.Equal(t, uint64(4), s.Count)
+	assert.Equal(t, uint64(1), s.Counts[0])
+	assert.Equal(t, uint64(2), s.Counts[1])
+	assert.True(t, s.Sum > 60)
+}
+
+func TestUnackedDeliveriesAreCounted(t *testing.T) {
+	// arrange
+	ch := &StrongChannel{}
+	unacked := ch.unackedOf(nil)
+	var deliveries []amqp.Delivery
+	for tag := uint64(1); tag <= 4; tag++ {
+		d := amqp.Delivery{DeliveryTag: tag, Acknowledger: &acknowledgerRecorder{}}
+		deliveries = append(deliveries, ch.delivered(d, unacked))
+	}
+
+	// act
+	deliveries[3].Reject(false)
+	deliveries[1].Ack(true)
+
+	// assert
+	stats := ch.Stats()
+	assert.Equal(t, uint64(4), stats.Deliveries)
+	assert.Equal(t, 1, stats.Unacked)
+}
+
+func TestPrometheusTextFormat(t *testing.T) {
+	// arrange
+	stats := []ConnectionStats{{
+		Group:      "publish",
+		Node:       "rabbit-1:5672",
+		Reconnects: 2,
+		Channels: []ChannelStats{{
+			Name:           `orders "eu"`,
+			Group:          "publish",
+			Published:      10,
+			Acks:           9,
+			Nacks:          1,
+			PublishLatency: Histogram{Buckets: []float64{0.01, 0.1}, Counts: []uint64{3, 7}, Count: 10, Sum: 0.5},
+			ConfirmLatency: Histogram{Buckets: []float64{0.01, 0.1}, Counts: []uint64{0, 0}},
+		}},
+	}}
+	var buf bytes.Buffer
+
+	// act
+	err := writeMetrics(&buf, stats)
+
+	// assert
+	assert.NoError(t, err)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE strongrabbit_connection_reconnects_total counter",
+		`strongrabbit_connection_reconnects_total{group="publish",node="rabbit-1:5672"} 2`,
+		`strongrabbit_connection_blocked{group="publish",node="rabbit-1:5672"} 0`,
+		`strongrabbit_confirms_total{group="publish",channel="orders \"eu\"",result="nack"} 1`,
+		`strongrabbit_publish_duration_seconds_bucket{group="publish",channel="orders \"eu\"",le="0.01"} 3`,
+		`strongrabbit_publish_duration_seconds_bucket{group="publish",channel="orders \"eu\"",le="0.1"} 10`,
+		`strongrabbit_publish_duration_seconds_bucket{group="publish",channel="orders \"eu\"",le="+Inf"} 10`,
+		`strongrabbit_publish_duration_seconds_sum{group="publish",channel="orders \"eu\""} 0.5`,
+		`strongrabbit_publish_duration_seconds_count{group="publish",channel="orders \"eu\""} 10`,
+	} {
+		assert.True(t, strings.Contains(out, line+"\n"), "missing line: "+line)
+	}
+}
@@ -0,0 +1,72 @@
+package strongrabbit
+
+import (
+	"errors"
+	"net"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Option configures a StrongConnection or a StrongChannel.
+// Options given to Connect are inherited by the channels opened on the
+// connection, options given to Channel override them for that channel.
+type Option func(*options)
+
+// options holds the configuration set by the Option functions
+type options struct {
+	reconnectPolicy ReconnectPolicy
+	publishBuffer   BufferOpts
+	events          EventOpts
+	endpointPolicy  EndpointPolicy
+	dialConfig      amqp.Config
+	dialer          func(network, addr string) (net.Conn, error)
+	blockedPolicy   BlockedPolicy
+	returnHandler   ReturnHandler
+}
+
+func defaultOptions() options {
+	return options{
+		reconnectPolicy: DefaultReconnectPolicy,
+		endpointPolicy:  DefaultEndpointPolicy,
+	}
+}
+
+// apply returns a copy of the options with the given Option functions applied
+func (o options) apply(opts ...Option) options {
+	for i := range opts {
+		opts[i](&o)
+	}
+	return o
+}
+
+// WithReconnectPolicy sets the delays and the max attempts used
+// when reconnecting.
+func WithReconnectPolicy(p ReconnectPolicy) Option {
+	return func(o *options) {
+		o.reconnectPolicy = p
+	}
+}
+
+// BlockedPolicy defines what a publish does while the broker
+// is blocking the connection.
+type BlockedPolicy int
+
+const (
+	// WaitWhileBlocked makes the publishes wait for the connection to be
+	// unblocked, until their context is done.
+	WaitWhileBlocked BlockedPolicy = iota
+	// FailWhileBlocked makes the publishes fail right away with ErrBlocked.
+	FailWhileBlocked
+)
+
+// ErrBlocked is returned when publishing while the broker is blocking
+// the connection, if the FailWhileBlocked policy is set.
+var ErrBlocked = errors.New("connection blocked by the broker")
+
+// WithBlockedPolicy sets what the publishes do while the broker is
+// blocking the connection, by default they wait.
+func WithBlockedPolicy(p BlockedPolicy) Option {
+	return func(o *options) {
+		o.blockedPolicy = p
+	}
+}
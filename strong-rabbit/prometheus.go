@@ -0,0 +1,170 @@
+package strongrabbit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MetricsHandler returns an http.Handler that serves the stats of all the
+// pooled connections and their channels on the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, Stats())
+	})
+}
+
+// metricFamily writes all the series of a metric together,
+// as required by the text format
+type metricFamily struct {
+	name, help, kind string
+	connection       func(w *metricWriter, name string, c ConnectionStats)
+	channel          func(w *metricWriter, name string, ch ChannelStats)
+}
+
+var metricFamilies = []metricFamily{
+	{
+		name: "strongrabbit_connection_reconnects_total", kind: "counter",
+		help: "Times the connection was redialed.",
+		connection: func(w *metricWriter, name string, c ConnectionStats) {
+			w.sample(name, connectionLabels(c), float64(c.Reconnects))
+		},
+	},
+	{
+		name: "strongrabbit_connection_blocked", kind: "gauge",
+		help: "Whether the broker is blocking the connection.",
+		connection: func(w *metricWriter, name string, c ConnectionStats) {
+			blocked := 0.0
+			if c.Blocked {
+				blocked = 1
+			}
+			w.sample(name, connectionLabels(c), blocked)
+		},
+	},
+	{
+		name: "strongrabbit_channel_reconnects_total", kind: "counter",
+		help: "Times the channel was recovered.",
+		channel: func(w *metricWriter, name string, ch ChannelStats) {
+			w.sample(name, channelLabels(ch), float64(ch.Reconnects))
+		},
+	},
+	{
+		name: "strongrabbit_published_total", kind: "counter",
+		help: "Messages sent to the broker.",
+		channel: func(w *metricWriter, name string, ch ChannelStats) {
+			w.sample(name, channelLabels(ch), float64(ch.Published))
+		},
+	},
+	{
+		name: "strongrabbit_confirms_total", kind: "counter",
+		help: "Publisher confirmations received, by result.",
+		channel: func(w *metricWriter, name string, ch ChannelStats) {
+			w.sample(name, append(channelLabels(ch), "result", "ack"), float64(ch.Acks))
+			w.sample(name, append(channelLabels(ch), "result", "nack"), float64(ch.Nacks))
+		},
+	},
+	{
+		name: "strongrabbit_deliveries_total", kind: "counter",
+		help: "Messages received by the consumer.",
+		channel: func(w *metricWriter, name string, ch ChannelStats) {
+			w.sample(name, channelLabels(ch), float64(ch.Deliveries))
+		},
+	},
+	{
+		name: "strongrabbit_unacked_deliveries", kind: "gauge",
+		help: "Deliveries received and not acknowledged yet.",
+		channel: func(w *metricWriter, name string, ch ChannelStats) {
+			w.sample(name, channelLabels(ch), float64(ch.Unacked))
+		},
+	},
+	{
+		name: "strongrabbit_publish_duration_seconds", kind: "histogram",
+		help: "Time spent sending a message.",
+		channel: func(w *metricWriter, name string, ch ChannelStats) {
+			w.histogram(name, channelLabels(ch), ch.PublishLatency)
+		},
+	},
+	{
+		name: "strongrabbit_confirm_duration_seconds", kind: "histogram",
+		help: "Time between sending a message and its confirmation.",
+		channel: func(w *metricWriter, name string, ch ChannelStats) {
+			w.histogram(name, channelLabels(ch), ch.ConfirmLatency)
+		},
+	},
+}
+
+func connectionLabels(c ConnectionStats) []string {
+	return []string{"group", c.Group, "node", c.Node}
+}
+
+func channelLabels(ch ChannelStats) []string {
+	return []string{"group", ch.Group, "channel", ch.Name}
+}
+
+// writeMetrics writes the stats on the Prometheus text format
+func writeMetrics(out io.Writer, stats []ConnectionStats) error {
+	w := &metricWriter{w: bufio.NewWriter(out)}
+	for _, f := range metricFamilies {
+		fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, c := range stats {
+			if f.connection != nil {
+				f.connection(w, f.name, c)
+			}
+			if f.channel == nil {
+				continue
+			}
+			for _, ch := range c.Channels {
+				f.channel(w, f.name, ch)
+			}
+		}
+	}
+	return w.w.Flush()
+}
+
+// metricWriter writes the samples of the metrics
+type metricWriter struct {
+	w *bufio.Writer
+}
+
+// sample writes a line with the metric name, the labels,
+// given as key-value pairs, and the value
+func (w *metricWriter) sample(name string, labels []string, value float64) {
+	w.w.WriteString(name)
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			fmt.Fprintf(w.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteByte(' ')
+	w.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.w.WriteByte('\n')
+}
+
+// histogram writes the cumulative buckets, the sum and the count
+func (w *metricWriter) histogram(name string, labels []string, h Histogram) {
+	var cumulative uint64
+	for i, bound := range h.Buckets {
+		cumulative += h.Counts[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", le), float64(cumulative))
+	}
+	w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.Count))
+	w.sample(name+"_sum", labels, h.Sum)
+	w.sample(name+"_count", labels, float64(h.Count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value as required by the text format
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
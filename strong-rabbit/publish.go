@@ -0,0 +1,504 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrBufferFull is returned when publishing to a disconnected
+	// channel and there is no room left on the publish buffer.
+	ErrBufferFull = errors.New("publish buffer is full")
+)
+
+const (
+	// RepublishedHeader is set on the messages sent again after a
+	// reconnection because their confirmation never arrived.
+	RepublishedHeader = "x-republished"
+	// ReturnIDHeader is set on the mandatory and immediate messages, it
+	// matches the messages returned by the broker with their Confirmation.
+	ReturnIDHeader = "x-return-id"
+)
+
+// publishing holds the arguments of a publish to make it possible to
+// send it later, after a reconnection.
+type publishing struct {
+	exchange     string
+	key          string
+	mandatory    bool
+	immediate    bool
+	msg          amqp.Publishing
+	confirmation *Confirmation
+	sentAt       time.Time // when the message was last sent, to measure the confirmation
+}
+
+// confirmTracker matches the broker confirmations of an underlying
+// channel with the messages published on it, by their delivery tag.
+type confirmTracker struct {
+	lock        sync.Mutex
+	pending     map[uint64]*publishing
+	returns     map[string]*publishing // the pending messages that can be returned, by their ReturnIDHeader
+	done        chan struct{}          // closed when the underlying channel closes
+	unconfirmed []*publishing          // messages left without confirmation, in publishing order
+	stopped     bool                   // set when the tracking is done with the messages left without confirmation
+	discardErr  error                  // set when the channel will not reconnect before the tracking stops
+}
+
+// publisher holds the publishing state of a StrongChannel
+type publisher struct {
+	lock      sync.Mutex      // serializes the publishes, keeping delivery tags in order
+	tracker   *confirmTracker // tracks the confirmations of the current underlying channel
+	republish []*publishing   // messages not confirmed before a reconnection, sent before the buffer
+	buffer    *publishBuffer  // keeps the messages published while disconnected, nil if not enabled
+	returnSeq atomic.Uint64   // the last ReturnIDHeader set
+}
+
+// trackConfirms starts listening to the confirmations and to the returns
+// of the underlying channel, it must be called with the publisher lock held
+func (ch *StrongChannel) trackConfirms(amqpCh *amqp.Channel) {
+	t := &confirmTracker{
+		pending: make(map[uint64]*publishing),
+		returns: make(map[string]*publishing),
+		done:    make(chan struct{}),
+	}
+	confirms := amqpCh.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := amqpCh.NotifyReturn(make(chan amqp.Return, 1))
+	ch.pub.tracker = t
+
+	go func() {
+		defer close(t.done)
+		for confirms != nil || returns != nil {
+			select {
+			case r, ok := <-returns:
+				if !ok {
+					returns = nil
+					continue
+				}
+				ch.returned(t, r)
+			case c, ok := <-confirms:
+				if !ok {
+					confirms = nil
+					continue
+				}
+				// the broker sends the return of a message before its
+				// confirmation, the returns already received go first
+				for drained := false; !drained && returns != nil; {
+					select {
+					case r, ok := <-returns:
+						if !ok {
+							returns = nil
+							continue
+						}
+						ch.returned(t, r)
+					default:
+						drained = true
+					}
+				}
+				ch.confirmed(t, c)
+			}
+		}
+
+		// the underlying channel was closed, sort the messages without
+		// confirmation by their delivery tag to republish them in order
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		tags := make([]uint64, 0, len(t.pending))
+		for tag := range t.pending {
+			tags = append(tags, tag)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+		// if the channel will not reconnect, there is no one to republish
+		err := ch.Err()
+		if ch.isClosed() {
+			err = errChannelClosed
+		}
+		if err == nil {
+			err = t.discardErr
+		}
+		for _, tag := range tags {
+			if err != nil {
+				t.pending[tag].confirmation.resolve(false, err)
+				continue
+			}
+			t.unconfirmed = append(t.unconfirmed, t.pending[tag])
+		}
+		t.pending = nil
+		t.returns = nil
+		t.stopped = true
+	}()
+}
+
+// discard makes the tracking resolve the messages left without
+// confirmation with the error. It returns false if the tracking
+// already stopped, leaving them to be collected.
+func (t *confirmTracker) discard(err error) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.discardErr = err
+	return true
+}
+
+// confirmed resolves the Confirmation of the confirmed message
+func (ch *StrongChannel) confirmed(t *confirmTracker, c amqp.Confirmation) {
+	t.lock.Lock()
+	p, ok := t.pending[c.DeliveryTag]
+	delete(t.pending, c.DeliveryTag)
+	if ok {
+		delete(t.returns, returnID(p.msg))
+	}
+	t.lock.Unlock()
+	if ok {
+		ch.metrics.confirmed(c.Ack, p.sentAt)
+		p.confirmation.resolve(c.Ack, nil)
+	}
+}
+
+// returned marks the Confirmation of the message returned by the broker,
+// if it's waiting for the confirmation, and calls the ReturnHandler
+func (ch *StrongChannel) returned(t *confirmTracker, r amqp.Return) {
+	if id, ok := r.Headers[ReturnIDHeader].(string); ok {
+		t.lock.Lock()
+		p, found := t.returns[id]
+		t.lock.Unlock()
+		if found {
+			p.confirmation.markReturned(r)
+		}
+	}
+
+	if handler := ch.cfg.returnHandler; handler != nil {
+		handler(r)
+		return
+	}
+	ch.logger().Warn("message returned by the broker", "channel", ch.Name, "exchange", r.Exchange,
+		"key", r.RoutingKey, "code", r.ReplyCode, "reason", r.ReplyText)
+}
+
+// returnID returns the ReturnIDHeader of the message, empty if not set
+func returnID(msg amqp.Publishing) string {
+	id, _ := msg.Headers[ReturnIDHeader].(string)
+	return id
+}
+
+// collectUnconfirmed moves the messages not confirmed on the previous
+// underlying channel to the republish queue, marking them as republished.
+// It waits for the previous channel tracking to stop, so the underlying
+// channel must be closed. It must be called with the publisher lock held.
+func (ch *StrongChannel) collectUnconfirmed() {
+	t := ch.pub.tracker
+	if t == nil {
+		return
+	}
+
+	<-t.done
+	for _, p := range t.unconfirmed {
+		p.msg.Headers = republishedHeaders(p.msg.Headers)
+		p.confirmation.clearReturned()
+	}
+	ch.pub.republish = append(t.unconfirmed, ch.pub.republish...)
+	ch.pub.tracker = nil
+}
+
+// republishedHeaders returns a copy of the headers with the republished
+// header set, the original headers are not changed as they belong
+// to the caller
+func republishedHeaders(headers amqp.Table) amqp.Table {
+	return withHeader(headers, RepublishedHeader, true)
+}
+
+// withHeader returns a copy of the headers with the header set
+func withHeader(headers amqp.Table, key string, value interface{}) amqp.Table {
+	h := make(amqp.Table, len(headers)+1)
+	for k, v := range headers {
+		h[k] = v
+	}
+	h[key] = value
+	return h
+}
+
+// PublishConfirmed publishes a message and returns a Confirmation
+// that resolves when the broker confirms it. If the channel
+// is not in confirm mode, the Confirmation is resolved right after the
+// message is sent.
+//
+// If the channel has a publish buffer, messages published while the channel
+// is disconnected are buffered and sent, in order, after the reconnection.
+// Without a buffer, publishing on a disconnected channel returns an error.
+//
+// On confirm mode, the messages left without confirmation when the channel
+// drops are republished after the reconnection, with the RepublishedHeader
+// set, and the same Confirmation resolves with the new result. The delivery
+// is at-least-once, consumers may receive the message twice.
+//
+// While the broker is blocking the connection, the publish waits for it
+// to be unblocked or fails with ErrBlocked, following the BlockedPolicy.
+//
+// Mandatory and immediate messages get the ReturnIDHeader. On confirm mode,
+// when the broker returns one of them the Confirmation reports it on
+// Returned, the broker still acks the message.
+//
+// The context is used only to send the message, to wait for the
+// confirmation with a timeout use Confirmation.WaitContext.
+func (ch *StrongChannel) PublishConfirmed(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*Confirmation, error) {
+	if ctx == nil {
+		return nil, errors.New("nil Context")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// the broker doesn't read the messages while blocking the connection
+	if err := ch.conn.waitUnblocked(ctx, ch.cfg.blockedPolicy); err != nil {
+		return nil, err
+	}
+
+	p := &publishing{
+		exchange:     exchange,
+		key:          key,
+		mandatory:    mandatory,
+		immediate:    immediate,
+		msg:          msg,
+		confirmation: newConfirmation(),
+	}
+	if mandatory || immediate {
+		id := strconv.FormatUint(ch.pub.returnSeq.Add(1), 10)
+		p.msg.Headers = withHeader(msg.Headers, ReturnIDHeader, id)
+	}
+
+	ch.pub.lock.Lock()
+	defer ch.pub.lock.Unlock()
+
+	if ch.isClosed() {
+		return nil, errChannelClosed
+	}
+	if err := ch.Err(); err != nil {
+		return nil, err
+	}
+
+	buffer := ch.pub.buffer
+	// keep the order, if there are buffered messages
+	// the new ones go to the end of the buffer
+	if buffer != nil && (buffer.len() > 0 || !ch.isOpen()) {
+		if err := buffer.push(p); err != nil {
+			return nil, err
+		}
+		return p.confirmation, nil
+	}
+
+	amqpCh, _ := ch.current()
+	err := ch.send(ctx, amqpCh, p)
+	if err == nil {
+		return p.confirmation, nil
+	}
+
+	// the channel dropped before being noticed, buffer the message
+	if buffer != nil && errors.Is(err, amqp.ErrClosed) {
+		if err := buffer.push(p); err != nil {
+			return nil, err
+		}
+		return p.confirmation, nil
+	}
+	return nil, err
+}
+
+// PublishWithContext publishes a message, without waiting for the
+// confirmation. It follows the same rules of PublishConfirmed.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.PublishWithContext
+func (ch *StrongChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	_, err := ch.PublishConfirmed(ctx, exchange, key, mandatory, immediate, msg)
+	return err
+}
+
+// PublishWithDeferredConfirmWithContext keeps the signature of the amqp
+// method, the message goes to the current underlying channel. It follows
+// the blocked policy and is counted on the stats, as PublishConfirmed, but
+// it's not buffered while disconnected, republished after a reconnection
+// or matched with its return, use PublishConfirmed for that.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.PublishWithDeferredConfirmWithContext
+func (ch *StrongChannel) PublishWithDeferredConfirmWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*amqp.DeferredConfirmation, error) {
+	if ctx == nil {
+		return nil, errors.New("nil Context")
+	}
+	// the broker doesn't read the messages while blocking the connection
+	if err := ch.conn.waitUnblocked(ctx, ch.cfg.blockedPolicy); err != nil {
+		return nil, err
+	}
+
+	// hold the publisher lock to keep the delivery tags in order
+	ch.pub.lock.Lock()
+	defer ch.pub.lock.Unlock()
+
+	if ch.isClosed() {
+		return nil, errChannelClosed
+	}
+	if err := ch.Err(); err != nil {
+		return nil, err
+	}
+	amqpCh, _ := ch.current()
+	if amqpCh == nil || amqpCh.IsClosed() {
+		return nil, amqp.ErrClosed
+	}
+
+	sentAt := time.Now()
+	confirmation, err := amqpCh.PublishWithDeferredConfirmWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return nil, err
+	}
+	ch.measurePublish(sentAt)
+	return confirmation, nil
+}
+
+// PublishWithDeferredConfirm behaves as PublishWithDeferredConfirmWithContext
+// with a background context.
+//
+// Deprecated: Use PublishWithDeferredConfirmWithContext instead.
+func (ch *StrongChannel) PublishWithDeferredConfirm(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*amqp.DeferredConfirmation, error) {
+	return ch.PublishWithDeferredConfirmWithContext(context.Background(), exchange, key, mandatory, immediate, msg)
+}
+
+// Publish behaves as PublishWithContext with a background context.
+//
+// Deprecated: Use PublishWithContext instead.
+func (ch *StrongChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return ch.PublishWithContext(context.Background(), exchange, key, mandatory, immediate, msg)
+}
+
+// send publishes the message on the underlying channel, tracking its
+// confirmation. It must be called with the publisher lock held.
+func (ch *StrongChannel) send(ctx context.Context, amqpCh *amqp.Channel, p *publishing) error {
+	if amqpCh == nil || amqpCh.IsClosed() {
+		return amqp.ErrClosed
+	}
+
+	t := ch.pub.tracker
+	if !ch.confirm || t == nil {
+		if err := ch.publish(ctx, amqpCh, p); err != nil {
+			return err
+		}
+		p.confirmation.resolve(true, nil)
+		return nil
+	}
+
+	// register the message before publishing,
+	// the confirmation can arrive at any time
+	tag := amqpCh.GetNextPublishSeqNo()
+	id := returnID(p.msg)
+	t.lock.Lock()
+	t.pending[tag] = p
+	if id != "" {
+		t.returns[id] = p
+	}
+	t.lock.Unlock()
+
+	if err := ch.publish(ctx, amqpCh, p); err != nil {
+		t.lock.Lock()
+		delete(t.pending, tag)
+		delete(t.returns, id)
+		t.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// publish sends the message on the underlying channel, measuring it
+func (ch *StrongChannel) publish(ctx context.Context, amqpCh *amqp.Channel, p *publishing) error {
+	p.sentAt = time.Now()
+	err := amqpCh.PublishWithContext(ctx, p.exchange, p.key, p.mandatory, p.immediate, p.msg)
+	if err != nil {
+		return err
+	}
+	ch.measurePublish(p.sentAt)
+	return nil
+}
+
+// measurePublish counts a message sent at sentAt on the stats
+func (ch *StrongChannel) measurePublish(sentAt time.Time) {
+	ch.metrics.published.Add(1)
+	ch.metrics.publishLatency.observe(time.Since(sentAt))
+}
+
+// flush sends the messages not confirmed before the reconnection and
+// then the buffered ones, in order, on the underlying channel. It stops
+// on the first error, keeping the messages not sent to the next flush.
+func (ch *StrongChannel) flush() {
+	ch.pub.lock.Lock()
+	defer ch.pub.lock.Unlock()
+
+	amqpCh, _ := ch.current()
+	republished := 0
+	for len(ch.pub.republish) > 0 {
+		if err := ch.send(context.Background(), amqpCh, ch.pub.republish[0]); err != nil {
+			ch.logger().Warn("cannot republish unconfirmed messages", "channel", ch.Name, "error", err)
+			return
+		}
+		ch.pub.republish[0] = nil
+		ch.pub.republish = ch.pub.republish[1:]
+		republished++
+	}
+	if republished > 0 {
+		ch.logger().Info("unconfirmed messages republished", "channel", ch.Name, "count", republished)
+	}
+
+	buffer := ch.pub.buffer
+	if buffer == nil || buffer.len() == 0 {
+		return
+	}
+
+	flushed := 0
+	for buffer.len() > 0 {
+		p, err := buffer.peek()
+		if err != nil {
+			// the message cannot be read from the spill file
+			ch.dropBuffered(buffer)
+			continue
+		}
+		if err = ch.send(context.Background(), amqpCh, p); err != nil {
+			ch.logger().Warn("cannot flush the publish buffer", "channel", ch.Name, "error", err)
+			break
+		}
+		ch.dropBuffered(buffer)
+		flushed++
+	}
+	ch.logger().Info("buffered messages published", "channel", ch.Name, "count", flushed)
+}
+
+// dropBuffered removes the first buffered message, logging when
+// the spill file stops being used
+func (ch *StrongChannel) dropBuffered(buffer *publishBuffer) {
+	if err := buffer.drop(); err != nil {
+		ch.logger().Error("cannot truncate the spill file, it'll not be used anymore", "channel", ch.Name, "error", err)
+	}
+}
+
+// discardPending resolves the messages waiting to be republished and
+// the buffered ones with the given error, releasing the buffer resources.
+// It's used when the channel will not reconnect anymore.
+func (ch *StrongChannel) discardPending(err error) {
+	ch.pub.lock.Lock()
+	defer ch.pub.lock.Unlock()
+
+	// the tracking resolves the messages by itself if it didn't stop
+	// yet, otherwise they are collected to be resolved below
+	if t := ch.pub.tracker; t != nil && !t.discard(err) {
+		ch.collectUnconfirmed()
+	}
+	for _, p := range ch.pub.republish {
+		p.confirmation.resolve(false, err)
+	}
+	ch.pub.republish = nil
+
+	if ch.pub.buffer != nil {
+		ch.pub.buffer.discard(err)
+	}
+}
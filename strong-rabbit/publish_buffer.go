@@ -0,0 +1,240 @@
+package strongrabbit
+
+import (
+	"encoding/gob"
+	"io"
+	"os"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// BufferOpts is a struct that encapsulates the options of the buffer used
+// to keep the messages published while a Publisher channel is disconnected.
+//
+// Size is how many messages are kept in memory. When the memory is full the
+// messages are written to the SpillFile, if one is set, otherwise publishing
+// returns ErrBufferFull. The spill file is truncated when the channel is
+// opened and removed when the channel is closed, so each channel must use
+// its own file.
+type BufferOpts struct {
+	Size      int
+	SpillFile string
+}
+
+// WithPublishBuffer enables buffering on Publisher channels, messages
+// published while the channel is disconnected are sent after the
+// reconnection. It should be given to Channel, as the spill file
+// cannot be shared between channels.
+func WithPublishBuffer(opts BufferOpts) Option {
+	return func(o *options) {
+		o.publishBuffer = opts
+	}
+}
+
+func init() {
+	// types that can be found on the headers of a spilled message
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(amqp.Decimal{})
+	gob.Register(time.Time{})
+}
+
+// publishBuffer is a FIFO of the messages published while the channel
+// is disconnected. The messages that don't fit in memory go to the
+// spill file, keeping the publishing order.
+type publishBuffer struct {
+	size  int
+	mem   []*publishing
+	spill *spillFile
+}
+
+// spilledPublishing is the representation of a publishing on the spill file
+type spilledPublishing struct {
+	Exchange  string
+	Key       string
+	Mandatory bool
+	Immediate bool
+	Msg       amqp.Publishing
+}
+
+// spillFile stores the messages on disk, only their confirmations
+// are kept in memory
+type spillFile struct {
+	path          string
+	w             *os.File
+	enc           *gob.Encoder
+	r             *os.File
+	dec           *gob.Decoder
+	confirmations []*Confirmation // the confirmations of the spilled messages, in order
+	head          *publishing     // the next message, already read from the file
+}
+
+func newPublishBuffer(opts BufferOpts) (*publishBuffer, error) {
+	b := &publishBuffer{size: opts.Size}
+	if opts.SpillFile == "" {
+		return b, nil
+	}
+
+	spill := &spillFile{path: opts.SpillFile}
+	if err := spill.reset(); err != nil {
+		return nil, err
+	}
+	b.spill = spill
+	return b, nil
+}
+
+// len returns how many messages are buffered
+func (b *publishBuffer) len() int {
+	l := len(b.mem)
+	if b.spill != nil {
+		l += len(b.spill.confirmations)
+	}
+	return l
+}
+
+// push adds a message to the end of the buffer
+func (b *publishBuffer) push(p *publishing) error {
+	spilling := b.spill != nil && len(b.spill.confirmations) > 0
+	if !spilling && len(b.mem) < b.size {
+		b.mem = append(b.mem, p)
+		return nil
+	}
+	if b.spill == nil {
+		return ErrBufferFull
+	}
+	return b.spill.push(p)
+}
+
+// peek returns the first message of the buffer without removing it.
+// If it cannot be read from the spill file, its confirmation is
+// resolved with the error, and it must be dropped.
+func (b *publishBuffer) peek() (*publishing, error) {
+	if len(b.mem) > 0 {
+		return b.mem[0], nil
+	}
+	return b.spill.peek()
+}
+
+// drop removes the first message of the buffer. If the spill file
+// cannot be truncated it's removed and not used anymore, the pushes
+// that don't fit in memory return ErrBufferFull.
+func (b *publishBuffer) drop() error {
+	if len(b.mem) > 0 {
+		b.mem[0] = nil
+		b.mem = b.mem[1:]
+		return nil
+	}
+	if err := b.spill.drop(); err != nil {
+		b.spill.close()
+		os.Remove(b.spill.path)
+		b.spill = nil
+		return err
+	}
+	return nil
+}
+
+// discard resolves all the buffered messages with
+// the given error and removes the spill file
+func (b *publishBuffer) discard(err error) {
+	for _, p := range b.mem {
+		p.confirmation.resolve(false, err)
+	}
+	b.mem = nil
+	if b.spill == nil {
+		return
+	}
+	for _, c := range b.spill.confirmations {
+		c.resolve(false, err)
+	}
+	b.spill.confirmations = nil
+	b.spill.close()
+	os.Remove(b.spill.path)
+	b.spill = nil
+}
+
+// reset truncates the spill file and recreates the encoder and decoder
+func (s *spillFile) reset() error {
+	s.close()
+	s.enc, s.dec = nil, nil
+	w, err := os.OpenFile(s.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	r, err := os.Open(s.path)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	s.w, s.enc = w, gob.NewEncoder(w)
+	s.r, s.dec = r, gob.NewDecoder(r)
+	s.head = nil
+	return nil
+}
+
+// close releases the spill file handles
+func (s *spillFile) close() {
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+}
+
+// push writes a message to the end of the file
+func (s *spillFile) push(p *publishing) error {
+	err := s.enc.Encode(spilledPublishing{
+		Exchange:  p.exchange,
+		Key:       p.key,
+		Mandatory: p.mandatory,
+		Immediate: p.immediate,
+		Msg:       p.msg,
+	})
+	if err != nil {
+		return err
+	}
+	s.confirmations = append(s.confirmations, p.confirmation)
+	return nil
+}
+
+// peek reads the next message from the file
+func (s *spillFile) peek() (*publishing, error) {
+	if s.head != nil {
+		return s.head, nil
+	}
+
+	var sp spilledPublishing
+	if err := s.dec.Decode(&sp); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		s.confirmations[0].resolve(false, err)
+		return nil, err
+	}
+
+	s.head = &publishing{
+		exchange:     sp.Exchange,
+		key:          sp.Key,
+		mandatory:    sp.Mandatory,
+		immediate:    sp.Immediate,
+		msg:          sp.Msg,
+		confirmation: s.confirmations[0],
+	}
+	return s.head, nil
+}
+
+// drop removes the first message, when the file is
+// fully read, it's truncated
+func (s *spillFile) drop() error {
+	s.head = nil
+	s.confirmations[0] = nil
+	s.confirmations = s.confirmations[1:]
+	if len(s.confirmations) == 0 {
+		s.confirmations = nil
+		return s.reset()
+	}
+	return nil
+}
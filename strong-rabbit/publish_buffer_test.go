@@ -0,0 +1,127 @@
+package strongrabbit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+func newTestPublishing(i int) *publishing {
+	return &publishing{
+		exchange:     "orders",
+		key:          fmt.Sprintf("key-%d", i),
+		msg:          amqp.Publishing{Body: []byte(fmt.Sprintf("%d", i)), Headers: amqp.Table{"attempt": int32(i)}},
+		confirmation: newConfirmation(),
+	}
+}
+
+// drain reads all the buffered messages, in order
+func drain(t *testing.T, b *publishBuffer) []string {
+	var bodies []string
+	for b.len() > 0 {
+		p, err := b.peek()
+		assert.NoError(t, err)
+		bodies = append(bodies, string(p.msg.Body))
+		assert.NoError(t, b.drop())
+	}
+	return bodies
+}
+
+func TestPublishBufferIsBounded(t *testing.T) {
+	// arrange
+	b, err := newPublishBuffer(BufferOpts{Size: 2})
+	assert.NoError(t, err)
+
+	// act
+	assert.NoError(t, b.push(newTestPublishing(1)))
+	assert.NoError(t, b.push(newTestPublishing(2)))
+	err = b.push(newTestPublishing(3))
+
+	// assert
+	assert.True(t, errors.Is(err, ErrBufferFull))
+	assert.Equal(t, []string{"1", "2"}, drain(t, b))
+}
+
+func TestPublishBufferSpillsToDiskInOrder(t *testing.T) {
+	// arrange
+	spill := filepath.Join(t.TempDir(), "spill")
+	b, err := newPublishBuffer(BufferOpts{Size: 2, SpillFile: spill})
+	assert.NoError(t, err)
+
+	// act
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, b.push(newTestPublishing(i)))
+	}
+	// drain part of the buffer, the memory has room again
+	// but new messages must go after the spilled ones
+	for i := 1; i <= 3; i++ {
+		p, err := b.peek()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("%d", i), string(p.msg.Body))
+		assert.NoError(t, b.drop())
+	}
+	assert.NoError(t, b.push(newTestPublishing(6)))
+
+	// assert
+	p, err := b.peek()
+	assert.NoError(t, err)
+	assert.Equal(t, "key-4", p.key)
+	assert.Equal(t, amqp.Table{"attempt": int32(4)}, p.msg.Headers)
+	assert.Equal(t, []string{"4", "5", "6"}, drain(t, b))
+
+	// the spill file is reused after being emptied
+	assert.NoError(t, b.push(newTestPublishing(7)))
+	assert.NoError(t, b.push(newTestPublishing(8)))
+	assert.NoError(t, b.push(newTestPublishing(9)))
+	assert.Equal(t, []string{"7", "8", "9"}, drain(t, b))
+}
+
+func TestDiscardedBufferResolvesConfirmations(t *testing.T) {
+	// arrange
+	spill := filepath.Join(t.TempDir(), "spill")
+	b, err := newPublishBuffer(BufferOpts{Size: 1, SpillFile: spill})
+	assert.NoError(t, err)
+	inMemory, spilled := newTestPublishing(1), newTestPublishing(2)
+	assert.NoError(t, b.push(inMemory))
+	assert.NoError(t, b.push(spilled))
+
+	// act
+	b.discard(errChannelClosed)
+
+	// assert
+	assert.False(t, inMemory.confirmation.Wait())
+	assert.False(t, spilled.confirmation.Wait())
+	assert.True(t, errors.Is(spilled.confirmation.Err(), errChannelClosed))
+	assert.Equal(t, 0, b.len())
+}
+
+func TestSpillFileIsNotUsedAfterFailingToTruncate(t *testing.T) {
+	// arrange
+	spill := filepath.Join(t.TempDir(), "spill")
+	b, err := newPublishBuffer(BufferOpts{Size: 1, SpillFile: spill})
+	assert.NoError(t, err)
+	assert.NoError(t, b.push(newTestPublishing(1)))
+	assert.NoError(t, b.push(newTestPublishing(2)))
+	assert.NoError(t, b.drop())
+	_, err = b.peek()
+	assert.NoError(t, err)
+	// the spill file cannot be reopened where a directory is
+	assert.NoError(t, os.Remove(spill))
+	assert.NoError(t, os.Mkdir(spill, 0o700))
+
+	// act
+	err = b.drop()
+
+	// assert
+	assert.Error(t, err)
+	assert.Equal(t, 0, b.len())
+	assert.NoError(t, b.push(newTestPublishing(3)))
+	err = b.push(newTestPublishing(4))
+	assert.True(t, errors.Is(err, ErrBufferFull))
+	assert.Equal(t, []string{"3"}, drain(t, b))
+}
@@ -0,0 +1,293 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// PoolSelection defines how a PublisherPool picks the channel
+// used on each publish.
+type PoolSelection int
+
+const (
+	// PoolRoundRobin uses the channels one after another.
+	PoolRoundRobin PoolSelection = iota
+	// PoolLeastInFlight uses the channel with fewer messages
+	// waiting for confirmation.
+	PoolLeastInFlight
+)
+
+// PoolOpts is a struct that encapsulates the options of a PublisherPool.
+type PoolOpts struct {
+	Size      int           // how many channels are opened, defaults to 4
+	Selection PoolSelection // how the channel of each publish is picked
+}
+
+const defaultPoolSize = 4
+
+var errPoolClosed = errors.New("publisher pool is closed")
+
+// PublisherPool spreads the publishes across many confirm mode Publisher
+// channels of the same connection. Each StrongChannel serializes its
+// publishes and confirmations, the pool allows them to run in parallel.
+//
+// Channels that are reconnecting are skipped while there are working
+// ones, and channels that gave up reconnecting are replaced by new ones.
+type PublisherPool struct {
+	conn     *StrongConnection
+	name     string
+	opts     PoolOpts
+	chOpts   []Option
+	lock     sync.Mutex
+	channels []*pooledChannel
+	next     int  // the next channel used by PoolRoundRobin
+	closed   bool // set when Close is called
+}
+
+// pooledChannel is a channel of the pool and the
+// confirmations of the messages published on it
+type pooledChannel struct {
+	ch        *StrongChannel
+	pending   []*Confirmation // unresolved confirmations, in publishing order
+	replacing bool            // set while a publish opens the channel replacing this one
+}
+
+// PublisherPool opens a pool of confirm mode Publisher channels on the
+// connection. The channels are named after the pool, eg.: name-0, and
+// receive the given options, so a spill file must not be set on them.
+func (conn *StrongConnection) PublisherPool(name string, opts PoolOpts, chOpts ...Option) (*PublisherPool, error) {
+	if opts.Size <= 0 {
+		opts.Size = defaultPoolSize
+	}
+	p := &PublisherPool{
+		conn:     conn,
+		name:     name,
+		opts:     opts,
+		chOpts:   chOpts,
+		channels: make([]*pooledChannel, opts.Size),
+	}
+	for i := range p.channels {
+		ch, err := p.open(context.Background(), i)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.channels[i] = &pooledChannel{ch: ch}
+	}
+	return p, nil
+}
+
+// open opens the i-th channel of the pool in confirm mode
+func (p *PublisherPool) open(ctx context.Context, i int) (*StrongChannel, error) {
+	ch, err := p.conn.ChannelContext(ctx, Publisher, fmt.Sprintf("%s-%d", p.name, i), p.chOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// PublishConfirmed publishes a message on one of the pool channels,
+// it follows the same rules of StrongChannel.PublishConfirmed.
+func (p *PublisherPool) PublishConfirmed(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*Confirmation, error) {
+	if ctx == nil {
+		return nil, errors.New("nil Context")
+	}
+	pc, err := p.pick(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	confirmation, err := pc.ch.PublishConfirmed(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	pc.pending = append(pc.pending, confirmation)
+	pc.inFlight()
+	p.lock.Unlock()
+	return confirmation, nil
+}
+
+// PublishWithContext publishes a message on one of the pool channels,
+// without waiting for the confirmation.
+func (p *PublisherPool) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	_, err := p.PublishConfirmed(ctx, exchange, key, mandatory, immediate, msg)
+	return err
+}
+
+// PublishWithDeferredConfirmWithContext publishes a message on one of
+// the pool channels, it follows the same rules of
+// StrongChannel.PublishWithDeferredConfirmWithContext. The message is
+// not counted as in flight when picking the next channel.
+func (p *PublisherPool) PublishWithDeferredConfirmWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*amqp.DeferredConfirmation, error) {
+	if ctx == nil {
+		return nil, errors.New("nil Context")
+	}
+	pc, err := p.pick(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pc.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// pick returns the channel used on the next publish, replacing the
+// channels that gave up reconnecting
+func (p *PublisherPool) pick(ctx context.Context) (*pooledChannel, error) {
+	if err := p.replaceFailed(ctx); err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil, errPoolClosed
+	}
+
+	// start from the next channel and prefer the open ones, then
+	// the ones reconnecting, to the ones that gave up
+	rotated := make([]*pooledChannel, 0, len(p.channels))
+	var open, working []*pooledChannel
+	for i := range p.channels {
+		pc := p.channels[(p.next+i)%len(p.channels)]
+		rotated = append(rotated, pc)
+		if pc.ch.isOpen() {
+			open = append(open, pc)
+		}
+		if pc.ch.Err() == nil {
+			working = append(working, pc)
+		}
+	}
+	candidates := open
+	if len(candidates) == 0 {
+		candidates = working
+	}
+	if len(candidates) == 0 {
+		candidates = rotated
+	}
+
+	picked := candidates[0]
+	if p.opts.Selection == PoolLeastInFlight {
+		for _, pc := range candidates[1:] {
+			if pc.inFlight() < picked.inFlight() {
+				picked = pc
+			}
+		}
+	}
+	p.next = (p.indexOf(picked) + 1) % len(p.channels)
+	return picked, nil
+}
+
+// replaceFailed replaces the channels that gave up reconnecting. Opening
+// a channel waits for the connection to be ready, so it's done without
+// holding the pool lock, the publishes keep using the other channels.
+func (p *PublisherPool) replaceFailed(ctx context.Context) error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return errPoolClosed
+	}
+	var failed []*pooledChannel
+	for _, pc := range p.channels {
+		if !pc.replacing && pc.ch.Err() != nil {
+			pc.replacing = true
+			failed = append(failed, pc)
+		}
+	}
+	p.lock.Unlock()
+
+	var err error
+	for _, pc := range failed {
+		// release the channels left to the next publishes
+		if err != nil {
+			p.lock.Lock()
+			pc.replacing = false
+			p.lock.Unlock()
+			continue
+		}
+		err = p.replace(ctx, pc)
+	}
+	return err
+}
+
+// replace opens a channel and swaps it with the given one
+func (p *PublisherPool) replace(ctx context.Context, old *pooledChannel) error {
+	p.lock.Lock()
+	i := p.indexOf(old)
+	p.lock.Unlock()
+
+	ch, err := p.open(ctx, i)
+
+	p.lock.Lock()
+	if err != nil {
+		old.replacing = false
+		p.lock.Unlock()
+		return fmt.Errorf("cannot replace the channel %q: %w", old.ch.Name, err)
+	}
+	if p.closed {
+		p.lock.Unlock()
+		ch.Close()
+		return errPoolClosed
+	}
+	// the confirmations were resolved when the channel gave up
+	p.channels[i] = &pooledChannel{ch: ch}
+	p.lock.Unlock()
+
+	p.conn.logger().Info("pool channel replaced", "channel", ch.Name, "error", old.ch.Err())
+	old.ch.Close()
+	return nil
+}
+
+// indexOf returns the position of the channel on the pool
+func (p *PublisherPool) indexOf(pc *pooledChannel) int {
+	for i := range p.channels {
+		if p.channels[i] == pc {
+			return i
+		}
+	}
+	return 0
+}
+
+// inFlight drops the resolved confirmations and returns how many
+// messages are waiting for confirmation. The confirmations resolve
+// mostly in order, so only the oldest ones are checked.
+func (pc *pooledChannel) inFlight() int {
+	for len(pc.pending) > 0 && pc.pending[0].resolved() {
+		pc.pending[0] = nil
+		pc.pending = pc.pending[1:]
+	}
+	return len(pc.pending)
+}
+
+// Close closes all the channels of the pool. The messages waiting for
+// confirmation are resolved with an error.
+// It is safe to call this method multiple times.
+func (p *PublisherPool) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	channels := p.channels
+	p.lock.Unlock()
+
+	var err error
+	for _, pc := range channels {
+		if pc == nil {
+			continue
+		}
+		if closeErr := pc.ch.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+// newTestPool returns a pool of disconnected channels, with
+// the given amount of unresolved confirmations on each one
+func newTestPool(selection PoolSelection, inFlight ...int) *PublisherPool {
+	p := &PublisherPool{opts: PoolOpts{Size: len(inFlight), Selection: selection}}
+	for i, n := range inFlight {
+		pc := &pooledChannel{ch: &StrongChannel{Name: string(rune('a' + i))}}
+		for j := 0; j < n; j++ {
+			pc.pending = append(pc.pending, newConfirmation())
+		}
+		p.channels = append(p.channels, pc)
+	}
+	return p
+}
+
+// picks returns the names of the channels picked on n publishes
+func picks(t *testing.T, p *PublisherPool, n int) []string {
+	var names []string
+	for i := 0; i < n; i++ {
+		pc, err := p.pick(context.Background())
+		assert.NoError(t, err)
+		names = append(names, pc.ch.Name)
+	}
+	return names
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	// arrange
+	p := newTestPool(PoolRoundRobin, 5, 0, 1)
+
+	// act
+	names := picks(t, p, 4)
+
+	// assert
+	assert.Equal(t, []string{"a", "b", "c", "a"}, names)
+}
+
+func TestPoolLeastInFlight(t *testing.T) {
+	// arrange
+	p := newTestPool(PoolLeastInFlight, 5, 2, 1)
+
+	// act
+	names := picks(t, p, 2)
+
+	// assert
+	assert.Equal(t, []string{"c", "c"}, names)
+
+	// the resolved confirmations are not in flight anymore
+	for _, c := range p.channels[0].pending {
+		c.resolve(true, nil)
+	}
+	assert.Equal(t, []string{"a"}, picks(t, p, 1))
+	assert.Equal(t, 0, len(p.channels[0].pending))
+}
+
+func TestClosedPoolDoesNotPick(t *testing.T) {
+	// arrange
+	p := newTestPool(PoolRoundRobin)
+	p.closed = true
+
+	// act
+	_, err := p.pick(context.Background())
+
+	// assert
+	assert.True(t, errors.Is(err, errPoolClosed))
+}
+
+func TestPoolPicksWhileAChannelIsReplaced(t *testing.T) {
+	// arrange
+	p := newTestPool(PoolRoundRobin, 0, 0)
+	// the connection is recovering, the replacement waits for it
+	p.conn = &StrongConnection{Connection: &amqp.Connection{}, ready: make(chan struct{}), done: make(chan struct{})}
+	p.channels[0].ch.failErr = ErrReconnectGaveUp
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replaced := make(chan error, 1)
+	go func() {
+		_, err := p.pick(ctx)
+		replaced <- err
+	}()
+	for replacing := false; !replacing; {
+		p.lock.Lock()
+		replacing = p.channels[0].replacing
+		p.lock.Unlock()
+	}
+
+	// act
+	picked := make(chan string, 1)
+	go func() {
+		pc, err := p.pick(context.Background())
+		assert.NoError(t, err)
+		picked <- pc.ch.Name
+	}()
+
+	// assert
+	select {
+	case name := <-picked:
+		assert.Equal(t, "b", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pick waited for the replacement")
+	}
+	cancel()
+	assert.True(t, errors.Is(<-replaced, context.Canceled))
+	assert.False(t, p.channels[0].replacing)
+}
@@ -0,0 +1,488 @@
+package rabbittest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+// dialBroker opens an amqp connection and a channel to the broker
+func dialBroker(t *testing.T, b *Broker) *amqp.Channel {
+	conn, err := amqp.DialConfig(b.URL(), amqp.Config{Dial: b.Dial})
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	assert.NoError(t, err)
+	return ch
+}
+
+// receive waits for a delivery
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery received")
+		return amqp.Delivery{}
+	}
+}
+
+// eventually waits for the condition to be true
+func eventually(t *testing.T, timeout time.Duration, condition func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var topicMatchesData = map[string]struct {
+	pattern  string
+	key      string
+	expected bool
+}{
+	"exact words":              {pattern: "orders.created", key: "orders.created", expected: true},
+	"different words":          {pattern: "orders.created", key: "orders.paid", expected: false},
+	"star matches one word":    {pattern: "orders.*", key: "orders.created", expected: true},
+	"star needs one word":      {pattern: "orders.*", key: "orders", expected: false},
+	"star matches only one":    {pattern: "orders.*", key: "orders.created.eu", expected: false},
+	"hash matches many words":  {pattern: "orders.#", key: "orders.created.eu", expected: true},
+	"hash matches zero words":  {pattern: "orders.#", key: "orders", expected: true},
+	"hash in the middle":       {pattern: "orders.#.eu", key: "orders.created.paid.eu", expected: true},
+	"hash alone matches empty": {pattern: "#", key: "", expected: true},
+}
+
+func TestTopicMatches(t *testing.T) {
+	for name, data := range topicMatchesData {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			matched := topicMatches(strings.Split(data.pattern, "."), strings.Split(data.key, "."))
+			assert.Equal(t, data.expected, matched)
+		})
+	}
+}
+
+var routingData = map[string]struct {
+	kind       string
+	bindingKey string
+	routingKey string
+	routed     bool
+}{
+	"direct with the same key":      {kind: Direct, bindingKey: "orders", routingKey: "orders", routed: true},
+	"direct with another key":       {kind: Direct, bindingKey: "orders", routingKey: "payments", routed: false},
+	"fanout ignores the key":        {kind: Fanout, bindingKey: "", routingKey: "anything", routed: true},
+	"topic with a matching pattern": {kind: Topic, bindingKey: "orders.*", routingKey: "orders.created", routed: true},
+	"topic with another pattern":    {kind: Topic, bindingKey: "orders.*", routingKey: "payments.created", routed: false},
+}
+
+func TestRouting(t *testing.T) {
+	for name, data := range routingData {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			// arrange
+			b := NewBroker()
+			assert.NoError(t, b.ExchangeDeclare("shop", data.kind))
+			b.QueueDeclare("orders", nil)
+			assert.NoError(t, b.QueueBind("orders", data.bindingKey, "shop"))
+
+			// act
+			routed, err := b.Publish("shop", data.routingKey, amqp.Publishing{Body: []byte("order")})
+
+			// assert
+			assert.NoError(t, err)
+			assert.Equal(t, data.routed, routed)
+			expectedLen := 0
+			if data.routed {
+				expectedLen = 1
+			}
+			assert.Equal(t, expectedLen, b.QueueLen("orders"))
+		})
+	}
+}
+
+func TestDefaultExchangeRoutesToTheQueueNamedByTheKey(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	b.QueueDeclare("orders", nil)
+
+	// act
+	routed, err := b.Publish("", "orders", amqp.Publishing{Body: []byte("order")})
+
+	// assert
+	assert.NoError(t, err)
+	assert.True(t, routed)
+	msg, ok := b.Get("orders")
+	assert.True(t, ok)
+	assert.Equal(t, "order", string(msg.Body))
+}
+
+func TestPublishConfirmAndConsume(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	assert.NoError(t, ch.ExchangeDeclare("shop", Topic, true, false, false, false, nil))
+	_, err := ch.QueueDeclare("orders", true, false, false, false, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ch.QueueBind("orders", "orders.#", "shop", false, nil))
+	assert.NoError(t, ch.Confirm(false))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	deliveries, err := ch.Consume("orders", "", false, false, false, false, nil)
+	assert.NoError(t, err)
+
+	// act
+	err = ch.Publish("shop", "orders.created", false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Headers:     amqp.Table{"tenant": "acme", "attempt": int32(2)},
+		Body:        []byte(`{"id":1}`),
+	})
+	assert.NoError(t, err)
+
+	// assert
+	assert.Equal(t, amqp.Confirmation{DeliveryTag: 1, Ack: true}, <-confirms)
+	d := receive(t, deliveries)
+	assert.Equal(t, `{"id":1}`, string(d.Body))
+	assert.Equal(t, "application/json", d.ContentType)
+	assert.Equal(t, "acme", d.Headers["tenant"])
+	assert.Equal(t, int32(2), d.Headers["attempt"])
+	assert.Equal(t, "orders.created", d.RoutingKey)
+	assert.Equal(t, 1, b.Unacked("orders"))
+
+	assert.NoError(t, d.Ack(false))
+	eventually(t, time.Second, func() bool { return b.Unacked("orders") == 0 })
+	assert.Equal(t, 0, b.QueueLen("orders"))
+}
+
+func TestLargeBodiesAreSplitOnFrames(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	_, err := ch.QueueDeclare("files", false, false, false, false, nil)
+	assert.NoError(t, err)
+	body := []byte(strings.Repeat("a", 3*frameMax))
+
+	// act
+	assert.NoError(t, ch.Publish("", "files", false, false, amqp.Publishing{Body: body}))
+
+	// assert
+	eventually(t, time.Second, func() bool { return b.QueueLen("files") == 1 })
+	d, ok, err := ch.Get("files", true)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, len(body), len(d.Body))
+}
+
+func TestNackedMessagesAreRequeued(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	_, err := ch.QueueDeclare("orders", false, false, false, false, nil)
+	assert.NoError(t, err)
+	deliveries, err := ch.Consume("orders", "", false, false, false, false, nil)
+	assert.NoError(t, err)
+	_, err = b.Publish("", "orders", amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+
+	// act
+	first := receive(t, deliveries)
+	assert.NoError(t, first.Nack(false, true))
+
+	// assert
+	second := receive(t, deliveries)
+	assert.False(t, first.Redelivered)
+	assert.True(t, second.Redelivered)
+	assert.Equal(t, "order", string(second.Body))
+}
+
+func TestRejectedMessagesAreDeadLettered(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	b.QueueDeclare("orders.dead", nil)
+	ch := dialBroker(t, b)
+	_, err := ch.QueueDeclare("orders", false, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "orders.dead",
+	})
+	assert.NoError(t, err)
+	_, err = b.Publish("", "orders", amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+
+	// act
+	d, ok, err := ch.Get("orders", false)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, d.Reject(false))
+
+	// assert
+	eventually(t, time.Second, func() bool { return b.QueueLen("orders.dead") == 1 })
+	msg, _ := b.Get("orders.dead")
+	deaths, _ := msg.Headers["x-death"].([]interface{})
+	assert.Equal(t, 1, len(deaths))
+	death := deaths[0].(amqp.Table)
+	assert.Equal(t, "orders", death["queue"])
+	assert.Equal(t, "rejected", death["reason"])
+	assert.Equal(t, int64(1), death["count"])
+}
+
+func TestExpiredMessagesAreDeadLettered(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	b.QueueDeclare("orders", nil)
+	b.QueueDeclare("orders.retry", amqp.Table{
+		"x-message-ttl":             int64(20),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "orders",
+	})
+
+	// act
+	for i := 0; i < 2; i++ {
+		_, err := b.Publish("", "orders.retry", amqp.Publishing{Body: []byte("order")})
+		assert.NoError(t, err)
+		eventually(t, time.Second, func() bool { return b.QueueLen("orders") == 1 })
+		msg, _ := b.Get("orders")
+		_, err = b.Publish("", "orders.retry", msg.Publishing)
+		assert.NoError(t, err)
+		eventually(t, time.Second, func() bool { return b.QueueLen("orders") == 1 })
+		msg, _ = b.Get("orders")
+
+		// assert
+		deaths, _ := msg.Headers["x-death"].([]interface{})
+		assert.Equal(t, 1, len(deaths))
+		death := deaths[0].(amqp.Table)
+		assert.Equal(t, "expired", death["reason"])
+		assert.Equal(t, int64(2), death["count"])
+	}
+}
+
+func TestPrefetchLimitsTheDeliveries(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	_, err := ch.QueueDeclare("orders", false, false, false, false, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Qos(1, 0, false))
+	for i := 0; i < 3; i++ {
+		_, err := b.Publish("", "orders", amqp.Publishing{Body: []byte("order")})
+		assert.NoError(t, err)
+	}
+
+	// act
+	deliveries, err := ch.Consume("orders", "", false, false, false, false, nil)
+	assert.NoError(t, err)
+	d := receive(t, deliveries)
+
+	// assert
+	assert.Equal(t, 1, b.Unacked("orders"))
+	assert.Equal(t, 2, b.QueueLen("orders"))
+	assert.NoError(t, d.Ack(false))
+	receive(t, deliveries)
+	assert.Equal(t, 1, b.QueueLen("orders"))
+}
+
+func TestUnroutableMandatoryMessagesAreReturned(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	// act
+	err := ch.Publish("amq.direct", "nowhere", true, false, amqp.Publishing{Body: []byte("order")})
+
+	// assert
+	assert.NoError(t, err)
+	select {
+	case r := <-returns:
+		assert.Equal(t, uint16(amqp.NoRoute), r.ReplyCode)
+		assert.Equal(t, "order", string(r.Body))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message was not returned")
+	}
+}
+
+func TestNackPublishes(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	assert.NoError(t, ch.Confirm(false))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	b.QueueDeclare("orders", nil)
+	b.NackPublishes(true)
+
+	// act
+	err := ch.Publish("", "orders", false, false, amqp.Publishing{Body: []byte("order")})
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, amqp.Confirmation{DeliveryTag: 1, Ack: false}, <-confirms)
+	assert.Equal(t, 0, b.QueueLen("orders"))
+}
+
+func TestPublishingToAMissingExchangeClosesTheChannel(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	// act
+	assert.NoError(t, ch.Publish("missing", "", false, false, amqp.Publishing{}))
+
+	// assert
+	select {
+	case err := <-closed:
+		assert.Equal(t, amqp.NotFound, err.Code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the channel was not closed")
+	}
+}
+
+func TestUnackedMessagesAreRequeuedWhenTheConnectionDrops(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	_, err := ch.QueueDeclare("orders", false, false, false, false, nil)
+	assert.NoError(t, err)
+	_, err = b.Publish("", "orders", amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+	_, ok, err := ch.Get("orders", false)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// act
+	b.DropConnections()
+
+	// assert
+	eventually(t, time.Second, func() bool { return b.QueueLen("orders") == 1 })
+	msg, _ := b.Get("orders")
+	assert.True(t, msg.Redelivered)
+	assert.Equal(t, 0, b.Connections())
+}
+
+func TestExclusiveQueuesAreDeletedWithTheConnection(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	q, err := ch.QueueDeclare("", false, false, true, false, nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(q.Name, "amq.gen-"))
+	assert.True(t, b.HasQueue(q.Name))
+
+	// act
+	b.CloseConnections("test")
+
+	// assert
+	eventually(t, time.Second, func() bool { return !b.HasQueue(q.Name) })
+}
+
+func TestDeletedQueueCancelsTheConsumers(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	_, err := ch.QueueDeclare("orders", false, false, false, false, nil)
+	assert.NoError(t, err)
+	cancels := ch.NotifyCancel(make(chan string, 1))
+	_, err = ch.Consume("orders", "orders-consumer", false, false, false, false, nil)
+	assert.NoError(t, err)
+
+	// act
+	assert.True(t, b.DeleteQueue("orders"))
+
+	// assert
+	select {
+	case tag := <-cancels:
+		assert.Equal(t, "orders-consumer", tag)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the consumer was not cancelled")
+	}
+}
+
+func TestBlockNotifiesTheConnections(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	conn, err := amqp.DialConfig(b.URL(), amqp.Config{Dial: b.Dial})
+	assert.NoError(t, err)
+	defer conn.Close()
+	blocks := conn.NotifyBlocked(make(chan amqp.Blocking, 2))
+
+	// act
+	b.Block("low on memory")
+	b.Unblock()
+
+	// assert
+	assert.Equal(t, amqp.Blocking{Active: true, Reason: "low on memory"}, <-blocks)
+	assert.Equal(t, amqp.Blocking{Active: false}, <-blocks)
+}
+
+func TestRefusedConnections(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	b.RefuseConnections(true)
+
+	// act
+	_, err := amqp.DialConfig(b.URL(), amqp.Config{Dial: b.Dial})
+
+	// assert
+	assert.Error(t, err)
+}
+
+func TestDirectReplyTo(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	client := dialBroker(t, b)
+	server := dialBroker(t, b)
+	_, err := server.QueueDeclare("quotes", false, false, false, false, nil)
+	assert.NoError(t, err)
+	requests, err := server.Consume("quotes", "", true, false, false, false, nil)
+	assert.NoError(t, err)
+	replies, err := client.Consume(directReplyTo, "", true, false, false, false, nil)
+	assert.NoError(t, err)
+
+	// act
+	assert.NoError(t, client.Publish("", "quotes", false, false,
+		amqp.Publishing{ReplyTo: directReplyTo, CorrelationId: "1", Body: []byte("quote?")}))
+	request := receive(t, requests)
+	assert.NoError(t, server.Publish("", request.ReplyTo, false, false,
+		amqp.Publishing{CorrelationId: request.CorrelationId, Body: []byte("10")}))
+
+	// assert
+	assert.True(t, strings.HasPrefix(request.ReplyTo, directReplyTo+"."))
+	reply := receive(t, replies)
+	assert.Equal(t, "1", reply.CorrelationId)
+	assert.Equal(t, "10", string(reply.Body))
+}
+
+func TestDirectReplyToWithoutTheReplyConsumerClosesTheChannel(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	defer b.Close()
+	ch := dialBroker(t, b)
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	// act
+	assert.NoError(t, ch.Publish("", "quotes", false, false, amqp.Publishing{ReplyTo: directReplyTo}))
+
+	// assert
+	select {
+	case err := <-closed:
+		assert.Equal(t, amqp.PreconditionFailed, err.Code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the channel was not closed")
+	}
+}
@@ -0,0 +1,984 @@
+package rabbittest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+var errProtocolHeader = errors.New("unsupported protocol header")
+
+// connection serves a client connection. The frames are handled with the
+// broker lock held and the replies are queued, a writer goroutine sends
+// them so the broker never blocks on a slow client.
+type connection struct {
+	broker   *Broker
+	conn     net.Conn
+	channels map[uint16]*channel
+	opened   bool // set after the handshake
+	closing  bool // a connection.close was sent, waiting for the close-ok
+
+	outLock   sync.Mutex
+	out       [][]byte
+	outClose  bool // close the socket after the queued frames are written
+	outSignal chan struct{}
+	done      chan struct{}
+}
+
+// channel is a client channel, all its fields are guarded by the broker lock
+type channel struct {
+	conn        *connection
+	id          uint16
+	closing     bool // a channel.close was sent, waiting for the close-ok
+	confirm     bool
+	publishSeq  uint64
+	deliveryTag uint64
+	prefetch    int
+	consumers   map[string]*consumer
+	unacked     []*delivery // in delivery tag order
+	incoming    *content    // the message being published
+	replyTag    string      // the tag of the direct reply-to consumer
+	replyTo     string      // the direct reply-to address of the channel
+}
+
+type consumer struct {
+	tag      string
+	ch       *channel
+	queue    *queue
+	noAck    bool
+	prefetch int
+	unacked  int
+}
+
+// delivery is a message delivered and not acknowledged yet
+type delivery struct {
+	tag      uint64
+	queue    *queue
+	message  *message
+	consumer *consumer // nil for basic.get
+}
+
+// content is a message being received from the publisher
+type content struct {
+	exchange  string
+	key       string
+	mandatory bool
+	header    bool // if the content header was received
+	size      uint64
+	msg       amqp.Publishing
+}
+
+func newConnection(b *Broker, conn net.Conn) *connection {
+	return &connection{
+		broker:    b,
+		conn:      conn,
+		channels:  make(map[uint16]*channel),
+		outSignal: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// serve runs the handshake and handles the frames until the connection closes
+func (c *connection) serve() {
+	b := c.broker
+	go c.writeLoop()
+	defer func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		c.release()
+	}()
+
+	r := bufio.NewReader(c.conn)
+	heartbeat, err := c.handshake(r)
+	if err != nil {
+		return
+	}
+
+	b.lock.Lock()
+	c.opened = true
+	if b.blocked {
+		c.sendBlocked()
+	}
+	b.lock.Unlock()
+
+	if heartbeat > 0 {
+		go c.heartbeats(heartbeat / 2)
+	}
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		b.lock.Lock()
+		c.handle(f)
+		b.lock.Unlock()
+	}
+}
+
+// handshake negotiates the connection as RabbitMQ does,
+// returning the heartbeat interval asked by the client
+func (c *connection) handshake(r *bufio.Reader) (time.Duration, error) {
+	c.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	header := make([]byte, len(protocolHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(header, protocolHeader) {
+		c.conn.Write(protocolHeader)
+		return 0, errProtocolHeader
+	}
+
+	start := newMethod(connectionStart)
+	start.octet(0)
+	start.octet(9)
+	start.table(amqp.Table{
+		"product": "rabbittest",
+		"capabilities": amqp.Table{
+			"publisher_confirms":         true,
+			"basic.nack":                 true,
+			"consumer_cancel_notify":     true,
+			"connection.blocked":         true,
+			"exchange_exchange_bindings": true,
+			"per_consumer_qos":           true,
+		},
+	})
+	start.longstr("PLAIN AMQPLAIN")
+	start.longstr("en_US")
+	c.send(start.frame(0))
+	if _, err := c.expect(r, connectionStartOk); err != nil {
+		return 0, err
+	}
+
+	tune := newMethod(connectionTune)
+	tune.short(channelMax)
+	tune.long(frameMax)
+	tune.short(0) // the client picks the heartbeat
+	c.send(tune.frame(0))
+	tuneOk, err := c.expect(r, connectionTuneOk)
+	if err != nil {
+		return 0, err
+	}
+	tuneOk.short()
+	tuneOk.long()
+	heartbeat := time.Duration(tuneOk.short()) * time.Second
+
+	if _, err := c.expect(r, connectionOpen); err != nil {
+		return 0, err
+	}
+	openOk := newMethod(connectionOpenOk)
+	openOk.shortstr("")
+	c.send(openOk.frame(0))
+	return heartbeat, nil
+}
+
+// expect reads the next method of the handshake, skipping the heartbeats
+func (c *connection) expect(r *bufio.Reader, id uint32) (*decoder, error) {
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		if f.kind == frameHeartbeat {
+			continue
+		}
+		d := &decoder{buf: f.payload}
+		if f.kind != frameMethod || f.channel != 0 || d.method() != id {
+			return nil, fmt.Errorf("unexpected frame while waiting for the method %d.%d", id>>16, id&0xFFFF)
+		}
+		return d, nil
+	}
+}
+
+// writeLoop writes the queued frames until the connection closes
+func (c *connection) writeLoop() {
+	for {
+		select {
+		case <-c.outSignal:
+		case <-c.done:
+			return
+		}
+		c.outLock.Lock()
+		frames, closeAfter := c.out, c.outClose
+		c.out = nil
+		c.outLock.Unlock()
+
+		for _, f := range frames {
+			if _, err := c.conn.Write(f); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+		if closeAfter {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// send queues frames to be written
+func (c *connection) send(frames ...[]byte) {
+	c.outLock.Lock()
+	c.out = append(c.out, frames...)
+	c.outLock.Unlock()
+	select {
+	case c.outSignal <- struct{}{}:
+	default:
+	}
+}
+
+// closeAfterFlush closes the socket once the queued frames are written
+func (c *connection) closeAfterFlush() {
+	c.outLock.Lock()
+	c.outClose = true
+	c.outLock.Unlock()
+	c.send()
+}
+
+func (c *connection) heartbeats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.send(heartbeatFrame)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *connection) sendBlocked() {
+	e := newMethod(connectionBlocked)
+	e.shortstr(c.broker.blockReason)
+	c.send(e.frame(0))
+}
+
+// fail closes the connection with an error, the socket is
+// closed when the client answers with a close-ok
+func (c *connection) fail(code int, text string) {
+	if c.closing {
+		return
+	}
+	c.closing = true
+	e := newMethod(connectionClose)
+	e.short(uint16(code))
+	e.shortstr(text)
+	e.short(0)
+	e.short(0)
+	c.send(e.frame(0))
+}
+
+// release frees the resources of a closed connection, the
+// unacked messages are requeued and the exclusive queues deleted
+func (c *connection) release() {
+	b := c.broker
+	if _, ok := b.conns[c]; !ok {
+		return
+	}
+	delete(b.conns, c)
+	c.opened = false
+	close(c.done)
+	c.conn.Close()
+	for _, ch := range c.sortedChannels() {
+		ch.release()
+	}
+	c.channels = nil
+	for _, q := range b.queues {
+		if q.owner == c {
+			b.deleteQueue(q)
+		}
+	}
+}
+
+// sortedChannels returns the channels in id order
+func (c *connection) sortedChannels() []*channel {
+	channels := make([]*channel, 0, len(c.channels))
+	for _, ch := range c.channels {
+		channels = append(channels, ch)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].id < channels[j].id })
+	return channels
+}
+
+// handle handles a frame sent by the client
+func (c *connection) handle(f frame) {
+	switch f.kind {
+	case frameHeartbeat:
+		return
+	case frameMethod:
+		d := &decoder{buf: f.payload}
+		id := d.method()
+		if f.channel == 0 {
+			c.handleConnection(id, d)
+			return
+		}
+		if c.closing {
+			return
+		}
+		ch, ok := c.channels[f.channel]
+		if !ok {
+			c.handleClosedChannel(f.channel, id)
+			return
+		}
+		if ch.closing {
+			if id == channelCloseOk || id == channelClose {
+				if id == channelClose {
+					c.send(newMethod(channelCloseOk).frame(ch.id))
+				}
+				delete(c.channels, ch.id)
+			}
+			return
+		}
+		ch.handle(id, d)
+		if d.err != nil {
+			c.fail(amqp.SyntaxError, "SYNTAX_ERROR - malformed method")
+		}
+	case frameHeader, frameBody:
+		if c.closing {
+			return
+		}
+		ch, ok := c.channels[f.channel]
+		if !ok {
+			c.fail(amqp.ChannelError, "CHANNEL_ERROR - content on a closed channel")
+			return
+		}
+		if !ch.closing {
+			ch.handleContent(f)
+		}
+	default:
+		c.fail(amqp.FrameError, "FRAME_ERROR - unknown frame type")
+	}
+}
+
+// handleConnection handles the methods of the channel zero
+func (c *connection) handleConnection(id uint32, d *decoder) {
+	switch id {
+	case connectionClose:
+		c.send(newMethod(connectionCloseOk).frame(0))
+		c.closeAfterFlush()
+	case connectionCloseOk:
+		c.closeAfterFlush()
+	default:
+		c.fail(amqp.CommandInvalid, "COMMAND_INVALID - unexpected method on channel 0")
+	}
+}
+
+// handleClosedChannel handles the methods of a channel that is not open
+func (c *connection) handleClosedChannel(id uint16, method uint32) {
+	switch method {
+	case channelOpen:
+		if int(id) > channelMax {
+			c.fail(amqp.ChannelError, "CHANNEL_ERROR - channel id above the max")
+			return
+		}
+		c.channels[id] = &channel{conn: c, id: id, consumers: make(map[string]*consumer)}
+		ok := newMethod(channelOpenOk)
+		ok.longstr("")
+		c.send(ok.frame(id))
+	case channelClose:
+		c.send(newMethod(channelCloseOk).frame(id))
+	case channelCloseOk:
+	default:
+		c.fail(amqp.ChannelError, "CHANNEL_ERROR - expected 'channel.open'")
+	}
+}
+
+// send queues a method frame on the channel
+func (ch *channel) send(e *encoder) {
+	ch.conn.send(e.frame(ch.id))
+}
+
+// sendContent queues a method followed by the content of a message
+func (ch *channel) sendContent(e *encoder, msg amqp.Publishing) {
+	frames := append([][]byte{e.frame(ch.id)}, contentFrames(ch.id, msg)...)
+	ch.conn.send(frames...)
+}
+
+// fail closes the channel with an error
+func (ch *channel) fail(code int, text string, method uint32) {
+	if ch.closing {
+		return
+	}
+	ch.release()
+	ch.closing = true
+	e := newMethod(channelClose)
+	e.short(uint16(code))
+	e.shortstr(text)
+	e.short(uint16(method >> 16))
+	e.short(uint16(method))
+	ch.send(e)
+}
+
+// release cancels the consumers of a closed channel
+// and requeues its unacked messages
+func (ch *channel) release() {
+	b := ch.conn.broker
+	for _, cons := range ch.consumers {
+		b.removeConsumer(cons)
+	}
+	ch.consumers = make(map[string]*consumer)
+	ch.incoming = nil
+	ch.cancelReplies()
+
+	unacked := ch.unacked
+	ch.unacked = nil
+	b.requeueDeliveries(unacked)
+}
+
+// requeueDeliveries puts the delivered messages back on their queues
+func (b *Broker) requeueDeliveries(deliveries []*delivery) {
+	byQueue := make(map[*queue][]*message)
+	for _, d := range deliveries {
+		byQueue[d.queue] = append(byQueue[d.queue], d.message)
+	}
+	for _, q := range sortedQueues(byQueue) {
+		b.requeue(q, byQueue[q])
+	}
+}
+
+// handle handles a method of an open channel
+func (ch *channel) handle(id uint32, d *decoder) {
+	switch id {
+	case channelClose:
+		ch.release()
+		delete(ch.conn.channels, ch.id)
+		ch.send(newMethod(channelCloseOk))
+	case channelFlow:
+		active := d.octet()&1 != 0
+		ok := newMethod(channelFlowOk)
+		ok.bits(active)
+		ch.send(ok)
+	case exchangeDeclare:
+		ch.exchangeDeclare(d)
+	case exchangeDelete:
+		ch.exchangeDelete(d)
+	case exchangeBind, exchangeUnbind:
+		ch.exchangeBind(id, d)
+	case queueDeclare:
+		ch.queueDeclare(d)
+	case queueBind, queueUnbind:
+		ch.queueBind(id, d)
+	case queuePurge:
+		ch.queuePurge(d)
+	case queueDelete:
+		ch.queueDelete(d)
+	case basicQos:
+		d.long()
+		prefetch := d.short()
+		d.octet()
+		ch.prefetch = int(prefetch)
+		ch.send(newMethod(basicQosOk))
+	case basicConsume:
+		ch.consume(d)
+	case basicCancel:
+		ch.cancel(d)
+	case basicPublish:
+		d.short()
+		ch.incoming = &content{exchange: d.shortstr(), key: d.shortstr()}
+		ch.incoming.mandatory = d.octet()&1 != 0
+	case basicGet:
+		ch.get(d)
+	case basicAck:
+		tag := d.longlong()
+		multiple := d.octet()&1 != 0
+		ch.acknowledge(id, tag, multiple, false)
+	case basicNack:
+		tag := d.longlong()
+		bits := d.octet()
+		ch.acknowledge(id, tag, bits&1 != 0, bits&2 != 0)
+	case basicReject:
+		tag := d.longlong()
+		requeue := d.octet()&1 != 0
+		ch.acknowledge(id, tag, false, requeue)
+	case basicRecover:
+		d.octet()
+		unacked := ch.unacked
+		ch.unacked = nil
+		for _, del := range unacked {
+			if del.consumer != nil {
+				del.consumer.unacked--
+			}
+		}
+		ch.conn.broker.requeueDeliveries(unacked)
+		ch.send(newMethod(basicRecoverOk))
+	case confirmSelect:
+		noWait := d.octet()&1 != 0
+		ch.confirm = true
+		if !noWait {
+			ch.send(newMethod(confirmSelectOk))
+		}
+	default:
+		ch.conn.fail(amqp.NotImplemented, fmt.Sprintf("NOT_IMPLEMENTED - method %d.%d", id>>16, id&0xFFFF))
+	}
+}
+
+func (ch *channel) exchangeDeclare(d *decoder) {
+	b := ch.conn.broker
+	d.short()
+	name, kind := d.shortstr(), d.shortstr()
+	bits := d.octet()
+	passive, noWait := bits&1 != 0, bits&16 != 0
+	d.table()
+
+	if passive {
+		if _, ok := b.exchanges[name]; !ok {
+			ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", name), exchangeDeclare)
+			return
+		}
+	} else if _, err := b.declareExchange(name, kind); err != nil {
+		if _, exists := b.exchanges[name]; exists {
+			ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - "+err.Error(), exchangeDeclare)
+		} else {
+			ch.conn.fail(amqp.CommandInvalid, "COMMAND_INVALID - "+err.Error())
+		}
+		return
+	}
+	if !noWait {
+		ch.send(newMethod(exchangeDeclareOk))
+	}
+}
+
+func (ch *channel) exchangeDelete(d *decoder) {
+	b := ch.conn.broker
+	d.short()
+	name := d.shortstr()
+	noWait := d.octet()&2 != 0
+	if ex, ok := b.exchanges[name]; ok && name != "" {
+		b.deleteExchange(ex)
+	}
+	if !noWait {
+		ch.send(newMethod(exchangeDeleteOk))
+	}
+}
+
+func (ch *channel) exchangeBind(id uint32, d *decoder) {
+	b := ch.conn.broker
+	d.short()
+	destination, source, key := d.shortstr(), d.shortstr(), d.shortstr()
+	noWait := d.octet()&1 != 0
+	d.table()
+
+	src, ok := b.exchanges[source]
+	if _, destOk := b.exchanges[destination]; !ok || !destOk {
+		ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s' or '%s' in vhost '/'", source, destination), id)
+		return
+	}
+	bnd := binding{destination: destination, toExchange: true, key: key}
+	reply := uint32(exchangeUnbindOk)
+	if id == exchangeBind {
+		reply = exchangeBindOk
+		if err := b.bind(src, bnd); err != nil {
+			ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - "+err.Error(), id)
+			return
+		}
+	} else {
+		b.unbind(src, bnd)
+	}
+	if !noWait {
+		ch.send(newMethod(reply))
+	}
+}
+
+func (ch *channel) queueDeclare(d *decoder) {
+	b := ch.conn.broker
+	d.short()
+	name := d.shortstr()
+	bits := d.octet()
+	passive, exclusive, autoDelete, noWait := bits&1 != 0, bits&4 != 0, bits&8 != 0, bits&16 != 0
+	args := d.table()
+
+	q, ok := b.queues[name]
+	switch {
+	case ok && q.owner != nil && q.owner != ch.conn:
+		ch.fail(amqp.ResourceLocked, fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name), queueDeclare)
+		return
+	case !ok && passive:
+		ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name), queueDeclare)
+		return
+	case !ok:
+		if name == "" {
+			name = b.generateName("amq.gen-")
+		}
+		q = &queue{name: name, exclusive: exclusive, autoDelete: autoDelete, args: args}
+		if exclusive {
+			q.owner = ch.conn
+		}
+		b.queues[name] = q
+	}
+
+	b.expire(q)
+	if !noWait {
+		ok := newMethod(queueDeclareOk)
+		ok.shortstr(q.name)
+		ok.long(uint32(len(q.messages)))
+		ok.long(uint32(len(q.consumers)))
+		ch.send(ok)
+	}
+}
+
+func (ch *channel) queueBind(id uint32, d *decoder) {
+	b := ch.conn.broker
+	d.short()
+	name, exchange, key := d.shortstr(), d.shortstr(), d.shortstr()
+	noWait := false
+	if id == queueBind {
+		noWait = d.octet()&1 != 0
+	}
+	d.table()
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", exchange), id)
+		return
+	}
+	if _, ok := b.queues[name]; !ok {
+		ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name), id)
+		return
+	}
+	bnd := binding{destination: name, key: key}
+	reply := uint32(queueUnbindOk)
+	if id == queueBind {
+		reply = queueBindOk
+		if err := b.bind(ex, bnd); err != nil {
+			ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - "+err.Error(), id)
+			return
+		}
+	} else {
+		b.unbind(ex, bnd)
+	}
+	if !noWait {
+		ch.send(newMethod(reply))
+	}
+}
+
+func (ch *channel) queuePurge(d *decoder) {
+	b := ch.conn.broker
+	d.short()
+	name := d.shortstr()
+	noWait := d.octet()&1 != 0
+	q, ok := b.queues[name]
+	if !ok {
+		ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name), queuePurge)
+		return
+	}
+	count := len(q.messages)
+	q.messages = nil
+	if !noWait {
+		ok := newMethod(queuePurgeOk)
+		ok.long(uint32(count))
+		ch.send(ok)
+	}
+}
+
+func (ch *channel) queueDelete(d *decoder) {
+	b := ch.conn.broker
+	d.short()
+	name := d.shortstr()
+	bits := d.octet()
+	ifUnused, ifEmpty, noWait := bits&1 != 0, bits&2 != 0, bits&4 != 0
+
+	count := 0
+	if q, ok := b.queues[name]; ok {
+		if ifUnused && len(q.consumers) > 0 {
+			ch.fail(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' in use", name), queueDelete)
+			return
+		}
+		if ifEmpty && len(q.messages) > 0 {
+			ch.fail(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' is not empty", name), queueDelete)
+			return
+		}
+		count = b.deleteQueue(q)
+	}
+	if !noWait {
+		ok := newMethod(queueDeleteOk)
+		ok.long(uint32(count))
+		ch.send(ok)
+	}
+}
+
+func (ch *channel) consume(d *decoder) {
+	b := ch.conn.broker
+	d.short()
+	name, tag := d.shortstr(), d.shortstr()
+	bits := d.octet()
+	noAck, exclusive, noWait := bits&2 != 0, bits&4 != 0, bits&8 != 0
+	d.table()
+
+	if name == directReplyTo {
+		ch.consumeReplies(tag, noAck, noWait)
+		return
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name), basicConsume)
+		return
+	}
+	if (q.owner != nil && q.owner != ch.conn) || (exclusive && len(q.consumers) > 0) {
+		ch.fail(amqp.AccessRefused, fmt.Sprintf("ACCESS_REFUSED - queue '%s' in vhost '/' in exclusive use", name), basicConsume)
+		return
+	}
+	if tag == "" {
+		tag = b.generateName("amq.ctag-")
+	}
+	if _, exists := ch.consumers[tag]; exists {
+		ch.conn.fail(amqp.NotAllowed, fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", tag))
+		return
+	}
+
+	cons := &consumer{tag: tag, ch: ch, queue: q, noAck: noAck, prefetch: ch.prefetch}
+	ch.consumers[tag] = cons
+	q.consumers = append(q.consumers, cons)
+	if !noWait {
+		ok := newMethod(basicConsumeOk)
+		ok.shortstr(tag)
+		ch.send(ok)
+	}
+	b.dispatch(q)
+}
+
+// consumeReplies starts the direct reply-to consumer of the channel,
+// the replies are delivered without acknowledgement
+func (ch *channel) consumeReplies(tag string, noAck, noWait bool) {
+	b := ch.conn.broker
+	if !noAck {
+		ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer cannot acknowledge", basicConsume)
+		return
+	}
+	if ch.replyTag != "" {
+		ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer already set", basicConsume)
+		return
+	}
+	if tag == "" {
+		tag = b.generateName("amq.ctag-")
+	}
+	ch.replyTag = tag
+	ch.replyTo = b.generateName(directReplyTo + ".")
+	b.replies[ch.replyTo] = ch
+	if !noWait {
+		ok := newMethod(basicConsumeOk)
+		ok.shortstr(tag)
+		ch.send(ok)
+	}
+}
+
+// cancelReplies stops the direct reply-to consumer of the channel
+func (ch *channel) cancelReplies() {
+	if ch.replyTag == "" {
+		return
+	}
+	delete(ch.conn.broker.replies, ch.replyTo)
+	ch.replyTag, ch.replyTo = "", ""
+}
+
+func (ch *channel) cancel(d *decoder) {
+	tag := d.shortstr()
+	noWait := d.octet()&1 != 0
+	if tag == ch.replyTag {
+		ch.cancelReplies()
+	}
+	if cons, ok := ch.consumers[tag]; ok {
+		delete(ch.consumers, tag)
+		ch.conn.broker.removeConsumer(cons)
+	}
+	if !noWait {
+		ok := newMethod(basicCancelOk)
+		ok.shortstr(tag)
+		ch.send(ok)
+	}
+}
+
+func (ch *channel) get(d *decoder) {
+	b := ch.conn.broker
+	d.short()
+	name := d.shortstr()
+	noAck := d.octet()&1 != 0
+
+	q, ok := b.queues[name]
+	if !ok {
+		ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name), basicGet)
+		return
+	}
+	b.expire(q)
+	if len(q.messages) == 0 {
+		empty := newMethod(basicGetEmpty)
+		empty.shortstr("")
+		ch.send(empty)
+		return
+	}
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+
+	ch.deliveryTag++
+	if !noAck {
+		ch.unacked = append(ch.unacked, &delivery{tag: ch.deliveryTag, queue: q, message: m})
+	}
+	reply := newMethod(basicGetOk)
+	reply.longlong(ch.deliveryTag)
+	reply.bits(m.Redelivered)
+	reply.shortstr(m.Exchange)
+	reply.shortstr(m.RoutingKey)
+	reply.long(uint32(len(q.messages)))
+	ch.sendContent(reply, m.Publishing)
+}
+
+// acknowledge handles the acks, nacks and rejects. The messages
+// not acked are requeued or dead-lettered.
+func (ch *channel) acknowledge(id uint32, tag uint64, multiple, requeue bool) {
+	b := ch.conn.broker
+	ack := id == basicAck
+	var settled []*delivery
+	kept := ch.unacked[:0]
+	for _, d := range ch.unacked {
+		if d.tag == tag || (multiple && (tag == 0 || d.tag <= tag)) {
+			settled = append(settled, d)
+			continue
+		}
+		kept = append(kept, d)
+	}
+	if len(settled) == 0 && !(multiple && tag == 0) {
+		ch.unacked = kept
+		ch.fail(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag), id)
+		return
+	}
+	// clear the tail, the deliveries must not be kept alive by the array
+	for i := len(kept); i < len(ch.unacked); i++ {
+		ch.unacked[i] = nil
+	}
+	ch.unacked = kept
+
+	queues := make(map[*queue][]*message)
+	for _, d := range settled {
+		if d.consumer != nil {
+			d.consumer.unacked--
+		}
+		switch {
+		case ack:
+		case requeue:
+			queues[d.queue] = append(queues[d.queue], d.message)
+		case !d.queue.deleted:
+			b.deadLetter(d.queue, d.message, "rejected")
+		}
+		if _, ok := queues[d.queue]; !ok {
+			queues[d.queue] = nil
+		}
+	}
+	// requeue or dispatch to use the prefetch room freed
+	for _, q := range sortedQueues(queues) {
+		if len(queues[q]) > 0 {
+			b.requeue(q, queues[q])
+		} else if !q.deleted {
+			b.dispatch(q)
+		}
+	}
+}
+
+// handleContent receives the header and the body of a published message
+func (ch *channel) handleContent(f frame) {
+	in := ch.incoming
+	if in == nil || (f.kind == frameHeader) == in.header {
+		ch.conn.fail(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - content without basic.publish")
+		return
+	}
+	if f.kind == frameHeader {
+		d := &decoder{buf: f.payload}
+		d.short() // class
+		d.short() // weight
+		in.size = d.longlong()
+		in.msg = d.properties()
+		if d.err != nil {
+			ch.conn.fail(amqp.SyntaxError, "SYNTAX_ERROR - malformed content header")
+			return
+		}
+		in.header = true
+	} else {
+		in.msg.Body = append(in.msg.Body, f.payload...)
+	}
+
+	switch body := uint64(len(in.msg.Body)); {
+	case body > in.size:
+		ch.conn.fail(amqp.FrameError, "FRAME_ERROR - body above the content size")
+	case body == in.size:
+		ch.incoming = nil
+		ch.published(in)
+	}
+}
+
+// published routes a message received from the publisher,
+// confirming it when the channel is in confirm mode
+func (ch *channel) published(in *content) {
+	b := ch.conn.broker
+	if ch.confirm {
+		ch.publishSeq++
+	}
+	ex, ok := b.exchanges[in.exchange]
+	if !ok {
+		ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", in.exchange), basicPublish)
+		return
+	}
+	if in.msg.ReplyTo == directReplyTo {
+		if ch.replyTag == "" {
+			ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - fast reply consumer does not exist", basicPublish)
+			return
+		}
+		in.msg.ReplyTo = ch.replyTo
+	}
+
+	if b.nackPublishes {
+		if ch.confirm {
+			nack := newMethod(basicNack)
+			nack.longlong(ch.publishSeq)
+			nack.bits(false, false)
+			ch.send(nack)
+		}
+		return
+	}
+
+	if !b.publish(ex, in.key, in.msg) && in.mandatory {
+		ret := newMethod(basicReturn)
+		ret.short(amqp.NoRoute)
+		ret.shortstr("NO_ROUTE")
+		ret.shortstr(in.exchange)
+		ret.shortstr(in.key)
+		ch.sendContent(ret, in.msg)
+	}
+	if ch.confirm && !b.holdConfirms {
+		ack := newMethod(basicAck)
+		ack.longlong(ch.publishSeq)
+		ack.bits(false)
+		ch.send(ack)
+	}
+}
+
+// ready returns true if the consumer can receive a message
+func (cons *consumer) ready() bool {
+	return cons.noAck || cons.prefetch == 0 || cons.unacked < cons.prefetch
+}
+
+// deliver sends a message to the consumer
+func (cons *consumer) deliver(q *queue, m *message) {
+	ch := cons.ch
+	ch.deliveryTag++
+	if !cons.noAck {
+		ch.unacked = append(ch.unacked, &delivery{tag: ch.deliveryTag, queue: q, message: m, consumer: cons})
+		cons.unacked++
+	}
+	e := newMethod(basicDeliver)
+	e.shortstr(cons.tag)
+	e.longlong(ch.deliveryTag)
+	e.bits(m.Redelivered)
+	e.shortstr(m.Exchange)
+	e.shortstr(m.RoutingKey)
+	ch.sendContent(e, m.Publishing)
+}
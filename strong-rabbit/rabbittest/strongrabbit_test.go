@@ -0,0 +1,981 @@
+package rabbittest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	strongrabbit "github.com/xilapa/go-tiny-projects/strong-rabbit"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+var fastReconnect = strongrabbit.ReconnectPolicy{
+	InitialDelay: 10 * time.Millisecond,
+	Multiplier:   1,
+	MaxDelay:     10 * time.Millisecond,
+}
+
+// connect opens a StrongConnection to the broker, each test uses its own group
+func connect(t *testing.T, b *Broker) *strongrabbit.StrongConnection {
+	conn, err := strongrabbit.Connect(b.URL(), t.Name(),
+		strongrabbit.WithDialer(b.Dial), strongrabbit.WithReconnectPolicy(fastReconnect))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestPublisherRecoversFromDroppedConnection(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Confirm(false))
+	confirmation, err := ch.PublishConfirmed(context.Background(), "", "orders", false, false, amqp.Publishing{Body: []byte("first")})
+	assert.NoError(t, err)
+	assert.True(t, confirmation.Wait())
+
+	// act
+	b.RefuseConnections(true)
+	b.DropConnections()
+	time.Sleep(50 * time.Millisecond)
+	b.RefuseConnections(false)
+
+	// assert
+	eventually(t, 10*time.Second, func() bool { return conn.Stats().Reconnects == 1 })
+	// the connection counts the reconnection before restoring its channels
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, ch.WaitReady(ctx))
+	confirmation, err = ch.PublishConfirmed(context.Background(), "", "orders", false, false, amqp.Publishing{Body: []byte("second")})
+	assert.NoError(t, err)
+	assert.True(t, confirmation.Wait())
+	assert.Equal(t, 2, b.QueueLen("orders"))
+	assert.Equal(t, 1, b.Connections())
+}
+
+func TestChannelsAreRecoveredInTheOrderTheyWereOpened(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	var lock sync.Mutex
+	var recovered []string
+	conn, err := strongrabbit.Connect(b.URL(), t.Name(), strongrabbit.WithDialer(b.Dial),
+		strongrabbit.WithReconnectPolicy(fastReconnect),
+		strongrabbit.WithEvents(strongrabbit.EventOpts{OnReconnected: func(e strongrabbit.Event) {
+			lock.Lock()
+			defer lock.Unlock()
+			if e.Channel != "" {
+				recovered = append(recovered, e.Channel)
+			}
+		}}))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	names := []string{"orders", "payments", "audit", "shipping", "refunds"}
+	for _, name := range names {
+		_, err := conn.Channel(strongrabbit.Publisher, name)
+		assert.NoError(t, err)
+	}
+
+	// act
+	b.DropConnections()
+
+	// assert
+	eventually(t, 10*time.Second, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(recovered) == len(names)
+	})
+	assert.Equal(t, names, recovered)
+}
+
+func TestChannelRecoversAfterTheTopologyRestoreFails(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	assert.NoError(t, ch.ExchangeDeclare("orders", Direct, false, false, false, false, nil))
+	open := b.Channels()
+
+	// act
+	b.RefuseConnections(true)
+	b.DropConnections()
+	eventually(t, 5*time.Second, func() bool { return ch.State() == strongrabbit.Recovering })
+	// the redeclaration fails while the exchange has another type
+	b.DeleteExchange("orders")
+	assert.NoError(t, b.ExchangeDeclare("orders", Fanout))
+	b.RefuseConnections(false)
+	eventually(t, 5*time.Second, func() bool { return conn.State() == strongrabbit.Ready })
+	time.Sleep(50 * time.Millisecond)
+	failing := ch.State()
+	b.DeleteExchange("orders")
+
+	// assert
+	assert.Equal(t, strongrabbit.Recovering, failing)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, ch.WaitReady(ctx))
+	assert.Equal(t, open, b.Channels())
+}
+
+func TestTopologyIsDeclaredWhileTheChannelRecovers(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	stop := make(chan struct{})
+	declared := make(chan struct{})
+	go func() {
+		defer close(declared)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				// fails while the channel is down, it must not race the swap
+				ch.ExchangeDeclare("orders", Direct, false, false, false, false, nil)
+			}
+		}
+	}()
+
+	// act
+	b.DropConnections()
+	eventually(t, 10*time.Second, func() bool { return ch.Stats().Reconnects == 1 })
+	close(stop)
+	<-declared
+
+	// assert
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, ch.WaitReady(ctx))
+	assert.NoError(t, ch.ExchangeDeclare("orders", Direct, false, false, false, false, nil))
+}
+
+func TestUnconfirmedMessagesAreRepublishedAfterTheReconnection(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Confirm(false))
+	b.HoldConfirms(true)
+	confirmation, err := ch.PublishConfirmed(context.Background(), "", "orders", false, false, amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+	eventually(t, 5*time.Second, func() bool { return b.QueueLen("orders") == 1 })
+
+	// act
+	b.DropConnections()
+	b.HoldConfirms(false)
+
+	// assert
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ack, err := confirmation.WaitContext(ctx)
+	assert.NoError(t, err)
+	assert.True(t, ack)
+	first, _ := b.Get("orders")
+	republished, ok := b.Get("orders")
+	assert.True(t, ok)
+	assert.Equal(t, nil, first.Headers[strongrabbit.RepublishedHeader])
+	assert.Equal(t, true, republished.Headers[strongrabbit.RepublishedHeader])
+	assert.Equal(t, "order", string(republished.Body))
+}
+
+func TestUnconfirmedMessagesAreResolvedWhenTheReconnectionGivesUp(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn, err := strongrabbit.Connect(b.URL(), t.Name(), strongrabbit.WithDialer(b.Dial),
+		strongrabbit.WithReconnectPolicy(strongrabbit.ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxAttempts: 1}))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Confirm(false))
+	b.HoldConfirms(true)
+	confirmation, err := ch.PublishConfirmed(context.Background(), "", "orders", false, false, amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+
+	// act
+	b.RefuseConnections(true)
+	b.DropConnections()
+
+	// assert
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ack, err := confirmation.WaitContext(ctx)
+	assert.NoError(t, err)
+	assert.False(t, ack)
+	assert.True(t, errors.Is(confirmation.Err(), strongrabbit.ErrReconnectGaveUp))
+}
+
+func TestConsumerRecoversFromChannelFailure(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Consumer, "orders-consumer")
+	assert.NoError(t, err)
+	deliveries := make(chan amqp.Delivery)
+	go ch.Consume(&strongrabbit.ConsumeOpts{Queue: "orders"}, deliveries)
+	eventually(t, 5*time.Second, func() bool { return b.Consumers("orders") == 1 })
+
+	// act
+	b.CloseChannels(amqp.PreconditionFailed, "PRECONDITION_FAILED - injected")
+
+	// assert
+	eventually(t, 10*time.Second, func() bool { return ch.Stats().Reconnects == 1 && b.Consumers("orders") == 1 })
+	_, err = b.Publish("", "orders", amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+	d := receive(t, deliveries)
+	assert.Equal(t, "order", string(d.Body))
+	assert.NoError(t, d.Ack(false))
+}
+
+func TestConsumerResubscribesWhenTheQueueIsDeleted(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Consumer, "orders-consumer")
+	assert.NoError(t, err)
+	_, err = ch.QueueDeclare("orders", true, false, false, false, nil)
+	assert.NoError(t, err)
+	deliveries := make(chan amqp.Delivery)
+	go ch.Consume(&strongrabbit.ConsumeOpts{Queue: "orders"}, deliveries)
+	eventually(t, 5*time.Second, func() bool { return b.Consumers("orders") == 1 })
+
+	// act
+	assert.True(t, b.DeleteQueue("orders"))
+
+	// assert
+	eventually(t, 10*time.Second, func() bool { return b.Consumers("orders") == 1 })
+	_, err = b.Publish("", "orders", amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+	d := receive(t, deliveries)
+	assert.Equal(t, "order", string(d.Body))
+}
+
+// serveQuotes answers the requests of the quotes queue with the request
+// body followed by a quote, failing for empty requests
+func serveQuotes(t *testing.T, b *Broker, conn *strongrabbit.StrongConnection) {
+	b.QueueDeclare("quotes", nil)
+	server, err := conn.Channel(strongrabbit.Consumer, "quotes-server")
+	assert.NoError(t, err)
+	go server.ServeRPC(context.Background(), &strongrabbit.ConsumeOpts{Queue: "quotes"},
+		func(d amqp.Delivery) (amqp.Publishing, error) {
+			if len(d.Body) == 0 {
+				return amqp.Publishing{}, errors.New("empty request")
+			}
+			return amqp.Publishing{Body: append(d.Body, []byte(": 10")...)}, nil
+		}, 2)
+	eventually(t, 5*time.Second, func() bool { return b.Consumers("quotes") == 1 })
+}
+
+func TestRetryAfterTheServerNamedQueueIsRenamed(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	assert.NoError(t, b.ExchangeDeclare("orders", Direct))
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Consumer, "orders-consumer")
+	assert.NoError(t, err)
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ch.QueueBind(q.Name, "created", "orders", false, nil))
+	assert.NoError(t, ch.DeclareRetry(q.Name, strongrabbit.RetryOpts{Delay: time.Minute, MaxAttempts: 3}))
+	opts := &strongrabbit.ConsumeOpts{Queue: q.Name}
+	go ch.ConsumeWithHandler(opts, func(amqp.Delivery) strongrabbit.Decision {
+		return strongrabbit.Retry(errors.New("failed"))
+	}, 1)
+	eventually(t, 5*time.Second, func() bool { return b.Consumers(q.Name) == 1 })
+
+	// act
+	assert.True(t, b.DeleteQueue(q.Name))
+	// routed once the queue is redeclared with a new name
+	eventually(t, 10*time.Second, func() bool {
+		routed, err := b.Publish("orders", "created", amqp.Publishing{Body: []byte("order")})
+		return err == nil && routed
+	})
+
+	// assert
+	eventually(t, 10*time.Second, func() bool { return b.QueueLen(strongrabbit.RetryQueueName(q.Name)) == 1 })
+	assert.Equal(t, q.Name, opts.Queue)
+}
+
+func TestRetriedMessagesAreAckedOnlyAfterTheConfirm(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Consumer, "orders-consumer")
+	assert.NoError(t, err)
+	assert.NoError(t, ch.DeclareRetry("orders", strongrabbit.RetryOpts{Delay: 200 * time.Millisecond, MaxAttempts: 1}))
+	var handled atomic.Int32
+	go ch.ConsumeWithHandler(&strongrabbit.ConsumeOpts{Queue: "orders"}, func(amqp.Delivery) strongrabbit.Decision {
+		handled.Add(1)
+		return strongrabbit.Retry(errors.New("failed"))
+	}, 1)
+	b.NackPublishes(true)
+
+	// act
+	_, err = b.Publish("", "orders", amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+	eventually(t, 5*time.Second, func() bool { return handled.Load() == 1 })
+	time.Sleep(100 * time.Millisecond)
+	unacked, retrying, attempts := b.Unacked("orders"), b.QueueLen(strongrabbit.RetryQueueName("orders")), handled.Load()
+	b.NackPublishes(false)
+
+	// assert
+	assert.Equal(t, 1, unacked)
+	assert.Equal(t, 0, retrying)
+	assert.Equal(t, int32(1), attempts)
+	eventually(t, 10*time.Second, func() bool { return b.QueueLen(strongrabbit.ParkingLotQueueName("orders")) == 1 })
+	assert.Equal(t, 0, b.Unacked("orders"))
+	assert.Equal(t, 0, b.QueueLen("orders"))
+}
+
+func TestPublisherPoolCloseIsIdempotent(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn := connect(t, b)
+	pool, err := conn.PublisherPool("orders", strongrabbit.PoolOpts{Size: 2})
+	assert.NoError(t, err)
+
+	// act
+	first, second := pool.Close(), pool.Close()
+
+	// assert
+	assert.NoError(t, first)
+	assert.NoError(t, second)
+	assert.Equal(t, 0, b.Channels())
+}
+
+func TestPublisherPoolPublishesWithDeferredConfirm(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	pool, err := conn.PublisherPool("orders", strongrabbit.PoolOpts{Size: 2})
+	assert.NoError(t, err)
+	t.Cleanup(func() { pool.Close() })
+
+	// act
+	for i := 0; i < 2; i++ {
+		_, err = pool.PublishWithDeferredConfirmWithContext(context.Background(), "", "orders", false, false,
+			amqp.Publishing{Body: []byte("order")})
+		assert.NoError(t, err)
+	}
+
+	// assert
+	eventually(t, 5*time.Second, func() bool { return b.QueueLen("orders") == 2 })
+}
+
+func TestRPCCall(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn := connect(t, b)
+	serveQuotes(t, b, conn)
+	ch, err := conn.Channel(strongrabbit.Publisher, "quotes-client")
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Confirm(false))
+	client, err := strongrabbit.NewRPCClient(ch)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// act
+	reply, err := client.Call(ctx, "", "quotes", amqp.Publishing{Body: []byte("order 1")})
+	_, failed := client.Call(ctx, "", "quotes", amqp.Publishing{})
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, "order 1: 10", string(reply.Body))
+	var rpcErr *strongrabbit.RPCError
+	assert.True(t, errors.As(failed, &rpcErr))
+	assert.Equal(t, "empty request", rpcErr.Message)
+	assert.NoError(t, client.Close())
+	assert.NoError(t, client.Close())
+}
+
+func TestRPCCallTimesOut(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("quotes", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "quotes-client")
+	assert.NoError(t, err)
+	client, err := strongrabbit.NewRPCClient(ch)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// act
+	_, err = client.Call(ctx, "", "quotes", amqp.Publishing{Body: []byte("order 1")})
+
+	// assert
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 1, b.QueueLen("quotes"))
+}
+
+func TestRPCPendingCallsAreInterruptedByTheReconnection(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("quotes", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "quotes-client")
+	assert.NoError(t, err)
+	client, err := strongrabbit.NewRPCClient(ch)
+	assert.NoError(t, err)
+	called := make(chan error)
+	go func() {
+		_, err := client.Call(context.Background(), "", "quotes", amqp.Publishing{Body: []byte("order 1")})
+		called <- err
+	}()
+	eventually(t, 5*time.Second, func() bool { return b.QueueLen("quotes") == 1 })
+
+	// act
+	b.CloseChannels(amqp.InternalError, "INTERNAL_ERROR - injected")
+
+	// assert
+	select {
+	case err := <-called:
+		assert.True(t, errors.Is(err, strongrabbit.ErrRPCInterrupted))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the call was not interrupted")
+	}
+	eventually(t, 10*time.Second, func() bool { return ch.Stats().Reconnects == 1 })
+	serveQuotes(t, b, conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := client.Call(ctx, "", "quotes", amqp.Publishing{Body: []byte("order 2")})
+	assert.NoError(t, err)
+	assert.Equal(t, "order 2: 10", string(reply.Body))
+}
+
+// consumeBlocked consumes the orders queue with a handler that
+// signals it started and waits for the release to ack
+func consumeBlocked(t *testing.T, conn *strongrabbit.StrongConnection) (ch *strongrabbit.StrongChannel, started, release chan struct{}) {
+	ch, err := conn.Channel(strongrabbit.Consumer, "orders-consumer")
+	assert.NoError(t, err)
+	started = make(chan struct{}, 10)
+	release = make(chan struct{})
+	go ch.ConsumeWithHandler(&strongrabbit.ConsumeOpts{Queue: "orders"}, func(d amqp.Delivery) strongrabbit.Decision {
+		started <- struct{}{}
+		<-release
+		return strongrabbit.Ack
+	}, 1)
+	return ch, started, release
+}
+
+func TestShutdownWaitsForTheInFlightDeliveries(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, started, release := consumeBlocked(t, conn)
+	eventually(t, 5*time.Second, func() bool { return b.Consumers("orders") == 1 })
+	_, err := b.Publish("", "orders", amqp.Publishing{Body: []byte("first")})
+	assert.NoError(t, err)
+	<-started
+
+	// act
+	shutdown := make(chan error)
+	go func() { shutdown <- ch.Shutdown(context.Background()) }()
+	eventually(t, 5*time.Second, func() bool { return b.Consumers("orders") == 0 })
+	_, err = b.Publish("", "orders", amqp.Publishing{Body: []byte("second")})
+	assert.NoError(t, err)
+	close(release)
+
+	// assert
+	assert.NoError(t, <-shutdown)
+	assert.True(t, ch.Stopped())
+	assert.Equal(t, 0, b.Unacked("orders"))
+	assert.Equal(t, 1, b.QueueLen("orders"))
+	assert.Equal(t, 0, len(started))
+}
+
+func TestShutdownWaitsForThePublishConfirms(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher",
+		strongrabbit.WithPublishBuffer(strongrabbit.BufferOpts{Size: 10}))
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Confirm(false))
+	b.RefuseConnections(true)
+	b.DropConnections()
+	eventually(t, 5*time.Second, func() bool { return b.Connections() == 0 })
+	confirmation, err := ch.PublishConfirmed(context.Background(), "", "orders", false, false, amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+
+	// act
+	shutdown := make(chan error)
+	go func() { shutdown <- ch.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	b.RefuseConnections(false)
+
+	// assert
+	assert.NoError(t, <-shutdown)
+	assert.True(t, confirmation.Wait())
+	assert.Equal(t, 1, b.QueueLen("orders"))
+}
+
+func TestShutdownClosesTheChannelWhenTheContextIsDone(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, started, release := consumeBlocked(t, conn)
+	eventually(t, 5*time.Second, func() bool { return b.Consumers("orders") == 1 })
+	_, err := b.Publish("", "orders", amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// act
+	err = ch.Shutdown(ctx)
+	close(release)
+
+	// assert
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	eventually(t, 5*time.Second, func() bool { return b.QueueLen("orders") == 1 })
+}
+
+// healthStatus returns the status code of the HealthHandler
+func healthStatus() int {
+	rec := httptest.NewRecorder()
+	strongrabbit.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	return rec.Code
+}
+
+func TestStateFollowsTheReconnection(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	connStates := conn.NotifyState(make(chan strongrabbit.State, 10))
+	chStates := ch.NotifyState(make(chan strongrabbit.State, 10))
+	assert.Equal(t, http.StatusOK, healthStatus())
+
+	// act
+	b.RefuseConnections(true)
+	b.DropConnections()
+	eventually(t, 5*time.Second, func() bool {
+		return conn.State() == strongrabbit.Recovering && ch.State() == strongrabbit.Recovering
+	})
+	recovering := healthStatus()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	waitErr := ch.WaitReady(ctx)
+	b.RefuseConnections(false)
+
+	// assert
+	assert.Equal(t, http.StatusServiceUnavailable, recovering)
+	assert.True(t, errors.Is(waitErr, context.DeadlineExceeded))
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, conn.WaitReady(ctx))
+	assert.NoError(t, ch.WaitReady(ctx))
+	assert.Equal(t, http.StatusOK, healthStatus())
+	expected := []strongrabbit.State{strongrabbit.Ready, strongrabbit.Recovering, strongrabbit.Ready}
+	for _, states := range []chan strongrabbit.State{connStates, chStates} {
+		for _, s := range expected {
+			assert.Equal(t, s, <-states)
+		}
+	}
+}
+
+func TestStateIsFailedWhenTheReconnectionGivesUp(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn, err := strongrabbit.Connect(b.URL(), t.Name(), strongrabbit.WithDialer(b.Dial),
+		strongrabbit.WithReconnectPolicy(strongrabbit.ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxAttempts: 1}))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	assert.False(t, ch.Stopped())
+
+	// act
+	b.RefuseConnections(true)
+	b.DropConnections()
+	eventually(t, 5*time.Second, func() bool { return conn.State() != strongrabbit.Ready })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = conn.WaitReady(ctx)
+
+	// assert
+	assert.True(t, errors.Is(err, strongrabbit.ErrReconnectGaveUp))
+	assert.Equal(t, strongrabbit.Failed, conn.State())
+	assert.Equal(t, http.StatusServiceUnavailable, healthStatus())
+	eventually(t, 5*time.Second, ch.Stopped)
+	assert.NoError(t, conn.Close())
+	assert.Equal(t, strongrabbit.Failed, conn.State())
+}
+
+// publishReturns opens a confirm mode publisher whose returns go to the returned chan
+func publishReturns(t *testing.T, conn *strongrabbit.StrongConnection) (ch *strongrabbit.StrongChannel, returned chan amqp.Return) {
+	returned = make(chan amqp.Return, 10)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher",
+		strongrabbit.WithReturnHandler(func(r amqp.Return) { returned <- r }))
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Confirm(false))
+	return ch, returned
+}
+
+func TestUnroutableMandatoryPublishesAreReturned(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, returned := publishReturns(t, conn)
+
+	// act
+	unroutable, err := ch.PublishConfirmed(context.Background(), "", "payments", true, false, amqp.Publishing{Body: []byte("payment")})
+	assert.NoError(t, err)
+	delivered, err := ch.PublishConfirmed(context.Background(), "", "orders", true, false, amqp.Publishing{Body: []byte("order")})
+	assert.NoError(t, err)
+
+	// assert
+	assert.True(t, unroutable.Wait())
+	r, ok := unroutable.Returned()
+	assert.True(t, ok)
+	assert.Equal(t, uint16(amqp.NoRoute), r.ReplyCode)
+	assert.Equal(t, "payment", string(r.Body))
+	assert.True(t, delivered.Wait())
+	_, ok = delivered.Returned()
+	assert.False(t, ok)
+	assert.Equal(t, "payments", (<-returned).RoutingKey)
+	assert.Equal(t, 1, b.QueueLen("orders"))
+}
+
+func TestReturnsAreHandledAfterTheReconnection(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn := connect(t, b)
+	ch, returned := publishReturns(t, conn)
+
+	// act
+	b.DropConnections()
+	eventually(t, 10*time.Second, func() bool { return ch.Stats().Reconnects == 1 })
+	confirmation, err := ch.PublishConfirmed(context.Background(), "", "payments", true, false, amqp.Publishing{Body: []byte("payment")})
+
+	// assert
+	assert.NoError(t, err)
+	assert.True(t, confirmation.Wait())
+	_, ok := confirmation.Returned()
+	assert.True(t, ok)
+	select {
+	case r := <-returned:
+		assert.Equal(t, "payments", r.RoutingKey)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the return was not handled")
+	}
+}
+
+// orderBatch returns a batch of orders published on the orders queue
+func orderBatch(size int) []strongrabbit.BatchMessage {
+	msgs := make([]strongrabbit.BatchMessage, size)
+	for i := range msgs {
+		msgs[i] = strongrabbit.BatchMessage{Key: "orders", Msg: amqp.Publishing{Body: []byte("order")}}
+	}
+	return msgs
+}
+
+// publishBatch publishes the batch on another go routine, sending its outcome to the chan
+func publishBatch(ch *strongrabbit.StrongChannel, msgs []strongrabbit.BatchMessage) chan []strongrabbit.BatchResult {
+	published := make(chan []strongrabbit.BatchResult, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		results, _ := ch.PublishBatch(ctx, msgs, strongrabbit.BatchOpts{RetryDelay: 200 * time.Millisecond})
+		published <- results
+	}()
+	return published
+}
+
+func TestDeferredConfirmPublishFollowsTheBlockedPolicy(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher",
+		strongrabbit.WithBlockedPolicy(strongrabbit.FailWhileBlocked))
+	assert.NoError(t, err)
+	b.Block("low on memory")
+	eventually(t, 5*time.Second, func() bool { blocked, _ := conn.Blocked(); return blocked })
+
+	// act
+	_, blockedErr := ch.PublishWithDeferredConfirmWithContext(context.Background(), "", "orders", false, false,
+		amqp.Publishing{Body: []byte("blocked")})
+	b.Unblock()
+	eventually(t, 5*time.Second, func() bool { blocked, _ := conn.Blocked(); return !blocked })
+	_, err = ch.PublishWithDeferredConfirmWithContext(context.Background(), "", "orders", false, false,
+		amqp.Publishing{Body: []byte("order")})
+
+	// assert
+	assert.True(t, errors.Is(blockedErr, strongrabbit.ErrBlocked))
+	assert.NoError(t, err)
+	eventually(t, 5*time.Second, func() bool { return b.QueueLen("orders") == 1 })
+	assert.Equal(t, uint64(1), ch.Stats().Published)
+}
+
+func TestPublishBatchRetriesTheNackedMessages(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Confirm(false))
+	b.NackPublishes(true)
+
+	// act
+	published := publishBatch(ch, orderBatch(3))
+	eventually(t, 5*time.Second, func() bool { return ch.Stats().Nacks == 3 })
+	b.NackPublishes(false)
+
+	// assert
+	for _, r := range <-published {
+		assert.True(t, r.Acked)
+		assert.Equal(t, 2, r.Attempts)
+	}
+	assert.Equal(t, 3, b.QueueLen("orders"))
+}
+
+func TestPublishBatchWhileReconnecting(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.QueueDeclare("orders", nil)
+	conn := connect(t, b)
+	ch, err := conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Confirm(false))
+	b.RefuseConnections(true)
+	b.DropConnections()
+	eventually(t, 5*time.Second, func() bool { return ch.State() == strongrabbit.Recovering })
+
+	// act
+	published := publishBatch(ch, orderBatch(3))
+	time.Sleep(50 * time.Millisecond)
+	b.RefuseConnections(false)
+
+	// assert
+	for _, r := range <-published {
+		assert.True(t, r.Acked)
+		assert.Equal(t, 2, r.Attempts)
+	}
+	assert.Equal(t, 3, b.QueueLen("orders"))
+}
+
+// eventRecorder records the events received by each callback
+type eventRecorder struct {
+	lock   sync.Mutex
+	events map[string][]strongrabbit.Event
+}
+
+// opts returns the callbacks recording the events, logging to the logger
+func (r *eventRecorder) opts(logger strongrabbit.Logger) strongrabbit.EventOpts {
+	record := func(name string) func(strongrabbit.Event) {
+		return func(e strongrabbit.Event) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if r.events == nil {
+				r.events = make(map[string][]strongrabbit.Event)
+			}
+			r.events[name] = append(r.events[name], e)
+		}
+	}
+	return strongrabbit.EventOpts{
+		Logger:             logger,
+		OnDisconnect:       record("disconnect"),
+		OnReconnectAttempt: record("attempt"),
+		OnReconnected:      record("reconnected"),
+		OnGiveUp:           record("give up"),
+		OnClosed:           record("closed"),
+	}
+}
+
+// get returns the events received by the callback, of the connection
+// if channel is empty or of the named channel otherwise
+func (r *eventRecorder) get(name, channel string) []strongrabbit.Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var events []strongrabbit.Event
+	for _, e := range r.events[name] {
+		if e.Channel == channel {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// recordingLogger keeps the messages logged on each level
+type recordingLogger struct {
+	lock    sync.Mutex
+	records []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.record("DEBUG", msg) }
+func (l *recordingLogger) Info(msg string, args ...any)  { l.record("INFO", msg) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.record("WARN", msg) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.record("ERROR", msg) }
+
+func (l *recordingLogger) record(level, msg string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.records = append(l.records, level+" "+msg)
+}
+
+// logged reports if the message was logged on the level
+func (l *recordingLogger) logged(level, msg string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, r := range l.records {
+		if r == level+" "+msg {
+			return true
+		}
+	}
+	return false
+}
+
+// connectWithEvents opens a StrongConnection, with a publisher channel,
+// recording their events and logs. The standard log output is captured.
+func connectWithEvents(t *testing.T, b *Broker, policy strongrabbit.ReconnectPolicy) (*strongrabbit.StrongConnection, *eventRecorder, *recordingLogger, *bytes.Buffer) {
+	var std bytes.Buffer
+	log.SetOutput(&std)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	events, logger := &eventRecorder{}, &recordingLogger{}
+	conn, err := strongrabbit.Connect(b.URL(), t.Name(), strongrabbit.WithDialer(b.Dial),
+		strongrabbit.WithReconnectPolicy(policy), strongrabbit.WithEvents(events.opts(logger)))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Channel(strongrabbit.Publisher, "orders-publisher")
+	assert.NoError(t, err)
+	return conn, events, logger, &std
+}
+
+func TestEventsOfTheReconnection(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn, events, logger, std := connectWithEvents(t, b, fastReconnect)
+
+	// act
+	b.DropConnections()
+	eventually(t, 10*time.Second, func() bool { return len(events.get("reconnected", "orders-publisher")) == 1 })
+
+	// assert
+	disconnect := events.get("disconnect", "")
+	assert.Equal(t, 1, len(disconnect))
+	assert.Equal(t, t.Name(), disconnect[0].Group)
+	assert.Error(t, disconnect[0].Err)
+	attempts := events.get("attempt", "")
+	assert.Equal(t, 1, len(attempts))
+	assert.Equal(t, 1, attempts[0].Attempt)
+	reconnected := events.get("reconnected", "")
+	assert.Equal(t, 1, len(reconnected))
+	assert.Equal(t, t.Name(), reconnected[0].Group)
+	assert.Equal(t, conn.Node(), reconnected[0].Node)
+	chDisconnect := events.get("disconnect", "orders-publisher")
+	assert.Equal(t, 1, len(chDisconnect))
+	assert.Equal(t, t.Name(), chDisconnect[0].Group)
+	assert.Error(t, chDisconnect[0].Err)
+	chReconnected := events.get("reconnected", "orders-publisher")
+	assert.Equal(t, t.Name(), chReconnected[0].Group)
+	assert.NoError(t, chReconnected[0].Err)
+	assert.Equal(t, 0, len(events.get("give up", "")))
+	assert.True(t, logger.logged("WARN", "connection lost"))
+	assert.True(t, logger.logged("INFO", "reconnected"))
+	assert.Equal(t, 0, std.Len())
+}
+
+func TestEventsOfTheGiveUp(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	_, events, logger, std := connectWithEvents(t, b, strongrabbit.ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxAttempts: 1})
+
+	// act
+	b.RefuseConnections(true)
+	b.DropConnections()
+	eventually(t, 10*time.Second, func() bool { return len(events.get("give up", "orders-publisher")) == 1 })
+
+	// assert
+	giveUp := events.get("give up", "")
+	assert.Equal(t, 1, len(giveUp))
+	assert.Equal(t, t.Name(), giveUp[0].Group)
+	assert.True(t, errors.Is(giveUp[0].Err, strongrabbit.ErrReconnectGaveUp))
+	assert.Equal(t, 1, len(events.get("attempt", "")))
+	chGiveUp := events.get("give up", "orders-publisher")
+	assert.Equal(t, t.Name(), chGiveUp[0].Group)
+	assert.True(t, errors.Is(chGiveUp[0].Err, strongrabbit.ErrReconnectGaveUp))
+	assert.Equal(t, 0, len(events.get("reconnected", "")))
+	assert.True(t, logger.logged("ERROR", "connection will not reconnect"))
+	assert.True(t, logger.logged("ERROR", "channel will not reconnect"))
+	assert.Equal(t, 0, std.Len())
+}
+
+func TestEventsOfTheClose(t *testing.T) {
+	// arrange
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	conn, events, logger, std := connectWithEvents(t, b, fastReconnect)
+
+	// act
+	assert.NoError(t, conn.Close())
+
+	// assert
+	closed := events.get("closed", "")
+	assert.Equal(t, 1, len(closed))
+	assert.Equal(t, t.Name(), closed[0].Group)
+	assert.NoError(t, closed[0].Err)
+	chClosed := events.get("closed", "orders-publisher")
+	assert.Equal(t, 1, len(chClosed))
+	assert.Equal(t, t.Name(), chClosed[0].Group)
+	assert.Equal(t, 0, len(events.get("disconnect", "")))
+	assert.Equal(t, 0, len(events.get("disconnect", "orders-publisher")))
+	assert.True(t, logger.logged("INFO", "connection closed"))
+	assert.True(t, logger.logged("INFO", "channel stopped"))
+	assert.Equal(t, 0, std.Len())
+}
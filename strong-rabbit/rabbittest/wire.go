@@ -0,0 +1,566 @@
+package rabbittest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+
+	frameMax   = 131072
+	channelMax = 2047
+)
+
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+var (
+	errFrameEnd   = errors.New("frame without the frame end octet")
+	errFrameSize  = errors.New("frame above the negotiated size")
+	errShortFrame = errors.New("frame payload shorter than its fields")
+)
+
+// method ids, the class id on the upper half and the method id on the lower
+const (
+	connectionStart     = 10<<16 | 10
+	connectionStartOk   = 10<<16 | 11
+	connectionTune      = 10<<16 | 30
+	connectionTuneOk    = 10<<16 | 31
+	connectionOpen      = 10<<16 | 40
+	connectionOpenOk    = 10<<16 | 41
+	connectionClose     = 10<<16 | 50
+	connectionCloseOk   = 10<<16 | 51
+	connectionBlocked   = 10<<16 | 60
+	connectionUnblocked = 10<<16 | 61
+
+	channelOpen    = 20<<16 | 10
+	channelOpenOk  = 20<<16 | 11
+	channelFlow    = 20<<16 | 20
+	channelFlowOk  = 20<<16 | 21
+	channelClose   = 20<<16 | 40
+	channelCloseOk = 20<<16 | 41
+
+	exchangeDeclare   = 40<<16 | 10
+	exchangeDeclareOk = 40<<16 | 11
+	exchangeDelete    = 40<<16 | 20
+	exchangeDeleteOk  = 40<<16 | 21
+	exchangeBind      = 40<<16 | 30
+	exchangeBindOk    = 40<<16 | 31
+	exchangeUnbind    = 40<<16 | 40
+	exchangeUnbindOk  = 40<<16 | 51
+
+	queueDeclare   = 50<<16 | 10
+	queueDeclareOk = 50<<16 | 11
+	queueBind      = 50<<16 | 20
+	queueBindOk    = 50<<16 | 21
+	queuePurge     = 50<<16 | 30
+	queuePurgeOk   = 50<<16 | 31
+	queueDelete    = 50<<16 | 40
+	queueDeleteOk  = 50<<16 | 41
+	queueUnbind    = 50<<16 | 50
+	queueUnbindOk  = 50<<16 | 51
+
+	basicQos       = 60<<16 | 10
+	basicQosOk     = 60<<16 | 11
+	basicConsume   = 60<<16 | 20
+	basicConsumeOk = 60<<16 | 21
+	basicCancel    = 60<<16 | 30
+	basicCancelOk  = 60<<16 | 31
+	basicPublish   = 60<<16 | 40
+	basicReturn    = 60<<16 | 50
+	basicDeliver   = 60<<16 | 60
+	basicGet       = 60<<16 | 70
+	basicGetOk     = 60<<16 | 71
+	basicGetEmpty  = 60<<16 | 72
+	basicAck       = 60<<16 | 80
+	basicReject    = 60<<16 | 90
+	basicRecover   = 60<<16 | 110
+	basicRecoverOk = 60<<16 | 111
+	basicNack      = 60<<16 | 120
+
+	confirmSelect   = 85<<16 | 10
+	confirmSelectOk = 85<<16 | 11
+)
+
+// content header property flags
+const (
+	flagContentType     = 0x8000
+	flagContentEncoding = 0x4000
+	flagHeaders         = 0x2000
+	flagDeliveryMode    = 0x1000
+	flagPriority        = 0x0800
+	flagCorrelationID   = 0x0400
+	flagReplyTo         = 0x0200
+	flagExpiration      = 0x0100
+	flagMessageID       = 0x0080
+	flagTimestamp       = 0x0040
+	flagType            = 0x0020
+	flagUserID          = 0x0010
+	flagAppID           = 0x0008
+)
+
+// frame is a frame read from the client
+type frame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+// readFrame reads a frame, rejecting the ones above the max size
+func readFrame(r io.Reader) (frame, error) {
+	var head [7]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{kind: head[0], channel: binary.BigEndian.Uint16(head[1:3])}
+	size := binary.BigEndian.Uint32(head[3:7])
+	if size > frameMax {
+		return frame{}, errFrameSize
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+	if payload[size] != frameEnd {
+		return frame{}, errFrameEnd
+	}
+	f.payload = payload[:size]
+	return f, nil
+}
+
+// encodeFrame returns the bytes of a frame
+func encodeFrame(kind byte, channel uint16, payload []byte) []byte {
+	buf := make([]byte, 7, len(payload)+8)
+	buf[0] = kind
+	binary.BigEndian.PutUint16(buf[1:3], channel)
+	binary.BigEndian.PutUint32(buf[3:7], uint32(len(payload)))
+	buf = append(buf, payload...)
+	return append(buf, frameEnd)
+}
+
+var heartbeatFrame = encodeFrame(frameHeartbeat, 0, nil)
+
+// decoder reads the fields of a frame payload, the first
+// error is kept and the following reads return zero values
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err == nil && len(d.buf) < n {
+		d.err = errShortFrame
+	}
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) octet() byte {
+	return d.take(1)[0]
+}
+
+func (d *decoder) short() uint16 {
+	return binary.BigEndian.Uint16(d.take(2))
+}
+
+func (d *decoder) long() uint32 {
+	return binary.BigEndian.Uint32(d.take(4))
+}
+
+func (d *decoder) longlong() uint64 {
+	return binary.BigEndian.Uint64(d.take(8))
+}
+
+func (d *decoder) shortstr() string {
+	return string(d.take(int(d.octet())))
+}
+
+func (d *decoder) longstr() string {
+	return string(d.take(int(d.long())))
+}
+
+// method reads the class and method ids
+func (d *decoder) method() uint32 {
+	class := d.short()
+	return uint32(class)<<16 | uint32(d.short())
+}
+
+func (d *decoder) table() amqp.Table {
+	size := d.long()
+	if d.err == nil && uint32(len(d.buf)) < size {
+		d.err = errShortFrame
+	}
+	if d.err != nil {
+		return nil
+	}
+	fields := &decoder{buf: d.take(int(size))}
+	t := amqp.Table{}
+	for len(fields.buf) > 0 && fields.err == nil {
+		key := fields.shortstr()
+		t[key] = fields.field()
+	}
+	d.err = fields.err
+	return t
+}
+
+func (d *decoder) array() []interface{} {
+	size := d.long()
+	if d.err == nil && uint32(len(d.buf)) < size {
+		d.err = errShortFrame
+	}
+	if d.err != nil {
+		return nil
+	}
+	fields := &decoder{buf: d.take(int(size))}
+	a := []interface{}{}
+	for len(fields.buf) > 0 && fields.err == nil {
+		a = append(a, fields.field())
+	}
+	d.err = fields.err
+	return a
+}
+
+// field reads a table value, with the same types used by the amqp library
+func (d *decoder) field() interface{} {
+	switch kind := d.octet(); kind {
+	case 't':
+		return d.octet() != 0
+	case 'B':
+		return d.octet()
+	case 'b':
+		return int8(d.octet())
+	case 's':
+		return int16(d.short())
+	case 'I':
+		return int32(d.long())
+	case 'l':
+		return int64(d.longlong())
+	case 'f':
+		return math.Float32frombits(d.long())
+	case 'd':
+		return math.Float64frombits(d.longlong())
+	case 'D':
+		scale := d.octet()
+		return amqp.Decimal{Scale: scale, Value: int32(d.long())}
+	case 'S':
+		return d.longstr()
+	case 'A':
+		return d.array()
+	case 'T':
+		return time.Unix(int64(d.longlong()), 0)
+	case 'F':
+		return d.table()
+	case 'x':
+		return append([]byte(nil), d.take(int(d.long()))...)
+	case 'V':
+		return nil
+	default:
+		if d.err == nil {
+			d.err = errors.New("unknown field type " + string(kind))
+		}
+		return nil
+	}
+}
+
+// properties reads the content header properties of a message
+func (d *decoder) properties() amqp.Publishing {
+	var p amqp.Publishing
+	flags := d.short()
+	if flags&flagContentType != 0 {
+		p.ContentType = d.shortstr()
+	}
+	if flags&flagContentEncoding != 0 {
+		p.ContentEncoding = d.shortstr()
+	}
+	if flags&flagHeaders != 0 {
+		p.Headers = d.table()
+	}
+	if flags&flagDeliveryMode != 0 {
+		p.DeliveryMode = d.octet()
+	}
+	if flags&flagPriority != 0 {
+		p.Priority = d.octet()
+	}
+	if flags&flagCorrelationID != 0 {
+		p.CorrelationId = d.shortstr()
+	}
+	if flags&flagReplyTo != 0 {
+		p.ReplyTo = d.shortstr()
+	}
+	if flags&flagExpiration != 0 {
+		p.Expiration = d.shortstr()
+	}
+	if flags&flagMessageID != 0 {
+		p.MessageId = d.shortstr()
+	}
+	if flags&flagTimestamp != 0 {
+		p.Timestamp = time.Unix(int64(d.longlong()), 0)
+	}
+	if flags&flagType != 0 {
+		p.Type = d.shortstr()
+	}
+	if flags&flagUserID != 0 {
+		p.UserId = d.shortstr()
+	}
+	if flags&flagAppID != 0 {
+		p.AppId = d.shortstr()
+	}
+	return p
+}
+
+// encoder writes the fields of a frame payload
+type encoder struct {
+	buf []byte
+}
+
+// newMethod starts the payload of a method frame
+func newMethod(id uint32) *encoder {
+	e := &encoder{}
+	e.long(id)
+	return e
+}
+
+// frame returns the method frame of the payload
+func (e *encoder) frame(channel uint16) []byte {
+	return encodeFrame(frameMethod, channel, e.buf)
+}
+
+func (e *encoder) octet(v byte) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) bits(bits ...bool) {
+	var v byte
+	for i, set := range bits {
+		if set {
+			v |= 1 << i
+		}
+	}
+	e.octet(v)
+}
+
+func (e *encoder) short(v uint16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) long(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) longlong(v uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) shortstr(s string) {
+	if len(s) > math.MaxUint8 {
+		s = s[:math.MaxUint8]
+	}
+	e.octet(byte(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) longstr(s string) {
+	e.long(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// sized writes the size of what's written by fn before it
+func (e *encoder) sized(fn func()) {
+	start := len(e.buf)
+	e.long(0)
+	fn()
+	binary.BigEndian.PutUint32(e.buf[start:], uint32(len(e.buf)-start-4))
+}
+
+func (e *encoder) table(t amqp.Table) {
+	e.sized(func() {
+		for key, v := range t {
+			e.shortstr(key)
+			e.field(v)
+		}
+	})
+}
+
+// field writes a table value, the values are decoded from the
+// clients or set by the broker so all their types are known
+func (e *encoder) field(v interface{}) {
+	switch v := v.(type) {
+	case bool:
+		e.octet('t')
+		if v {
+			e.octet(1)
+		} else {
+			e.octet(0)
+		}
+	case byte:
+		e.octet('B')
+		e.octet(v)
+	case int8:
+		e.octet('b')
+		e.octet(byte(v))
+	case int16:
+		e.octet('s')
+		e.short(uint16(v))
+	case int:
+		e.octet('I')
+		e.long(uint32(v))
+	case int32:
+		e.octet('I')
+		e.long(uint32(v))
+	case int64:
+		e.octet('l')
+		e.longlong(uint64(v))
+	case float32:
+		e.octet('f')
+		e.long(math.Float32bits(v))
+	case float64:
+		e.octet('d')
+		e.longlong(math.Float64bits(v))
+	case amqp.Decimal:
+		e.octet('D')
+		e.octet(v.Scale)
+		e.long(uint32(v.Value))
+	case string:
+		e.octet('S')
+		e.longstr(v)
+	case []interface{}:
+		e.octet('A')
+		e.sized(func() {
+			for i := range v {
+				e.field(v[i])
+			}
+		})
+	case time.Time:
+		e.octet('T')
+		e.longlong(uint64(v.Unix()))
+	case amqp.Table:
+		e.octet('F')
+		e.table(v)
+	case []byte:
+		e.octet('x')
+		e.long(uint32(len(v)))
+		e.buf = append(e.buf, v...)
+	default:
+		e.octet('V')
+	}
+}
+
+// contentFrames returns the header and body frames of a message,
+// the body is split on frames of the max size
+func contentFrames(channel uint16, p amqp.Publishing) [][]byte {
+	e := &encoder{}
+	e.short(60) // basic class
+	e.short(0)  // weight
+	e.longlong(uint64(len(p.Body)))
+	e.properties(p)
+	frames := [][]byte{encodeFrame(frameHeader, channel, e.buf)}
+
+	body := p.Body
+	for len(body) > 0 {
+		n := len(body)
+		if n > frameMax-8 {
+			n = frameMax - 8
+		}
+		frames = append(frames, encodeFrame(frameBody, channel, body[:n]))
+		body = body[n:]
+	}
+	return frames
+}
+
+// properties writes the content header properties of a message
+func (e *encoder) properties(p amqp.Publishing) {
+	var flags uint16
+	if p.ContentType != "" {
+		flags |= flagContentType
+	}
+	if p.ContentEncoding != "" {
+		flags |= flagContentEncoding
+	}
+	if len(p.Headers) > 0 {
+		flags |= flagHeaders
+	}
+	if p.DeliveryMode > 0 {
+		flags |= flagDeliveryMode
+	}
+	if p.Priority > 0 {
+		flags |= flagPriority
+	}
+	if p.CorrelationId != "" {
+		flags |= flagCorrelationID
+	}
+	if p.ReplyTo != "" {
+		flags |= flagReplyTo
+	}
+	if p.Expiration != "" {
+		flags |= flagExpiration
+	}
+	if p.MessageId != "" {
+		flags |= flagMessageID
+	}
+	if !p.Timestamp.IsZero() {
+		flags |= flagTimestamp
+	}
+	if p.Type != "" {
+		flags |= flagType
+	}
+	if p.UserId != "" {
+		flags |= flagUserID
+	}
+	if p.AppId != "" {
+		flags |= flagAppID
+	}
+
+	e.short(flags)
+	if flags&flagContentType != 0 {
+		e.shortstr(p.ContentType)
+	}
+	if flags&flagContentEncoding != 0 {
+		e.shortstr(p.ContentEncoding)
+	}
+	if flags&flagHeaders != 0 {
+		e.table(p.Headers)
+	}
+	if flags&flagDeliveryMode != 0 {
+		e.octet(p.DeliveryMode)
+	}
+	if flags&flagPriority != 0 {
+		e.octet(p.Priority)
+	}
+	if flags&flagCorrelationID != 0 {
+		e.shortstr(p.CorrelationId)
+	}
+	if flags&flagReplyTo != 0 {
+		e.shortstr(p.ReplyTo)
+	}
+	if flags&flagExpiration != 0 {
+		e.shortstr(p.Expiration)
+	}
+	if flags&flagMessageID != 0 {
+		e.shortstr(p.MessageId)
+	}
+	if flags&flagTimestamp != 0 {
+		e.longlong(uint64(p.Timestamp.Unix()))
+	}
+	if flags&flagType != 0 {
+		e.shortstr(p.Type)
+	}
+	if flags&flagUserID != 0 {
+		e.shortstr(p.UserId)
+	}
+	if flags&flagAppID != 0 {
+		e.shortstr(p.AppId)
+	}
+}
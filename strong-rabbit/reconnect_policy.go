@@ -0,0 +1,78 @@
+package strongrabbit
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy controls how long to wait between reconnection
+// attempts and how many attempts are made before giving up.
+//
+// The delay starts at InitialDelay and it's multiplied by Multiplier
+// after each failed attempt, never going above MaxDelay. Jitter is the
+// fraction of the delay that is randomly added or removed, eg.: 0.2
+// makes a 10s delay be anything between 8s and 12s.
+// A MaxAttempts of zero retries forever.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	Jitter       float64
+	MaxAttempts  int
+}
+
+// DefaultReconnectPolicy retries forever every five seconds.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: time.Second * 5,
+	Multiplier:   1,
+	MaxDelay:     time.Second * 5,
+}
+
+// ErrReconnectGaveUp is returned when all the reconnection attempts
+// allowed by the ReconnectPolicy failed. The channel will not
+// try to reconnect again.
+var ErrReconnectGaveUp = errors.New("reconnection attempts exhausted")
+
+// delay returns how long to wait before the given attempt,
+// attempts start at 1
+func (p ReconnectPolicy) delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay)
+	for i := 1; i < attempt; i++ {
+		if p.Multiplier > 1 {
+			d *= p.Multiplier
+		}
+		if p.MaxDelay > 0 && d >= float64(p.MaxDelay) {
+			d = float64(p.MaxDelay)
+			break
+		}
+	}
+
+	if p.Jitter > 0 {
+		// spread the delay between [d - d*jitter, d + d*jitter]
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// exhausted reports if no more attempts are allowed after
+// the given number of failed attempts
+func (p ReconnectPolicy) exhausted(failedAttempts int) bool {
+	return p.MaxAttempts > 0 && failedAttempts >= p.MaxAttempts
+}
+
+// giveUpError wraps the last reconnection error with ErrReconnectGaveUp
+func giveUpError(err error) error {
+	if errors.Is(err, ErrReconnectGaveUp) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrReconnectGaveUp, err)
+}
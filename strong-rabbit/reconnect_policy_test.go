@@ -0,0 +1,60 @@
+package strongrabbit
+
+import (
+	"testing"
+	"time"
+
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+var reconnectDelayData = map[string]struct {
+	policy   ReconnectPolicy
+	attempt  int
+	expected time.Duration
+}{
+	"default policy keeps the delay": {
+		policy:   DefaultReconnectPolicy,
+		attempt:  10,
+		expected: time.Second * 5,
+	},
+	"first attempt uses the initial delay": {
+		policy:   ReconnectPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: time.Minute},
+		attempt:  1,
+		expected: time.Second,
+	},
+	"delay grows exponentially": {
+		policy:   ReconnectPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: time.Minute},
+		attempt:  4,
+		expected: time.Second * 8,
+	},
+	"delay is capped": {
+		policy:   ReconnectPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: time.Second * 10},
+		attempt:  50,
+		expected: time.Second * 10,
+	},
+}
+
+func TestReconnectDelay(t *testing.T) {
+	for name, data := range reconnectDelayData {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, data.expected, data.policy.delay(data.attempt))
+		})
+	}
+}
+
+func TestReconnectDelayJitter(t *testing.T) {
+	p := ReconnectPolicy{InitialDelay: time.Second * 10, Multiplier: 1, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		d := p.delay(1)
+		assert.True(t, d >= time.Second*8 && d <= time.Second*12, d.String())
+	}
+}
+
+func TestReconnectAttemptsExhausted(t *testing.T) {
+	assert.False(t, DefaultReconnectPolicy.exhausted(1000))
+
+	p := ReconnectPolicy{MaxAttempts: 3}
+	assert.False(t, p.exhausted(2))
+	assert.True(t, p.exhausted(3))
+}
@@ -0,0 +1,276 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// RetryAttemptsHeader is set on retried and parked messages with
+	// how many times the message failed.
+	RetryAttemptsHeader = "x-retry-attempts"
+	// RetryErrorHeader is set on retried and parked messages with the
+	// error returned by the last failed attempt.
+	RetryErrorHeader = "x-retry-error"
+	// RetryQueueHeader is set on parked messages with the queue the
+	// message was consumed from.
+	RetryQueueHeader = "x-retry-queue"
+)
+
+var (
+	errRetryNotDeclared = errors.New("retry is not declared for the queue")
+	errEmptyRetryQueue  = errors.New("retry queue name is empty")
+	errRetryNacked      = errors.New("message nacked by the broker")
+)
+
+// RetryOpts is a struct that encapsulates the settings used to retry
+// the failed deliveries of a queue.
+type RetryOpts struct {
+	Delay       time.Duration // how long a failed message waits before going back to the queue, defaults to 10s
+	MaxAttempts int           // how many times a message is retried before being parked, defaults to 3
+}
+
+// DefaultRetryOpts are the settings used for the zero fields of RetryOpts.
+var DefaultRetryOpts = RetryOpts{
+	Delay:       10 * time.Second,
+	MaxAttempts: 3,
+}
+
+// withDefaults fills the zero fields with the DefaultRetryOpts values
+func (r RetryOpts) withDefaults() RetryOpts {
+	if r.Delay <= 0 {
+		r.Delay = DefaultRetryOpts.Delay
+	}
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = DefaultRetryOpts.MaxAttempts
+	}
+	return r
+}
+
+// RetryQueueName returns the name of the queue where the failed
+// messages of the given queue wait to be retried.
+func RetryQueueName(queue string) string {
+	return queue + ".retry"
+}
+
+// ParkingLotQueueName returns the name of the queue where the messages
+// of the given queue go after running out of retries.
+func ParkingLotQueueName(queue string) string {
+	return queue + ".parking-lot"
+}
+
+// retryQueueArgs returns the arguments of the retry queue, the messages
+// expire after the delay and are dead-lettered back to the queue
+// through the default exchange
+func retryQueueArgs(queue string, delay time.Duration) amqp.Table {
+	return amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queue,
+	}
+}
+
+// DeclareRetry declares the retry queue and the parking-lot queue of the
+// given queue, enabling the Retry decision for the handlers consuming
+// from it on this channel.
+//
+// A retried message is sent to the retry queue and acknowledged. The retry
+// queue has no consumers, the message expires after the delay and is
+// dead-lettered back to the original queue. The attempts are counted using
+// the x-death header set by the broker. When the attempts run out, the
+// message is sent to the parking-lot queue with the RetryErrorHeader set.
+//
+// The messages are sent on a confirm mode Publisher channel opened on the
+// same connection, the delivery is only acknowledged after the broker
+// confirms the copy. If it cannot be sent, the delivery is requeued after
+// the retry delay.
+//
+// The queues are durable and, as any queue declared through the channel,
+// they are redeclared on reconnection.
+func (ch *StrongChannel) DeclareRetry(queue string, opts RetryOpts) error {
+	if queue == "" {
+		return errEmptyRetryQueue
+	}
+	opts = opts.withDefaults()
+
+	_, err := ch.QueueDeclare(RetryQueueName(queue), true, false, false, false, retryQueueArgs(queue, opts.Delay))
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(ParkingLotQueueName(queue), true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	ch.retryLock.Lock()
+	defer ch.retryLock.Unlock()
+	if ch.retryPub == nil {
+		pub, err := ch.conn.Channel(Publisher, ch.Name+"-retry")
+		if err != nil {
+			return err
+		}
+		if err = pub.Confirm(false); err != nil {
+			pub.Close()
+			return err
+		}
+		ch.retryPub = pub
+	}
+	if ch.retries == nil {
+		ch.retries = make(map[string]RetryOpts)
+	}
+	ch.retries[queue] = opts
+	return nil
+}
+
+// retryPublisher returns the channel the retried messages are published on
+func (ch *StrongChannel) retryPublisher() *StrongChannel {
+	ch.retryLock.RLock()
+	defer ch.retryLock.RUnlock()
+	return ch.retryPub
+}
+
+// closeRetryPublisher closes the channel the retried messages are
+// published on, it must be called after the handlers stop
+func (ch *StrongChannel) closeRetryPublisher() {
+	ch.retryLock.Lock()
+	pub := ch.retryPub
+	ch.retryPub = nil
+	ch.retryLock.Unlock()
+	if pub != nil {
+		pub.Close()
+	}
+}
+
+// retryOpts returns the retry settings declared for the queue
+func (ch *StrongChannel) retryOpts(queue string) (RetryOpts, bool) {
+	ch.retryLock.RLock()
+	defer ch.retryLock.RUnlock()
+	opts, ok := ch.retries[queue]
+	return opts, ok
+}
+
+// retry sends the delivery to the retry queue, or to the parking-lot queue
+// if the attempts run out, and acknowledges it after the broker confirms
+// the copy. If the message cannot be sent, the delivery is requeued after
+// the retry delay, or left to the broker if the channel closes meanwhile.
+func (ch *StrongChannel) retry(d amqp.Delivery, cause error) error {
+	// the opts are set before the deliveries arrive and not changed,
+	// the retries are declared for the name the consumer started with,
+	// it's kept when a server-named queue is renamed
+	queue := ch.opts.Queue
+	opts, ok := ch.retryOpts(queue)
+	if !ok {
+		// there is nowhere to send the message, let the
+		// queue dead-letter it if it's configured to
+		d.Nack(false, false)
+		return fmt.Errorf("%w: %q", errRetryNotDeclared, queue)
+	}
+
+	attempts := retryAttempts(d.Headers, RetryQueueName(queue)) + 1
+	target := RetryQueueName(queue)
+	msg := retryPublishing(d, attempts, cause)
+	if attempts > opts.MaxAttempts {
+		target = ParkingLotQueueName(queue)
+		msg.Headers[RetryQueueHeader] = queue
+		ch.logger().Warn("message parked", "channel", ch.Name, "queue", queue,
+			"attempts", attempts, "error", cause)
+	}
+
+	err := ch.publishRetry(target, msg)
+	if err != nil {
+		// wait before requeueing, to not loop while the
+		// queues or the publisher are not available
+		if wait(opts.Delay, ch.stopping) {
+			d.Nack(false, true)
+		}
+		return fmt.Errorf("cannot send the message to %q: %w", target, err)
+	}
+	return d.Ack(false)
+}
+
+// publishRetry publishes the message on the retry publisher and
+// waits for its confirmation
+func (ch *StrongChannel) publishRetry(target string, msg amqp.Publishing) error {
+	pub := ch.retryPublisher()
+	if pub == nil {
+		return errChannelClosed
+	}
+	confirmation, err := pub.PublishConfirmed(context.Background(), "", target, false, false, msg)
+	if err != nil {
+		return err
+	}
+
+	// stop waiting if the channel closes, the delivery
+	// is requeued by the broker
+	ctx, cancel := stopContext(ch.stopping)
+	defer cancel()
+	ack, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ack {
+		if err := confirmation.Err(); err != nil {
+			return err
+		}
+		return errRetryNacked
+	}
+	return nil
+}
+
+// retryAttempts returns how many times the message went through the
+// retry queue, using the x-death header set by the broker. The
+// RetryAttemptsHeader is used when it's higher, for brokers that
+// don't keep the x-death count of republished messages.
+func retryAttempts(headers amqp.Table, retryQueue string) int {
+	attempts := 0
+	deaths, _ := headers["x-death"].([]interface{})
+	for i := range deaths {
+		death, ok := deaths[i].(amqp.Table)
+		if !ok || death["queue"] != retryQueue {
+			continue
+		}
+		if count, ok := death["count"].(int64); ok {
+			attempts = int(count)
+		}
+		break
+	}
+
+	if previous, ok := headers[RetryAttemptsHeader].(int32); ok && int(previous) > attempts {
+		attempts = int(previous)
+	}
+	return attempts
+}
+
+// retryPublishing copies the delivery into a message to be published,
+// keeping the headers, including x-death, to count the attempts.
+// The expiration is dropped, it would cut the retry delay short
+func retryPublishing(d amqp.Delivery, attempts int, cause error) amqp.Publishing {
+	headers := make(amqp.Table, len(d.Headers)+3)
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[RetryAttemptsHeader] = int32(attempts)
+	if cause != nil {
+		headers[RetryErrorHeader] = cause.Error()
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
@@ -0,0 +1,110 @@
+package strongrabbit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+var retryAttemptsData = map[string]struct {
+	headers  amqp.Table
+	expected int
+}{
+	"first failure": {
+		headers:  nil,
+		expected: 0,
+	},
+	"x-death count of the retry queue": {
+		headers: amqp.Table{"x-death": []interface{}{
+			amqp.Table{"queue": "orders", "reason": "rejected", "count": int64(5)},
+			amqp.Table{"queue": "orders.retry", "reason": "expired", "count": int64(2)},
+		}},
+		expected: 2,
+	},
+	"x-death of other queues is ignored": {
+		headers: amqp.Table{"x-death": []interface{}{
+			amqp.Table{"queue": "payments.retry", "reason": "expired", "count": int64(4)},
+		}},
+		expected: 0,
+	},
+	"attempts header is used when higher": {
+		headers: amqp.Table{
+			RetryAttemptsHeader: int32(3),
+			"x-death": []interface{}{
+				amqp.Table{"queue": "orders.retry", "reason": "expired", "count": int64(1)},
+			},
+		},
+		expected: 3,
+	},
+}
+
+func TestRetryAttempts(t *testing.T) {
+	for name, data := range retryAttemptsData {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			// act
+			attempts := retryAttempts(data.headers, RetryQueueName("orders"))
+
+			// assert
+			assert.Equal(t, data.expected, attempts)
+		})
+	}
+}
+
+func TestRetryPublishingKeepsTheDelivery(t *testing.T) {
+	// arrange
+	deaths := []interface{}{amqp.Table{"queue": "orders.retry", "count": int64(1)}}
+	d := amqp.Delivery{
+		Headers:     amqp.Table{"x-death": deaths, "tenant": "a"},
+		ContentType: "application/json",
+		MessageId:   "42",
+		Expiration:  "100",
+		Body:        []byte("{}"),
+	}
+
+	// act
+	msg := retryPublishing(d, 2, errors.New("db is down"))
+
+	// assert
+	assert.Equal(t, amqp.Table{
+		"x-death":           deaths,
+		"tenant":            "a",
+		RetryAttemptsHeader: int32(2),
+		RetryErrorHeader:    "db is down",
+	}, msg.Headers)
+	assert.Equal(t, "application/json", msg.ContentType)
+	assert.Equal(t, "42", msg.MessageId)
+	assert.Equal(t, "", msg.Expiration)
+	assert.Equal(t, []byte("{}"), msg.Body)
+	// the delivery headers are not changed
+	assert.Equal(t, 2, len(d.Headers))
+}
+
+func TestRetryQueueDeadLettersBackToTheQueue(t *testing.T) {
+	// act
+	args := retryQueueArgs("orders", 1500*time.Millisecond)
+
+	// assert
+	assert.Equal(t, amqp.Table{
+		"x-message-ttl":             int64(1500),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "orders",
+	}, args)
+}
+
+func TestRetryWithoutDeclaringDropsTheDelivery(t *testing.T) {
+	// arrange
+	ch := &StrongChannel{Name: "test", opts: &ConsumeOpts{Queue: "orders"}, cfg: options{events: EventOpts{Logger: discardLogger{}}}}
+	ack := &acknowledgerRecorder{}
+
+	// act
+	ch.handle(amqp.Delivery{Acknowledger: ack}, func(amqp.Delivery) Decision {
+		return Retry(errors.New("failed"))
+	})
+
+	// assert
+	assert.Equal(t, "nack", ack.result)
+}
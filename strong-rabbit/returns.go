@@ -0,0 +1,22 @@
+package strongrabbit
+
+import amqp "github.com/rabbitmq/amqp091-go"
+
+// ReturnHandler receives the messages returned by the broker: the
+// mandatory ones that could not be routed to any queue and the
+// immediate ones that could not be delivered right away.
+type ReturnHandler func(r amqp.Return)
+
+// WithReturnHandler sets the handler of the messages returned to Publisher
+// channels. The returns are listened on every underlying channel, so the
+// handler keeps receiving them after the reconnections. It's called on
+// the go routine tracking the confirmations, it must not block. Without
+// a handler the returns are logged.
+//
+// On confirm mode, the Confirmation of a returned message also reports
+// it, check Confirmation.Returned.
+func WithReturnHandler(handler ReturnHandler) Option {
+	return func(o *options) {
+		o.returnHandler = handler
+	}
+}
@@ -0,0 +1,290 @@
+package strongrabbit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// DirectReplyTo is the RabbitMQ pseudo queue used to receive replies
+	// without declaring a queue. Messages published with it as ReplyTo are
+	// answered on the channel that published them.
+	DirectReplyTo = "amq.rabbitmq.reply-to"
+	// RPCErrorHeader is set on the replies of the requests whose RPCHandler
+	// failed, with the error message.
+	RPCErrorHeader = "x-rpc-error"
+)
+
+var (
+	// ErrRPCInterrupted is returned by the calls waiting for a reply when
+	// the channel reconnects, and by the calls made while it's reconnecting.
+	// The replies are lost with the underlying channel, the request may
+	// have been processed.
+	ErrRPCInterrupted = errors.New("rpc call interrupted by the channel reconnection")
+
+	errRPCClientClosed = errors.New("rpc client is closed")
+	errNilRPCHandler   = errors.New("rpc handler is nil")
+)
+
+// RPCError is returned by RPCClient.Call when the RPCHandler
+// of the server fails.
+type RPCError struct {
+	Message string // the error message of the handler
+}
+
+func (e *RPCError) Error() string {
+	return "rpc handler failed: " + e.Message
+}
+
+// rpcResult is the outcome of a call
+type rpcResult struct {
+	reply amqp.Delivery
+	err   error
+}
+
+// RPCClient makes request/reply calls over the direct reply-to, through
+// a Publisher StrongChannel. It's safe for concurrent use, the calls are
+// matched with their replies by the correlation id.
+//
+// The requests are not republished after a reconnection, the calls
+// waiting for a reply fail with ErrRPCInterrupted.
+type RPCClient struct {
+	ch       *StrongChannel
+	lock     sync.Mutex
+	replies  *amqp.Channel // the underlying channel consuming the replies
+	tag      string        // the consumer tag of the replies
+	pending  map[string]chan rpcResult
+	prefix   string // makes the correlation ids unique across clients
+	sequence uint64
+	closed   bool
+}
+
+// NewRPCClient creates a RPCClient publishing the requests on the
+// given Publisher channel. The replies consumer is started on the
+// first call, and again after each reconnection.
+func NewRPCClient(ch *StrongChannel) (*RPCClient, error) {
+	if ch.chType != Publisher {
+		return nil, errInvalidChannelType
+	}
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	return &RPCClient{
+		ch:      ch,
+		pending: make(map[string]chan rpcResult),
+		prefix:  hex.EncodeToString(prefix),
+	}, nil
+}
+
+// Call publishes the request and waits for its reply until the context
+// is done. The ReplyTo and CorrelationId of msg are overwritten.
+//
+// It returns an *RPCError if the server handler failed, ErrRPCInterrupted
+// if the channel reconnects before the reply arrives, and ctx.Err() if
+// the context is done first. Requests not routed to any queue are not
+// answered, the call waits for the context.
+func (c *RPCClient) Call(ctx context.Context, exchange, key string, msg amqp.Publishing) (amqp.Delivery, error) {
+	if ctx == nil {
+		return amqp.Delivery{}, errors.New("nil Context")
+	}
+	if err := ctx.Err(); err != nil {
+		return amqp.Delivery{}, err
+	}
+	if err := c.ch.conn.waitUnblocked(ctx, c.ch.cfg.blockedPolicy); err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	result := make(chan rpcResult, 1)
+	id, err := c.send(ctx, exchange, key, msg, result)
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return amqp.Delivery{}, r.err
+		}
+		if msg, ok := r.reply.Headers[RPCErrorHeader].(string); ok {
+			return r.reply, &RPCError{Message: msg}
+		}
+		return r.reply, nil
+	case <-ctx.Done():
+		c.forget(id)
+		return amqp.Delivery{}, ctx.Err()
+	}
+}
+
+// forget removes a pending call
+func (c *RPCClient) forget(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pending, id)
+}
+
+// send publishes the request on the underlying channel consuming the
+// replies, returning its correlation id. The request skips the publish
+// buffer and the republishing, the reply-to is only valid on the
+// channel the request is sent.
+func (c *RPCClient) send(ctx context.Context, exchange, key string, msg amqp.Publishing, result chan rpcResult) (string, error) {
+	c.ch.pub.lock.Lock()
+	defer c.ch.pub.lock.Unlock()
+
+	if c.ch.isClosed() {
+		return "", errChannelClosed
+	}
+	if err := c.ch.Err(); err != nil {
+		return "", err
+	}
+	amqpCh, _ := c.ch.current()
+	if amqpCh == nil || amqpCh.IsClosed() {
+		return "", ErrRPCInterrupted
+	}
+	id, err := c.register(amqpCh, result)
+	if err != nil {
+		return "", err
+	}
+
+	// in confirm mode the request takes a delivery tag that is not
+	// tracked, its confirmation is ignored
+	msg.ReplyTo = DirectReplyTo
+	msg.CorrelationId = id
+	err = c.ch.publish(ctx, amqpCh, &publishing{exchange: exchange, key: key, msg: msg})
+	if err != nil {
+		c.forget(id)
+		if errors.Is(err, amqp.ErrClosed) {
+			return "", ErrRPCInterrupted
+		}
+		return "", err
+	}
+	return id, nil
+}
+
+// register adds a pending call, returning its correlation id. The
+// replies consumer is started on the underlying channel, if it's
+// not consuming from it yet.
+func (c *RPCClient) register(amqpCh *amqp.Channel, result chan rpcResult) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return "", errRPCClientClosed
+	}
+
+	if c.replies != amqpCh {
+		tag := "rpc-" + c.prefix
+		deliveries, err := amqpCh.Consume(DirectReplyTo, tag, true, false, false, false, nil)
+		if err != nil {
+			if errors.Is(err, amqp.ErrClosed) {
+				return "", ErrRPCInterrupted
+			}
+			return "", err
+		}
+		c.replies = amqpCh
+		c.tag = tag
+		go c.receive(amqpCh, deliveries)
+	}
+
+	c.sequence++
+	id := c.prefix + "-" + strconv.FormatUint(c.sequence, 10)
+	c.pending[id] = result
+	return id, nil
+}
+
+// receive resolves the pending calls with their replies. When the
+// underlying channel closes, the pending calls are interrupted.
+func (c *RPCClient) receive(amqpCh *amqp.Channel, deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		c.lock.Lock()
+		result, ok := c.pending[d.CorrelationId]
+		delete(c.pending, d.CorrelationId)
+		c.lock.Unlock()
+		if ok {
+			result <- rpcResult{reply: d}
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.replies != amqpCh {
+		return
+	}
+	c.replies = nil
+	err := ErrRPCInterrupted
+	if c.ch.isClosed() {
+		err = errChannelClosed
+	}
+	c.failPending(err)
+}
+
+// failPending resolves all the pending calls with the error,
+// it must be called with the lock held
+func (c *RPCClient) failPending(err error) {
+	for id, result := range c.pending {
+		result <- rpcResult{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// Close stops consuming the replies, the pending calls fail.
+// The StrongChannel is not closed. It is safe to call this
+// method multiple times.
+func (c *RPCClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.failPending(errRPCClientClosed)
+	if c.replies != nil && !c.replies.IsClosed() {
+		return c.replies.Cancel(c.tag, false)
+	}
+	return nil
+}
+
+// RPCHandler processes a request and returns its reply. An error is sent
+// to the caller as an RPCError, the request is acknowledged anyway.
+type RPCHandler func(d amqp.Delivery) (amqp.Publishing, error)
+
+// ServeRPC consumes the requests with ConsumeWithHandlerContext and
+// publishes the replies of the handler on this channel, to the ReplyTo
+// of each request with its CorrelationId.
+//
+// Requests without ReplyTo are rejected. When the reply cannot be
+// published, the request is requeued once.
+func (ch *StrongChannel) ServeRPC(ctx context.Context, opts *ConsumeOpts, handler RPCHandler, concurrency int) error {
+	if handler == nil {
+		return errNilRPCHandler
+	}
+	return ch.ConsumeWithHandlerContext(ctx, opts, ch.rpcHandler(handler), concurrency)
+}
+
+// rpcHandler returns a Handler that answers the requests with the handler
+func (ch *StrongChannel) rpcHandler(handler RPCHandler) Handler {
+	return func(d amqp.Delivery) Decision {
+		if d.ReplyTo == "" {
+			ch.logger().Warn("rpc request without reply-to", "channel", ch.Name, "deliveryTag", d.DeliveryTag)
+			return Reject
+		}
+
+		reply, err := handler(d)
+		if err != nil {
+			reply = amqp.Publishing{Headers: amqp.Table{RPCErrorHeader: err.Error()}}
+		}
+		reply.CorrelationId = d.CorrelationId
+
+		if err := ch.PublishWithContext(context.Background(), "", d.ReplyTo, false, false, reply); err != nil {
+			ch.logger().Warn("cannot send the rpc reply", "channel", ch.Name,
+				"deliveryTag", d.DeliveryTag, "error", err)
+			return Nack(!d.Redelivered)
+		}
+		return Ack
+	}
+}
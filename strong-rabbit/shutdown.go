@@ -0,0 +1,138 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// drainInterval is how often Shutdown checks the in-flight
+// deliveries and the pending confirmations
+const drainInterval = 10 * time.Millisecond
+
+// Shutdown closes the channel gracefully. The consumer is cancelled, so
+// no new deliveries arrive, then it waits for the in-flight deliveries to
+// be acked, nacked or rejected and for the published messages, including
+// the buffered ones, to be confirmed. Only then the channel is closed,
+// as Close does.
+//
+// When the context is done first, the underlying channel is closed right
+// away and ctx.Err() is returned. The deliveries not acknowledged are
+// requeued by the broker, and the messages not confirmed resolve with an
+// error. The running handlers are still awaited, in background.
+//
+// Messages published during the shutdown are waited too, the publishes
+// should stop before calling it.
+func (ch *StrongChannel) Shutdown(ctx context.Context) error {
+	if ctx == nil {
+		return errors.New("nil Context")
+	}
+
+	ch.cancelConsumer()
+	if err := ch.waitDrained(ctx); err != nil {
+		ch.abort()
+		go ch.Close()
+		return err
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- ch.Close() }()
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		ch.abort()
+		return ctx.Err()
+	}
+}
+
+// abort marks the channel as closed and closes the underlying
+// channel, without waiting for the handlers
+func (ch *StrongChannel) abort() {
+	ch.markClosed()
+
+	if amqpCh, _ := ch.current(); amqpCh != nil {
+		amqpCh.Close()
+	}
+}
+
+// cancelConsumer stops the deliveries of the consumer, the consume
+// loop keeps running, without consuming, until the channel is closed
+func (ch *StrongChannel) cancelConsumer() {
+	ch.consumeLock.Lock()
+	defer ch.consumeLock.Unlock()
+	ch.draining = true
+
+	amqpCh := ch.consuming
+	ch.consuming = nil
+	if amqpCh == nil || amqpCh.IsClosed() {
+		return
+	}
+	if err := amqpCh.Cancel(ch.consumerTag, false); err != nil {
+		ch.logger().Warn("cannot cancel the consumer", "channel", ch.Name,
+			"consumer", ch.consumerTag, "error", err)
+		return
+	}
+	ch.logger().Info("consumer cancelled, draining the deliveries", "channel", ch.Name, "consumer", ch.consumerTag)
+}
+
+// isDraining reports if Shutdown was called on the channel
+func (ch *StrongChannel) isDraining() bool {
+	ch.consumeLock.Lock()
+	defer ch.consumeLock.Unlock()
+	return ch.draining
+}
+
+// idle waits, without consuming, for the consume loop to be stopped
+func (ch *StrongChannel) idle() (keepConsuming bool) {
+	<-ch.consLoopStop
+	return false
+}
+
+// waitDrained waits for the in-flight deliveries to be acknowledged
+// and for the published messages to be confirmed
+func (ch *StrongChannel) waitDrained(ctx context.Context) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for !ch.drained() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// drained reports if there are no deliveries to acknowledge nor
+// messages waiting for their confirmation
+func (ch *StrongChannel) drained() bool {
+	// the channel gave up reconnecting, nothing will be settled
+	if ch.Err() != nil {
+		return true
+	}
+	// the deliveries of a closed underlying channel
+	// can't be acknowledged, the broker requeued them
+	if u := ch.metrics.unacked.Load(); u != nil && !u.ch.IsClosed() && u.len() > 0 {
+		return false
+	}
+	return ch.unconfirmed() == 0
+}
+
+// unconfirmed counts the published messages waiting for their
+// confirmation, the ones to be republished and the buffered ones
+func (ch *StrongChannel) unconfirmed() int {
+	ch.pub.lock.Lock()
+	defer ch.pub.lock.Unlock()
+
+	n := len(ch.pub.republish)
+	if ch.pub.buffer != nil {
+		n += ch.pub.buffer.len()
+	}
+	if t := ch.pub.tracker; t != nil {
+		t.lock.Lock()
+		n += len(t.pending) + len(t.unconfirmed)
+		t.lock.Unlock()
+	}
+	return n
+}
@@ -0,0 +1,198 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// State is the lifecycle state of a StrongConnection or StrongChannel.
+type State int
+
+const (
+	Ready      State = iota + 1 // connected and working
+	Recovering                  // dropped, reconnecting following the ReconnectPolicy
+	Closed                      // closed by Close or Shutdown, it's final
+	Failed                      // gave up reconnecting, it's final, the cause is on Err
+)
+
+var stateNames = map[State]string{
+	Ready:      "Ready",
+	Recovering: "Recovering",
+	Closed:     "Closed",
+	Failed:     "Failed",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "State(" + strconv.Itoa(int(s)) + ")"
+}
+
+// MarshalText encodes the state as its name, eg.: on JSON.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// final reports if the state doesn't change anymore
+func (s State) final() bool {
+	return s == Closed || s == Failed
+}
+
+// stateMachine holds the state of a connection or channel,
+// the zero value is ready to use
+type stateMachine struct {
+	lock      sync.Mutex
+	state     State
+	changed   chan struct{} // closed and replaced on every transition
+	listeners []chan State  // the chans given to NotifyState
+}
+
+// get returns the current state
+func (m *stateMachine) get() State {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.state
+}
+
+// set moves to the given state and notifies the listeners. A final
+// state is not left, it returns false if the state didn't change.
+func (m *stateMachine) set(s State) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.state == s || m.state.final() {
+		return false
+	}
+
+	m.state = s
+	if m.changed != nil {
+		close(m.changed)
+		m.changed = nil
+	}
+	for _, c := range m.listeners {
+		sendState(c, s)
+		if s.final() {
+			close(c)
+		}
+	}
+	if s.final() {
+		m.listeners = nil
+	}
+	return true
+}
+
+// notify registers a listener, the current state is sent right away.
+// On a final state the chan is closed after that.
+func (m *stateMachine) notify(c chan State) chan State {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	sendState(c, m.state)
+	if m.state.final() {
+		close(c)
+		return c
+	}
+	m.listeners = append(m.listeners, c)
+	return c
+}
+
+// sendState delivers the state without blocking, a listener
+// not keeping up misses the states it has no room for
+func sendState(c chan State, s State) {
+	select {
+	case c <- s:
+	default:
+	}
+}
+
+// wait blocks until the state is Ready or final, or the context is
+// done. It returns the last state seen.
+func (m *stateMachine) wait(ctx context.Context) (State, error) {
+	for {
+		m.lock.Lock()
+		s := m.state
+		if m.changed == nil {
+			m.changed = make(chan struct{})
+		}
+		changed := m.changed
+		m.lock.Unlock()
+
+		if s == Ready || s.final() {
+			return s, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return s, ctx.Err()
+		}
+	}
+}
+
+// State returns the current state of the connection.
+func (cn *StrongConnection) State() State {
+	return cn.state.get()
+}
+
+// WaitReady blocks while the connection is recovering. It returns nil
+// when the connection is Ready, amqp.ErrClosed if it's Closed, the Err
+// if it's Failed, and ctx.Err() if the context is done first.
+func (cn *StrongConnection) WaitReady(ctx context.Context) error {
+	if ctx == nil {
+		return errors.New("nil Context")
+	}
+	s, err := cn.state.wait(ctx)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case Closed:
+		return amqp.ErrClosed
+	case Failed:
+		return cn.Err()
+	}
+	return nil
+}
+
+// NotifyState registers a listener for the state changes of the
+// connection, the current state is sent right away. The sends don't
+// block, a buffered chan should be used, the states it has no room
+// for are missed. The chan is closed when the connection is Closed
+// or Failed.
+func (cn *StrongConnection) NotifyState(c chan State) chan State {
+	return cn.state.notify(c)
+}
+
+// State returns the current state of the channel. A channel is Recovering
+// while it reconnects, also when it waits for its connection to redial.
+func (ch *StrongChannel) State() State {
+	return ch.state.get()
+}
+
+// WaitReady blocks while the channel is recovering. It returns nil when
+// the channel is Ready, an error if it's Closed, the Err if it's Failed,
+// and ctx.Err() if the context is done first.
+func (ch *StrongChannel) WaitReady(ctx context.Context) error {
+	if ctx == nil {
+		return errors.New("nil Context")
+	}
+	s, err := ch.state.wait(ctx)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case Closed:
+		return errChannelClosed
+	case Failed:
+		return ch.Err()
+	}
+	return nil
+}
+
+// NotifyState registers a listener for the state changes of the channel,
+// following the same rules of StrongConnection.NotifyState.
+func (ch *StrongChannel) NotifyState(c chan State) chan State {
+	return ch.state.notify(c)
+}
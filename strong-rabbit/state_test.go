@@ -0,0 +1,134 @@
+package strongrabbit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+func TestFinalStatesAreNotLeft(t *testing.T) {
+	// arrange
+	var m stateMachine
+	m.set(Ready)
+	m.set(Failed)
+
+	// act
+	changed := m.set(Ready)
+
+	// assert
+	assert.False(t, changed)
+	assert.Equal(t, Failed, m.get())
+}
+
+func TestNotifyStateSendsTheChanges(t *testing.T) {
+	// arrange
+	var m stateMachine
+	m.set(Ready)
+	states := m.notify(make(chan State, 4))
+
+	// act
+	m.set(Recovering)
+	m.set(Ready)
+	m.set(Closed)
+
+	// assert
+	var received []State
+	for s := range states {
+		received = append(received, s)
+	}
+	assert.Equal(t, []State{Ready, Recovering, Ready, Closed}, received)
+}
+
+func TestNotifyStateOnAFinalStateClosesTheChan(t *testing.T) {
+	// arrange
+	var m stateMachine
+	m.set(Closed)
+
+	// act
+	states := m.notify(make(chan State, 1))
+
+	// assert
+	s, ok := <-states
+	assert.Equal(t, Closed, s)
+	assert.True(t, ok)
+	_, ok = <-states
+	assert.False(t, ok)
+}
+
+func TestWaitReturnsWhenReady(t *testing.T) {
+	// arrange
+	var m stateMachine
+	m.set(Recovering)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.set(Ready)
+	}()
+
+	// act
+	s, err := m.wait(context.Background())
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, Ready, s)
+}
+
+func TestWaitStopsWhenTheContextIsDone(t *testing.T) {
+	// arrange
+	var m stateMachine
+	m.set(Recovering)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// act
+	s, err := m.wait(ctx)
+
+	// assert
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, Recovering, s)
+}
+
+var healthData = map[string]struct {
+	stats    []ConnectionStats
+	expected State
+}{
+	"no connections": {expected: Closed},
+	"all ready": {
+		stats: []ConnectionStats{
+			{Group: "publish", State: Ready, Channels: []ChannelStats{{Name: "orders", State: Ready}}},
+			{Group: "consume", State: Ready},
+		},
+		expected: Ready,
+	},
+	"a channel recovering": {
+		stats: []ConnectionStats{
+			{Group: "publish", State: Ready, Channels: []ChannelStats{
+				{Name: "orders", State: Ready},
+				{Name: "payments", State: Recovering},
+			}},
+		},
+		expected: Recovering,
+	},
+	"a failed connection and a recovering one": {
+		stats: []ConnectionStats{
+			{Group: "publish", State: Recovering},
+			{Group: "consume", State: Failed},
+		},
+		expected: Failed,
+	},
+}
+
+func TestHealth(t *testing.T) {
+	for name, d := range healthData {
+		t.Run(name, func(t *testing.T) {
+			// act
+			report := health(d.stats)
+
+			// assert
+			assert.Equal(t, d.expected, report.Status)
+			assert.Equal(t, len(d.stats), len(report.Connections))
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package strongrabbit
+
+import (
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// topologyKind identifies what a topologyEntry declares
+type topologyKind int
+
+const (
+	exchangeDeclaration topologyKind = iota + 1
+	queueDeclaration
+	queueBinding
+	exchangeBinding
+)
+
+// topologyEntry stores the arguments of a declaration made through
+// a StrongChannel, to make it possible to replay it on reconnection.
+type topologyEntry struct {
+	kind         topologyKind
+	name         string // exchange or queue name, or binding destination
+	exchangeKind string // the exchange type, eg.: direct, fanout, topic
+	key          string // binding routing key
+	source       string // binding source exchange
+	durable      bool
+	autoDelete   bool
+	exclusive    bool
+	internal     bool
+	noWait       bool
+	serverNamed  bool // queue declared without a name, the server picks one
+	args         amqp.Table
+}
+
+// topologyDeclarer is the subset of the *amqp.Channel methods used
+// to restore the topology.
+type topologyDeclarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+}
+
+// topology keeps, in order, the exchanges, queues and bindings
+// declared through a StrongChannel. Deletions remove the matching
+// declarations, so only the live topology is replayed.
+type topology struct {
+	lock    sync.Mutex
+	entries []*topologyEntry
+}
+
+// add records a declaration. If an equivalent declaration was already
+// recorded, it's replaced in place to keep the original order.
+func (t *topology) add(e *topologyEntry) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i := range t.entries {
+		if t.entries[i].sameAs(e) {
+			t.entries[i] = e
+			return
+		}
+	}
+	t.entries = append(t.entries, e)
+}
+
+// remove deletes all the recorded entries that match the filter
+func (t *topology) remove(match func(e *topologyEntry) bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	kept := t.entries[:0]
+	for _, e := range t.entries {
+		if !match(e) {
+			kept = append(kept, e)
+		}
+	}
+	// release the references left after the kept entries
+	for i := len(kept); i < len(t.entries); i++ {
+		t.entries[i] = nil
+	}
+	t.entries = kept
+}
+
+// removeExchange deletes an exchange declaration and every binding
+// where the exchange is the source or the destination
+func (t *topology) removeExchange(name string) {
+	t.remove(func(e *topologyEntry) bool {
+		switch e.kind {
+		case exchangeDeclaration:
+			return e.name == name
+		case queueBinding:
+			return e.source == name
+		case exchangeBinding:
+			return e.source == name || e.name == name
+		}
+		return false
+	})
+}
+
+// removeQueue deletes a queue declaration and its bindings
+func (t *topology) removeQueue(name string) {
+	t.remove(func(e *topologyEntry) bool {
+		return (e.kind == queueDeclaration || e.kind == queueBinding) && e.name == name
+	})
+}
+
+// removeBinding deletes a queue or exchange binding
+func (t *topology) removeBinding(kind topologyKind, destination, key, source string) {
+	t.remove(func(e *topologyEntry) bool {
+		return e.kind == kind && e.name == destination && e.key == key && e.source == source
+	})
+}
+
+// restore replays the recorded topology, in order, on the given channel.
+// Server-named queues receive a new name when redeclared, the returned
+// map has the old names as keys and the new ones as values.
+func (t *topology) restore(ch topologyDeclarer) (renamed map[string]string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	renamed = make(map[string]string)
+	for _, e := range t.entries {
+		switch e.kind {
+		case exchangeDeclaration:
+			err = ch.ExchangeDeclare(e.name, e.exchangeKind, e.durable, e.autoDelete, e.internal, e.noWait, e.args)
+
+		case queueDeclaration:
+			if !e.serverNamed {
+				_, err = ch.QueueDeclare(e.name, e.durable, e.autoDelete, e.exclusive, e.noWait, e.args)
+				break
+			}
+			// redeclared without noWait, the reply has the new name
+			var q amqp.Queue
+			q, err = ch.QueueDeclare("", e.durable, e.autoDelete, e.exclusive, false, e.args)
+			if err == nil && q.Name != "" && q.Name != e.name {
+				renamed[e.name] = q.Name
+				e.name = q.Name
+			}
+
+		case queueBinding:
+			if newName, ok := renamed[e.name]; ok {
+				e.name = newName
+			}
+			err = ch.QueueBind(e.name, e.key, e.source, e.noWait, e.args)
+
+		case exchangeBinding:
+			err = ch.ExchangeBind(e.name, e.key, e.source, e.noWait, e.args)
+		}
+
+		if err != nil {
+			return renamed, err
+		}
+	}
+	return renamed, nil
+}
+
+// restoreQueue redeclares a single queue and its bindings on the given
+// channel. It returns false if the queue was not recorded. A server-named
+// queue receives a new name, which is returned and recorded.
+func (t *topology) restoreQueue(ch topologyDeclarer, name string) (newName string, known bool, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	newName = name
+	for _, e := range t.entries {
+		switch {
+		case e.kind == queueDeclaration && e.name == name:
+			known = true
+			if !e.serverNamed {
+				_, err = ch.QueueDeclare(e.name, e.durable, e.autoDelete, e.exclusive, e.noWait, e.args)
+				break
+			}
+			// redeclared without noWait, the reply has the new name
+			var q amqp.Queue
+			q, err = ch.QueueDeclare("", e.durable, e.autoDelete, e.exclusive, false, e.args)
+			if err == nil && q.Name != "" {
+				newName = q.Name
+				e.name = q.Name
+			}
+
+		case e.kind == queueBinding && e.name == name && known:
+			e.name = newName
+			err = ch.QueueBind(e.name, e.key, e.source, e.noWait, e.args)
+		}
+
+		if err != nil {
+			return newName, known, err
+		}
+	}
+	return newName, known, nil
+}
+
+// sameAs reports if two entries declare the same object
+func (e *topologyEntry) sameAs(other *topologyEntry) bool {
+	if e.kind != other.kind || e.name != other.name {
+		return false
+	}
+	if e.kind == queueBinding || e.kind == exchangeBinding {
+		return e.key == other.key && e.source == other.source
+	}
+	return true
+}
+
+// ExchangeDeclare declares an exchange and records it to be
+// redeclared on reconnection.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.ExchangeDeclare
+func (ch *StrongChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	amqpCh, _ := ch.current()
+	err := amqpCh.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+	if err != nil {
+		return err
+	}
+	ch.topology.add(&topologyEntry{
+		kind:         exchangeDeclaration,
+		name:         name,
+		exchangeKind: kind,
+		durable:      durable,
+		autoDelete:   autoDelete,
+		internal:     internal,
+		noWait:       noWait,
+		args:         args,
+	})
+	return nil
+}
+
+// ExchangeDelete deletes an exchange and removes it, and the bindings
+// that use it, from the topology restored on reconnection.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.ExchangeDelete
+func (ch *StrongChannel) ExchangeDelete(name string, ifUnused, noWait bool) error {
+	amqpCh, _ := ch.current()
+	err := amqpCh.ExchangeDelete(name, ifUnused, noWait)
+	if err != nil {
+		return err
+	}
+	ch.topology.removeExchange(name)
+	return nil
+}
+
+// ExchangeBind binds two exchanges and records the binding to be
+// restored on reconnection.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.ExchangeBind
+func (ch *StrongChannel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	amqpCh, _ := ch.current()
+	err := amqpCh.ExchangeBind(destination, key, source, noWait, args)
+	if err != nil {
+		return err
+	}
+	ch.topology.add(&topologyEntry{
+		kind:   exchangeBinding,
+		name:   destination,
+		key:    key,
+		source: source,
+		noWait: noWait,
+		args:   args,
+	})
+	return nil
+}
+
+// ExchangeUnbind removes an exchange binding, it'll not be restored
+// on reconnection anymore.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.ExchangeUnbind
+func (ch *StrongChannel) ExchangeUnbind(destination, key, source string, noWait bool, args amqp.Table) error {
+	amqpCh, _ := ch.current()
+	err := amqpCh.ExchangeUnbind(destination, key, source, noWait, args)
+	if err != nil {
+		return err
+	}
+	ch.topology.removeBinding(exchangeBinding, destination, key, source)
+	return nil
+}
+
+// QueueDeclare declares a queue and records it to be redeclared on
+// reconnection. Queues declared without a name get a new server
+// generated name when redeclared, always without noWait to receive
+// it, the consumer and the bindings recorded on this channel are
+// updated to use the new name.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.QueueDeclare
+func (ch *StrongChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	amqpCh, _ := ch.current()
+	q, err := amqpCh.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+	if err != nil {
+		return q, err
+	}
+	ch.topology.add(&topologyEntry{
+		kind:        queueDeclaration,
+		name:        q.Name,
+		durable:     durable,
+		autoDelete:  autoDelete,
+		exclusive:   exclusive,
+		noWait:      noWait,
+		serverNamed: name == "",
+		args:        args,
+	})
+	return q, nil
+}
+
+// QueueDelete deletes a queue and removes it, and its bindings, from
+// the topology restored on reconnection.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.QueueDelete
+func (ch *StrongChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	amqpCh, _ := ch.current()
+	purged, err := amqpCh.QueueDelete(name, ifUnused, ifEmpty, noWait)
+	if err != nil {
+		return purged, err
+	}
+	ch.topology.removeQueue(name)
+	return purged, nil
+}
+
+// QueueBind binds a queue to an exchange and records the binding to be
+// restored on reconnection.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.QueueBind
+func (ch *StrongChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	amqpCh, _ := ch.current()
+	err := amqpCh.QueueBind(name, key, exchange, noWait, args)
+	if err != nil {
+		return err
+	}
+	ch.topology.add(&topologyEntry{
+		kind:   queueBinding,
+		name:   name,
+		key:    key,
+		source: exchange,
+		noWait: noWait,
+		args:   args,
+	})
+	return nil
+}
+
+// QueueUnbind removes a queue binding, it'll not be restored on
+// reconnection anymore.
+// For more information check the amqp docs:
+// https://pkg.go.dev/github.com/rabbitmq/amqp091-go#Channel.QueueUnbind
+func (ch *StrongChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	amqpCh, _ := ch.current()
+	err := amqpCh.QueueUnbind(name, key, exchange, args)
+	if err != nil {
+		return err
+	}
+	ch.topology.removeBinding(queueBinding, name, key, exchange)
+	return nil
+}
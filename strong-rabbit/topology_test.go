@@ -0,0 +1,219 @@
+package strongrabbit
+
+import (
+	"fmt"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	assert "github.com/xilapa/go-tiny-projects/test-assertions"
+)
+
+// declarerRecorder records the calls made to restore a topology,
+// server-named queues receive the names on the serverNames slice,
+// like the amqp lib no name is returned with noWait
+type declarerRecorder struct {
+	calls       []string
+	serverNames []string
+}
+
+func (d *declarerRecorder) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	d.calls = append(d.calls, fmt.Sprintf("exchange %s %s", name, kind))
+	return nil
+}
+
+func (d *declarerRecorder) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if noWait {
+		d.calls = append(d.calls, fmt.Sprintf("queue %s nowait", name))
+		return amqp.Queue{Name: name}, nil
+	}
+	if name == "" {
+		name, d.serverNames = d.serverNames[0], d.serverNames[1:]
+	}
+	d.calls = append(d.calls, fmt.Sprintf("queue %s", name))
+	return amqp.Queue{Name: name}, nil
+}
+
+func (d *declarerRecorder) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	d.calls = append(d.calls, fmt.Sprintf("bind queue %s %s %s", name, key, exchange))
+	return nil
+}
+
+func (d *declarerRecorder) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	d.calls = append(d.calls, fmt.Sprintf("bind exchange %s %s %s", destination, key, source))
+	return nil
+}
+
+func TestTopologyIsRestoredInOrder(t *testing.T) {
+	// arrange
+	var tp topology
+	tp.add(&topologyEntry{kind: exchangeDeclaration, name: "orders", exchangeKind: "fanout"})
+	tp.add(&topologyEntry{kind: exchangeDeclaration, name: "audit", exchangeKind: "topic"})
+	tp.add(&topologyEntry{kind: queueDeclaration, name: "orders"})
+	tp.add(&topologyEntry{kind: queueBinding, name: "orders", key: "orders", source: "orders"})
+	tp.add(&topologyEntry{kind: exchangeBinding, name: "audit", key: "#", source: "orders"})
+	// redeclaring keeps the original position
+	tp.add(&topologyEntry{kind: exchangeDeclaration, name: "orders", exchangeKind: "fanout", durable: true})
+	rec := &declarerRecorder{}
+
+	// act
+	renamed, err := tp.restore(rec)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(renamed))
+	assert.Equal(t, []string{
+		"exchange orders fanout",
+		"exchange audit topic",
+		"queue orders",
+		"bind queue orders orders orders",
+		"bind exchange audit # orders",
+	}, rec.calls)
+}
+
+func TestDeletedTopologyIsNotRestored(t *testing.T) {
+	// arrange
+	var tp topology
+	tp.add(&topologyEntry{kind: exchangeDeclaration, name: "orders", exchangeKind: "fanout"})
+	tp.add(&topologyEntry{kind: exchangeDeclaration, name: "audit", exchangeKind: "topic"})
+	tp.add(&topologyEntry{kind: queueDeclaration, name: "orders"})
+	tp.add(&topologyEntry{kind: queueDeclaration, name: "audit"})
+	tp.add(&topologyEntry{kind: queueBinding, name: "orders", key: "orders", source: "orders"})
+	tp.add(&topologyEntry{kind: queueBinding, name: "audit", key: "#", source: "audit"})
+	tp.add(&topologyEntry{kind: exchangeBinding, name: "audit", key: "#", source: "orders"})
+	rec := &declarerRecorder{}
+
+	// act
+	tp.removeExchange("audit")
+	tp.removeQueue("orders")
+
+	// assert
+	_, err := tp.restore(rec)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"exchange orders fanout",
+		"queue audit",
+	}, rec.calls)
+}
+
+func TestServerNamedQueuesAreRenamed(t *testing.T) {
+	// arrange
+	var tp topology
+	tp.add(&topologyEntry{kind: exchangeDeclaration, name: "events", exchangeKind: "fanout"})
+	tp.add(&topologyEntry{kind: queueDeclaration, name: "amq.gen-1", serverNamed: true})
+	tp.add(&topologyEntry{kind: queueBinding, name: "amq.gen-1", source: "events"})
+	rec := &declarerRecorder{serverNames: []string{"amq.gen-2", "amq.gen-3"}}
+
+	// act
+	renamed, err := tp.restore(rec)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"amq.gen-1": "amq.gen-2"}, renamed)
+	assert.Equal(t, "bind queue amq.gen-2  events", rec.calls[2])
+
+	// the new name must be used on the next restore
+	rec.calls = nil
+	renamed, err = tp.restore(rec)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"amq.gen-2": "amq.gen-3"}, renamed)
+	assert.Equal(t, "bind queue amq.gen-3  events", rec.calls[2])
+}
+
+func TestSingleQueueIsRestored(t *testing.T) {
+	// arrange
+	var tp topology
+	tp.add(&topologyEntry{kind: exchangeDeclaration, name: "orders", exchangeKind: "fanout"})
+	tp.add(&topologyEntry{kind: queueDeclaration, name: "orders"})
+	tp.add(&topologyEntry{kind: queueDeclaration, name: "audit"})
+	tp.add(&topologyEntry{kind: queueBinding, name: "orders", key: "orders", source: "orders"})
+	tp.add(&topologyEntry{kind: queueBinding, name: "audit", key: "#", source: "orders"})
+	rec := &declarerRecorder{}
+
+	// act
+	name, known, err := tp.restoreQueue(rec, "orders")
+
+	// assert
+	assert.NoError(t, err)
+	assert.True(t, known)
+	assert.Equal(t, "orders", name)
+	assert.Equal(t, []string{
+		"queue orders",
+		"bind queue orders orders orders",
+	}, rec.calls)
+}
+
+func TestSingleServerNamedQueueIsRenamed(t *testing.T) {
+	// arrange
+	var tp topology
+	tp.add(&topologyEntry{kind: queueDeclaration, name: "amq.gen-1", serverNamed: true})
+	tp.add(&topologyEntry{kind: queueBinding, name: "amq.gen-1", key: "#", source: "orders"})
+	rec := &declarerRecorder{serverNames: []string{"amq.gen-2"}}
+
+	// act
+	name, known, err := tp.restoreQueue(rec, "amq.gen-1")
+
+	// assert
+	assert.NoError(t, err)
+	assert.True(t, known)
+	assert.Equal(t, "amq.gen-2", name)
+	assert.Equal(t, []string{
+		"queue amq.gen-2",
+		"bind queue amq.gen-2 # orders",
+	}, rec.calls)
+}
+
+func TestUnknownQueueIsNotRestored(t *testing.T) {
+	// arrange
+	var tp topology
+	tp.add(&topologyEntry{kind: queueDeclaration, name: "audit"})
+	rec := &declarerRecorder{}
+
+	// act
+	name, known, err := tp.restoreQueue(rec, "orders")
+
+	// assert
+	assert.NoError(t, err)
+	assert.False(t, known)
+	assert.Equal(t, "orders", name)
+	assert.Equal(t, 0, len(rec.calls))
+}
+
+func TestServerNamedQueuesAreRedeclaredWithoutNoWait(t *testing.T) {
+	testCases := map[string]struct {
+		restore func(tp *topology, rec *declarerRecorder) (string, error)
+	}{
+		"whole topology": {
+			restore: func(tp *topology, rec *declarerRecorder) (string, error) {
+				renamed, err := tp.restore(rec)
+				return renamed["amq.gen-1"], err
+			},
+		},
+		"single queue": {
+			restore: func(tp *topology, rec *declarerRecorder) (string, error) {
+				name, _, err := tp.restoreQueue(rec, "amq.gen-1")
+				return name, err
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// arrange
+			var tp topology
+			tp.add(&topologyEntry{kind: queueDeclaration, name: "amq.gen-1", serverNamed: true, noWait: true})
+			tp.add(&topologyEntry{kind: queueBinding, name: "amq.gen-1", key: "#", source: "orders", noWait: true})
+			rec := &declarerRecorder{serverNames: []string{"amq.gen-2"}}
+
+			// act
+			newName, err := tc.restore(&tp, rec)
+
+			// assert
+			assert.NoError(t, err)
+			assert.Equal(t, "amq.gen-2", newName)
+			assert.Equal(t, []string{
+				"queue amq.gen-2",
+				"bind queue amq.gen-2 # orders",
+			}, rec.calls)
+		})
+	}
+}